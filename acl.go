@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// addressList is a list of networks allowed to do something, such as
+// transferring zones.
+type addressList []*net.IPNet
+
+// parseAddressList parses a comma separated list of addresses and networks
+// in CIDR notation. A plain address stands for itself only.
+func parseAddressList(spec string) (addressList, error) {
+	var list addressList
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+// Contains reports whether the address belongs to one of the networks.
+func (l addressList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddrKey holds the address of the client that sent a query in its
+// context.
+type clientAddrKey struct{}
+
+// withClientAddr returns a context carrying the address of the client.
+func withClientAddr(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, ip)
+}
+
+// clientAddr returns the address of the client that sent the query, or nil
+// when unknown.
+func clientAddr(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(clientAddrKey{}).(net.IP)
+	return ip
+}
+
+// addrIP returns the IP address of a UDP or TCP address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
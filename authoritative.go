@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/guoard/godns/dns"
+)
+
+// answerFromZone answers a query for a name of a zone we serve, following
+// the algorithm of RFC 1034 section 4.3.2 as clarified for wildcards by RFC
+// 4592. Aliases are followed as long as they stay in the zone. Names below
+// a zone cut get a referral to the nameservers of the child zone instead of
+// an authoritative answer.
+func answerFromZone(z *zone, qname string, qtype uint16) dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.Response = true
+
+	if !z.Loaded() {
+		packet.Header.Rescode = dns.SERVFAIL
+		return packet
+	}
+	packet.Header.AuthoritativeAnswer = true
+
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+	seen := map[string]bool{name: true}
+	for {
+		node, encloser, cut := z.Find(name, qtype)
+
+		if cut != nil {
+			// Only the aliases already followed are authoritative data.
+			if len(packet.Answers) == 0 {
+				packet.Header.AuthoritativeAnswer = false
+			}
+			nsRecords := cut.RRsets[dns.NS.ToNum()]
+			packet.Authorities = append(packet.Authorities, nsRecords...)
+			packet.Authorities = append(packet.Authorities, z.RRset(cut, dns.DS.ToNum())...)
+			packet.Resources = append(packet.Resources, z.additionalRecords(nsRecords)...)
+			return packet
+		}
+
+		// A name that doesn't exist may still be matched by the wildcard
+		// below its closest encloser, whose records are then synthesized
+		// with the name as their owner (RFC 4592 section 3.3).
+		owner := ""
+		if node == nil {
+			node = encloser.Children["*"]
+			if node == nil {
+				packet.Header.Rescode = dns.NXDOMAIN
+				packet.Authorities = append(packet.Authorities, z.negativeSOA()...)
+				return packet
+			}
+			owner = name
+		}
+
+		rrset := synthesize(z.RRset(node, qtype), owner)
+		if len(rrset) > 0 {
+			packet.Answers = append(packet.Answers, rrset...)
+			packet.Resources = append(packet.Resources, z.additionalRecords(rrset)...)
+			return packet
+		}
+
+		cnames := node.RRsets[dns.CNAME.ToNum()]
+		if len(cnames) == 0 || qtype == dns.CNAME.ToNum() {
+			packet.Authorities = append(packet.Authorities, z.negativeSOA()...)
+			return packet
+		}
+
+		packet.Answers = append(packet.Answers, synthesize(z.RRset(node, dns.CNAME.ToNum()), owner)...)
+
+		// The client resolves aliases leading out of the zone on its own.
+		name = cnames[0].(dns.CNAMERecord).Host
+		if !dns.IsSubdomain(name, z.Origin) || seen[name] || len(seen) > maxCNAMEChain {
+			return packet
+		}
+		seen[name] = true
+	}
+}
+
+// synthesize returns the records of a wildcard with owner as their owner
+// name, or the records as they are when owner is empty. Signatures keep
+// their label count, which tells validators they were synthesized.
+func synthesize(records []dns.DnsRecord, owner string) []dns.DnsRecord {
+	if owner == "" {
+		return records
+	}
+
+	synthesized := make([]dns.DnsRecord, 0, len(records))
+	for _, record := range records {
+		synthesized = append(synthesized, dns.WithDomain(record, owner))
+	}
+	return synthesized
+}
+
+// RRset returns the record set of the given type owned by a node, along
+// with the signatures covering it.
+func (z *zone) RRset(node *zoneNode, qtype uint16) []dns.DnsRecord {
+	rrset := node.RRsets[qtype]
+	if len(rrset) == 0 || qtype == dns.RRSIG.ToNum() {
+		return rrset
+	}
+
+	records := append([]dns.DnsRecord(nil), rrset...)
+	for _, record := range node.RRsets[dns.RRSIG.ToNum()] {
+		if record.(dns.RRSIGRecord).TypeCovered == qtype {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// negativeSOA returns the SOA record sent along with negative answers,
+// whose TTL tells how long the answer may be cached (RFC 2308 section 3).
+func (z *zone) negativeSOA() []dns.DnsRecord {
+	soa := z.SOA()
+	ttl := soa.TTL
+	if soa.Minimum < ttl {
+		ttl = soa.Minimum
+	}
+
+	var records []dns.DnsRecord
+	for _, record := range z.RRset(z.apex, dns.SOA.ToNum()) {
+		records = append(records, dns.WithTTL(record, ttl))
+	}
+	return records
+}
+
+// additionalRecords returns the addresses the zone holds for the hosts
+// named by NS and MX records, which spare the client from looking them up.
+// For a referral, these are the glue records found below the zone cut.
+func (z *zone) additionalRecords(records []dns.DnsRecord) []dns.DnsRecord {
+	var additional []dns.DnsRecord
+	seen := make(map[string]bool)
+	for _, record := range records {
+		var host string
+		switch r := record.(type) {
+		case dns.NSRecord:
+			host = r.Host
+		case dns.MXRecord:
+			host = r.Host
+		default:
+			continue
+		}
+
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		node := z.Node(host)
+		if node == nil {
+			continue
+		}
+		additional = append(additional, node.RRsets[dns.A.ToNum()]...)
+		additional = append(additional, node.RRsets[dns.AAAA.ToNum()]...)
+	}
+	return additional
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/guoard/godns/dns"
+)
+
+// testZone builds a zone from the text of a zone file.
+func testZone(t *testing.T, origin string, text string) *zone {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zone")
+	err := os.WriteFile(path, []byte(text), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := loadZoneFile(origin, path)
+	if err != nil {
+		t.Fatalf("loadZoneFile: %v", err)
+	}
+	return z
+}
+
+const wildcardZone = `
+$ORIGIN example.com.
+$TTL 3600
+@               SOA   ns1 hostmaster 1 7200 3600 1209600 300
+@               NS    ns1
+ns1             A     192.0.2.1
+*.apps          A     192.0.2.10
+*.apps          RRSIG A 13 3 3600 20300101000000 20200101000000 12345 example.com. AAAA
+*.apps          MX    10 mail
+explicit.apps   A     192.0.2.11
+host.sub.apps   A     192.0.2.12
+mail            A     192.0.2.20
+*.alias         CNAME target
+target          A     192.0.2.30
+`
+
+// answerSummary is what the tests compare of an answer: the owner, type and
+// data of each record.
+func answerSummary(records []dns.DnsRecord) []string {
+	var summary []string
+	for _, record := range records {
+		line := dns.RecordDomain(record)
+		switch r := record.(type) {
+		case dns.ARecord:
+			line += " A " + r.Addr.String()
+		case dns.CNAMERecord:
+			line += " CNAME " + r.Host
+		case dns.MXRecord:
+			line += " MX " + r.Host
+		case dns.SOARecord:
+			line += " SOA"
+		case dns.NSRecord:
+			line += " NS " + r.Host
+		case dns.DSRecord:
+			line += " DS"
+		case dns.RRSIGRecord:
+			line += " RRSIG"
+		case dns.NSECRecord:
+			line += " NSEC " + r.NextDomain
+		case dns.NSEC3Record:
+			line += " NSEC3"
+		default:
+			line += " ?"
+		}
+		summary = append(summary, line)
+	}
+	return summary
+}
+
+func sameSummary(got []string, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWildcardAnswers(t *testing.T) {
+	z := testZone(t, "example.com", wildcardZone)
+
+	tests := []struct {
+		name        string
+		qname       string
+		qtype       dns.QueryType
+		rescode     dns.ResultCode
+		answers     []string
+		authorities []string
+	}{
+		{"match through the wildcard", "foo.apps.example.com", dns.A, dns.NOERROR,
+			[]string{"foo.apps.example.com A 192.0.2.10", "foo.apps.example.com RRSIG"}, nil},
+		{"match of another type through the wildcard", "foo.apps.example.com", dns.MX, dns.NOERROR,
+			[]string{"foo.apps.example.com MX mail.example.com"}, nil},
+		{"wildcard without the type", "foo.apps.example.com", dns.AAAA, dns.NOERROR,
+			nil, []string{"example.com SOA"}},
+		{"name more than one label below the wildcard", "a.b.apps.example.com", dns.A, dns.NOERROR,
+			[]string{"a.b.apps.example.com A 192.0.2.10", "a.b.apps.example.com RRSIG"}, nil},
+		{"explicit name takes precedence", "explicit.apps.example.com", dns.A, dns.NOERROR,
+			[]string{"explicit.apps.example.com A 192.0.2.11"}, nil},
+		{"explicit name without the type", "explicit.apps.example.com", dns.MX, dns.NOERROR,
+			nil, []string{"example.com SOA"}},
+		{"empty non-terminal blocks the wildcard", "sub.apps.example.com", dns.A, dns.NOERROR,
+			nil, []string{"example.com SOA"}},
+		{"name below an empty non-terminal", "x.sub.apps.example.com", dns.A, dns.NXDOMAIN,
+			nil, []string{"example.com SOA"}},
+		{"closest encloser without a wildcard", "nothing.example.com", dns.A, dns.NXDOMAIN,
+			nil, []string{"example.com SOA"}},
+		{"wildcard CNAME followed in the zone", "x.alias.example.com", dns.A, dns.NOERROR,
+			[]string{"x.alias.example.com CNAME target.example.com", "target.example.com A 192.0.2.30"}, nil},
+		{"wildcard CNAME asked for", "x.alias.example.com", dns.CNAME, dns.NOERROR,
+			[]string{"x.alias.example.com CNAME target.example.com"}, nil},
+		{"wildcard asked for by name", "*.apps.example.com", dns.A, dns.NOERROR,
+			[]string{"*.apps.example.com A 192.0.2.10", "*.apps.example.com RRSIG"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := answerFromZone(z, test.qname, test.qtype.ToNum())
+
+			if packet.Header.Rescode != test.rescode {
+				t.Errorf("rescode = %v, want %v", packet.Header.Rescode, test.rescode)
+			}
+			if !packet.Header.AuthoritativeAnswer {
+				t.Error("AA is not set")
+			}
+			if answers := answerSummary(packet.Answers); !sameSummary(answers, test.answers) {
+				t.Errorf("answers = %q, want %q", answers, test.answers)
+			}
+			if authorities := answerSummary(packet.Authorities); !sameSummary(authorities, test.authorities) {
+				t.Errorf("authorities = %q, want %q", authorities, test.authorities)
+			}
+		})
+	}
+}
+
+func TestWildcardSignatureLabels(t *testing.T) {
+	z := testZone(t, "example.com", wildcardZone)
+	packet := answerFromZone(z, "a.b.apps.example.com", dns.A.ToNum())
+
+	found := false
+	for _, record := range packet.Answers {
+		sig, ok := record.(dns.RRSIGRecord)
+		if !ok {
+			continue
+		}
+		found = true
+		if sig.Domain != "a.b.apps.example.com" {
+			t.Errorf("signature owner = %s, want the query name", sig.Domain)
+		}
+		if sig.Labels != 3 {
+			t.Errorf("signature labels = %d, want the 3 labels of the wildcard", sig.Labels)
+		}
+	}
+	if !found {
+		t.Fatal("no signature in the answer")
+	}
+
+	// The records of the zone itself keep the wildcard as their owner.
+	node := z.Node("*.apps.example.com")
+	if owner := dns.RecordDomain(node.RRsets[dns.A.ToNum()][0]); owner != "*.apps.example.com" {
+		t.Errorf("synthesizing changed the owner in the zone to %s", owner)
+	}
+}
+
+const delegationZone = `
+$ORIGIN example.com.
+$TTL 3600
+@               SOA   ns1 hostmaster 1 7200 3600 1209600 300
+@               NS    ns1
+@               MX    10 mail
+ns1             A     192.0.2.1
+mail            A     192.0.2.2
+www             A     192.0.2.3
+sub             NS    ns.sub
+sub             NS    ns.other.net.
+sub             DS    12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+ns.sub          A     192.0.2.53
+`
+
+func TestAuthoritativeAnswers(t *testing.T) {
+	z := testZone(t, "example.com", delegationZone)
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         dns.QueryType
+		rescode       dns.ResultCode
+		authoritative bool
+		answers       []string
+		authorities   []string
+		additional    []string
+	}{
+		{"answer", "www.example.com", dns.A, dns.NOERROR, true,
+			[]string{"www.example.com A 192.0.2.3"}, nil, nil},
+		{"answer ignoring case", "WWW.Example.COM.", dns.A, dns.NOERROR, true,
+			[]string{"www.example.com A 192.0.2.3"}, nil, nil},
+		{"answer with additional addresses", "example.com", dns.MX, dns.NOERROR, true,
+			[]string{"example.com MX mail.example.com"}, nil, []string{"mail.example.com A 192.0.2.2"}},
+		{"no data", "www.example.com", dns.AAAA, dns.NOERROR, true,
+			nil, []string{"example.com SOA"}, nil},
+		{"no such name", "nothing.example.com", dns.A, dns.NXDOMAIN, true,
+			nil, []string{"example.com SOA"}, nil},
+		{"referral at the zone cut", "sub.example.com", dns.A, dns.NOERROR, false,
+			nil, []string{"sub.example.com NS ns.sub.example.com", "sub.example.com NS ns.other.net", "sub.example.com DS"}, []string{"ns.sub.example.com A 192.0.2.53"}},
+		{"referral below the zone cut", "www.sub.example.com", dns.A, dns.NOERROR, false,
+			nil, []string{"sub.example.com NS ns.sub.example.com", "sub.example.com NS ns.other.net", "sub.example.com DS"}, []string{"ns.sub.example.com A 192.0.2.53"}},
+		{"referral for glue", "ns.sub.example.com", dns.A, dns.NOERROR, false,
+			nil, []string{"sub.example.com NS ns.sub.example.com", "sub.example.com NS ns.other.net", "sub.example.com DS"}, []string{"ns.sub.example.com A 192.0.2.53"}},
+		{"DS at the zone cut from the parent side", "sub.example.com", dns.DS, dns.NOERROR, true,
+			[]string{"sub.example.com DS"}, nil, nil},
+		{"DS below the zone cut", "www.sub.example.com", dns.DS, dns.NOERROR, false,
+			nil, []string{"sub.example.com NS ns.sub.example.com", "sub.example.com NS ns.other.net", "sub.example.com DS"}, []string{"ns.sub.example.com A 192.0.2.53"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := answerFromZone(z, test.qname, test.qtype.ToNum())
+
+			if !packet.Header.Response {
+				t.Error("QR is not set")
+			}
+			if packet.Header.Rescode != test.rescode {
+				t.Errorf("rescode = %v, want %v", packet.Header.Rescode, test.rescode)
+			}
+			if packet.Header.AuthoritativeAnswer != test.authoritative {
+				t.Errorf("AA = %v, want %v", packet.Header.AuthoritativeAnswer, test.authoritative)
+			}
+			if answers := answerSummary(packet.Answers); !sameSummary(answers, test.answers) {
+				t.Errorf("answers = %q, want %q", answers, test.answers)
+			}
+			if authorities := answerSummary(packet.Authorities); !sameSummary(authorities, test.authorities) {
+				t.Errorf("authorities = %q, want %q", authorities, test.authorities)
+			}
+			if additional := answerSummary(packet.Resources); !sameSummary(additional, test.additional) {
+				t.Errorf("additional = %q, want %q", additional, test.additional)
+			}
+		})
+	}
+}
+
+func TestNegativeAnswerSOATTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		soa     string
+		wantTTL uint32
+	}{
+		{"TTL above the minimum", "@ 3600 SOA ns1 hostmaster 1 7200 3600 1209600 300", 300},
+		{"TTL below the minimum", "@ 60 SOA ns1 hostmaster 1 7200 3600 1209600 300", 60},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			z := testZone(t, "example.com", "$ORIGIN example.com.\n"+test.soa+"\n@ 3600 NS ns1\nns1 3600 A 192.0.2.1\n")
+
+			for _, qname := range []string{"ns1.example.com", "nothing.example.com"} {
+				packet := answerFromZone(z, qname, dns.MX.ToNum())
+				soa := packet.GetSOA()
+				if soa == nil {
+					t.Fatalf("%s: no SOA record in the authority section", qname)
+				}
+				if soa.TTL != test.wantTTL {
+					t.Errorf("%s: SOA TTL = %d, want %d", qname, soa.TTL, test.wantTTL)
+				}
+			}
+
+			// Asked for directly, the SOA record keeps its own TTL.
+			packet := answerFromZone(z, "example.com", dns.SOA.ToNum())
+			if len(packet.Answers) != 1 || dns.RecordTTL(packet.Answers[0]) != z.SOA().TTL {
+				t.Errorf("SOA answer = %+v, want the record with its TTL of %d", packet.Answers, z.SOA().TTL)
+			}
+		})
+	}
+}
+
+func TestAnswerFromUnloadedZone(t *testing.T) {
+	var z *zone
+	packet := answerFromZone(z, "www.example.com", dns.A.ToNum())
+	if packet.Header.Rescode != dns.SERVFAIL || packet.Header.AuthoritativeAnswer {
+		t.Errorf("header = %+v, want SERVFAIL without AA", packet.Header)
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// maxCacheTTL caps how long a record set is cached, whatever its TTL says.
+const maxCacheTTL = 24 * time.Hour
+
+// maxNegativeCacheTTL caps how long a negative answer is cached, following
+// the upper bound suggested in RFC 2308.
+const maxNegativeCacheTTL = 3 * time.Hour
+
+// cacheKey identifies a record set in the cache.
+type cacheKey struct {
+	Name  string
+	Qtype uint16
+	Class uint16
+}
+
+func newCacheKey(name string, qtype uint16) cacheKey {
+	return cacheKey{
+		Name:  strings.ToLower(strings.TrimSuffix(name, ".")),
+		Qtype: qtype,
+		Class: dns.ClassIN,
+	}
+}
+
+// cacheEntry is a cached record set and its signatures, along with whether
+// it was validated as secure and the moment it expires.
+type cacheEntry struct {
+	Records []dns.DnsRecord
+	Secure  bool
+	Expires time.Time
+}
+
+// negativeEntry records that a name, or a type at a name, does not exist,
+// along with the authority records that prove it: the SOA record and, for
+// signed zones, its signature and the NSEC or NSEC3 records.
+type negativeEntry struct {
+	Rescode     dns.ResultCode
+	Authorities []dns.DnsRecord
+	Secure      bool
+	Expires     time.Time
+}
+
+// recordCache is a TTL-aware cache of record sets, safe for concurrent use.
+// Delegations and glue are kept apart from answers so that referral data is
+// only used to find nameservers and never handed to clients.
+type recordCache struct {
+	mu          sync.RWMutex
+	answers     map[cacheKey]cacheEntry
+	delegations map[cacheKey]cacheEntry
+	glue        map[cacheKey]cacheEntry
+	negative    map[cacheKey]negativeEntry
+
+	// nxdomains holds the names known not to exist. NXDOMAIN covers every
+	// type at the name, so these entries are keyed by name alone.
+	nxdomains map[string]negativeEntry
+
+	// denials holds the SOA, NSEC and NSEC3 record sets learned from secure
+	// negative answers, grouped by the SOA record of their zone.
+	denials map[cacheKey]map[cacheKey]cacheEntry
+}
+
+func newRecordCache() *recordCache {
+	return &recordCache{
+		answers:     make(map[cacheKey]cacheEntry),
+		delegations: make(map[cacheKey]cacheEntry),
+		glue:        make(map[cacheKey]cacheEntry),
+		negative:    make(map[cacheKey]negativeEntry),
+		nxdomains:   make(map[string]negativeEntry),
+		denials:     make(map[cacheKey]map[cacheKey]cacheEntry),
+	}
+}
+
+// Lookup returns the cached answer for the name and type as a packet
+// holding the record set and its signatures, with TTLs reflecting the time
+// left before the entry expires and the AD bit set if it was secure.
+func (c *recordCache) Lookup(name string, qtype uint16) (*dns.DnsPacket, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, found := lookupEntry(c.answers, newCacheKey(name, qtype), time.Now())
+	if !found {
+		return nil, false
+	}
+
+	packet := dns.NewDnsPacket()
+	packet.Header.AuthedData = entry.Secure
+	packet.Answers = entry.Records
+	return &packet, true
+}
+
+// StoreAnswers caches the record sets found in an answer section, noting
+// whether they were validated as secure.
+func (c *recordCache) StoreAnswers(records []dns.DnsRecord, secure bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	storeRecordSets(c.answers, records, secure, time.Now())
+}
+
+// StoreNegative caches an NXDOMAIN or NODATA response to a query. As RFC 2308
+// requires, the entry lives for the lower of the SOA TTL and its MINIMUM
+// field, and responses without an SOA record are not cached at all.
+func (c *recordCache) StoreNegative(qname string, qtype uint16, packet *dns.DnsPacket) {
+	soa := packet.GetSOA()
+	if soa == nil {
+		return
+	}
+
+	ttl := soa.TTL
+	if soa.Minimum < ttl {
+		ttl = soa.Minimum
+	}
+
+	duration := time.Duration(ttl) * time.Second
+	if duration <= 0 {
+		return
+	}
+	if duration > maxNegativeCacheTTL {
+		duration = maxNegativeCacheTTL
+	}
+
+	key := newCacheKey(qname, qtype)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var authorities []dns.DnsRecord
+	for _, record := range packet.Authorities {
+		if _, ok := record.(dns.NSRecord); !ok {
+			authorities = append(authorities, record)
+		}
+	}
+
+	now := time.Now()
+	entry := negativeEntry{
+		Rescode:     packet.Header.Rescode,
+		Authorities: authorities,
+		Secure:      packet.Header.AuthedData,
+		Expires:     now.Add(duration),
+	}
+	if packet.Header.Rescode == dns.NXDOMAIN {
+		c.nxdomains[key.Name] = entry
+	} else {
+		c.negative[key] = entry
+	}
+
+	// The records proving a secure denial also prove that the other names
+	// in the same ranges don't exist. They are kept no longer than the
+	// denial itself (RFC 8198 section 5.4).
+	if packet.Header.AuthedData {
+		zoneKey := newCacheKey(soa.Domain, dns.SOA.ToNum())
+		entries, found := c.denials[zoneKey]
+		if !found {
+			entries = make(map[cacheKey]cacheEntry)
+			c.denials[zoneKey] = entries
+		}
+
+		maxTTL := uint32(duration / time.Second)
+		var records []dns.DnsRecord
+		for _, record := range authorities {
+			if dns.RecordTTL(record) > maxTTL {
+				record = dns.WithTTL(record, maxTTL)
+			}
+			records = append(records, record)
+		}
+		storeRecordSets(entries, records, true, now)
+	}
+}
+
+// LookupNegative returns the cached negative response for the name and type
+// as a packet carrying the result code, with the SOA record and the proof of
+// the denial in its authority section.
+func (c *recordCache) LookupNegative(qname string, qtype uint16) (*dns.DnsPacket, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key := newCacheKey(qname, qtype)
+	var entries []negativeEntry
+	if entry, found := c.nxdomains[key.Name]; found {
+		entries = append(entries, entry)
+	}
+	if entry, found := c.negative[key]; found {
+		entries = append(entries, entry)
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		remaining := entry.Expires.Sub(now) / time.Second
+		if remaining <= 0 {
+			continue
+		}
+
+		packet := dns.NewDnsPacket()
+		packet.Header.Rescode = entry.Rescode
+		packet.Header.AuthedData = entry.Secure
+		for _, record := range entry.Authorities {
+			packet.Authorities = append(packet.Authorities, dns.WithTTL(record, uint32(remaining)))
+		}
+		return &packet, true
+	}
+
+	return nil, false
+}
+
+// SynthesizeDenial answers a query from the NSEC or NSEC3 records cached for
+// the closest zone above qname, when they prove on their own that the name
+// or the type doesn't exist, without asking the servers of the zone (RFC
+// 8198). Only denials that would be secure are synthesized.
+func (c *recordCache) SynthesizeDenial(qname string, qtype dns.QueryType) (*dns.DnsPacket, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// DS records are denied by the zone above the one they are about.
+	zone := qname
+	if qtype == dns.DS && qname != "" {
+		zone = parentDomain(qname)
+	}
+
+	var entries map[cacheKey]cacheEntry
+	for {
+		var found bool
+		entries, found = c.denials[newCacheKey(zone, dns.SOA.ToNum())]
+		if found {
+			break
+		}
+		if zone == "" {
+			return nil, false
+		}
+		zone = parentDomain(zone)
+	}
+
+	now := time.Now()
+	soa, found := lookupEntry(entries, newCacheKey(zone, dns.SOA.ToNum()), now)
+	if !found {
+		return nil, false
+	}
+
+	// Only the records matching or covering qname, its ancestors in the
+	// zone or the wildcards below them take part in a proof.
+	var names []string
+	for name := qname; ; name = parentDomain(name) {
+		names = append(names, name, wildcardName(name))
+		if dns.IsSubdomain(zone, name) {
+			break
+		}
+	}
+
+	var authorities []dns.DnsRecord
+	var nsecs []dns.NSECRecord
+	var nsec3s []dns.NSEC3Record
+	var hashes [][]byte
+	for key := range entries {
+		entry, found := lookupEntry(entries, key, now)
+		if !found {
+			continue
+		}
+
+		relevant := false
+		for _, record := range entry.Records {
+			switch record := record.(type) {
+			case dns.NSECRecord:
+				if nsecRelevant(record, names) {
+					nsecs = append(nsecs, record)
+					relevant = true
+				}
+			case dns.NSEC3Record:
+				if hashes == nil {
+					hashes = nsec3Hashes(record, names)
+				}
+				if nsec3Relevant(record, hashes) {
+					nsec3s = append(nsec3s, record)
+					relevant = true
+				}
+			}
+		}
+		if relevant {
+			authorities = append(authorities, entry.Records...)
+		}
+	}
+
+	packet := dns.NewDnsPacket()
+	packet.Header.AuthedData = true
+	packet.Authorities = append(soa.Records, authorities...)
+
+	switch {
+	case len(nsecs) > 0 && proveNSECDenial(qname, qtype, true, nsecs) == nil:
+		packet.Header.Rescode = dns.NXDOMAIN
+	case len(nsecs) > 0 && proveNSECDenial(qname, qtype, false, nsecs) == nil:
+		packet.Header.Rescode = dns.NOERROR
+	case len(nsec3s) > 0 && nsec3Denies(zone, qname, qtype, true, nsec3s):
+		packet.Header.Rescode = dns.NXDOMAIN
+	case len(nsec3s) > 0 && nsec3Denies(zone, qname, qtype, false, nsec3s):
+		packet.Header.Rescode = dns.NOERROR
+	default:
+		return nil, false
+	}
+	return &packet, true
+}
+
+// StoreReferral caches the NS records in the authority section of a response
+// as delegations, and the addresses of those nameservers from the additional
+// section as glue.
+func (c *recordCache) StoreReferral(packet *dns.DnsPacket) {
+	var nsRecords []dns.DnsRecord
+	for _, record := range packet.Authorities {
+		if _, ok := record.(dns.NSRecord); ok {
+			nsRecords = append(nsRecords, record)
+		}
+	}
+
+	c.StoreDelegation(nsRecords, packet.Resources)
+}
+
+// StoreDelegation caches a set of NS records as a delegation, along with the
+// addresses of those nameservers found among the additional records.
+func (c *recordCache) StoreDelegation(nsRecords []dns.DnsRecord, additional []dns.DnsRecord) {
+	hosts := make(map[string]bool)
+	for _, record := range nsRecords {
+		hosts[record.(dns.NSRecord).Host] = true
+	}
+
+	var glue []dns.DnsRecord
+	for _, record := range additional {
+		switch record.(type) {
+		case dns.ARecord, dns.AAAARecord:
+			if hosts[dns.RecordDomain(record)] {
+				glue = append(glue, record)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	storeRecordSets(c.delegations, nsRecords, false, now)
+	storeRecordSets(c.glue, glue, false, now)
+}
+
+// LookupNameservers returns the closest zone enclosing qname for which both
+// a delegation and addresses are cached, along with the addresses of its
+// nameservers, or nil if there is none.
+func (c *recordCache) LookupNameservers(qname string) (string, []net.IP) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	zone := qname
+	for {
+		entry, found := lookupEntry(c.delegations, newCacheKey(zone, dns.NS.ToNum()), now)
+		if found {
+			var addrs []net.IP
+			for _, record := range entry.Records {
+				addrs = append(addrs, c.lookupAddrs(record.(dns.NSRecord).Host, now)...)
+			}
+			if len(addrs) > 0 {
+				return zone, addrs
+			}
+		}
+
+		if zone == "" {
+			return "", nil
+		}
+		zone = parentDomain(zone)
+	}
+}
+
+// lookupAddrs finds the IPv4 and IPv6 addresses of host in the glue,
+// falling back to regular answers. The caller must hold the lock.
+func (c *recordCache) lookupAddrs(host string, now time.Time) []net.IP {
+	var addrs []net.IP
+	for _, qtype := range []dns.QueryType{dns.A, dns.AAAA} {
+		key := newCacheKey(host, qtype.ToNum())
+
+		entry, found := lookupEntry(c.glue, key, now)
+		if !found {
+			entry, found = lookupEntry(c.answers, key, now)
+		}
+		if !found {
+			continue
+		}
+
+		addrs = append(addrs, recordAddrs(entry.Records)...)
+	}
+	return addrs
+}
+
+// Prune removes every expired entry from the cache.
+func (c *recordCache) Prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, entries := range []map[cacheKey]cacheEntry{c.answers, c.delegations, c.glue} {
+		for key, entry := range entries {
+			if !entry.Expires.After(now) {
+				delete(entries, key)
+			}
+		}
+	}
+
+	for key, entry := range c.negative {
+		if !entry.Expires.After(now) {
+			delete(c.negative, key)
+		}
+	}
+
+	for name, entry := range c.nxdomains {
+		if !entry.Expires.After(now) {
+			delete(c.nxdomains, name)
+		}
+	}
+
+	for zoneKey, entries := range c.denials {
+		for key, entry := range entries {
+			if !entry.Expires.After(now) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(c.denials, zoneKey)
+		}
+	}
+}
+
+// lookupEntry returns a copy of the entry stored under key, with the TTLs of
+// its records decremented by the time spent in the cache.
+func lookupEntry(entries map[cacheKey]cacheEntry, key cacheKey, now time.Time) (cacheEntry, bool) {
+	entry, found := entries[key]
+	if !found {
+		return cacheEntry{}, false
+	}
+
+	remaining := entry.Expires.Sub(now) / time.Second
+	if remaining <= 0 {
+		return cacheEntry{}, false
+	}
+
+	records := make([]dns.DnsRecord, 0, len(entry.Records))
+	for _, record := range entry.Records {
+		records = append(records, dns.WithTTL(record, uint32(remaining)))
+	}
+	entry.Records = records
+	return entry, true
+}
+
+// storeRecordSets groups the records by owner and type and stores each set
+// for the lowest TTL found in it, along with the signatures covering it.
+// Sets with a zero TTL are not cached.
+func storeRecordSets(entries map[cacheKey]cacheEntry, records []dns.DnsRecord, secure bool, now time.Time) {
+	sets := make(map[cacheKey][]dns.DnsRecord)
+	ttls := make(map[cacheKey]uint32)
+	for _, record := range records {
+		if _, ok := record.(dns.OPTRecord); ok {
+			continue
+		}
+
+		key := newCacheKey(dns.RecordDomain(record), dns.RecordType(record))
+		if sig, ok := record.(dns.RRSIGRecord); ok {
+			key.Qtype = sig.TypeCovered
+		}
+
+		ttl := dns.RecordTTL(record)
+		if _, seen := sets[key]; !seen || ttl < ttls[key] {
+			ttls[key] = ttl
+		}
+		sets[key] = append(sets[key], record)
+	}
+
+	for key, set := range sets {
+		ttl := time.Duration(ttls[key]) * time.Second
+		if ttl <= 0 {
+			continue
+		}
+		if ttl > maxCacheTTL {
+			ttl = maxCacheTTL
+		}
+
+		entries[key] = cacheEntry{
+			Records: set,
+			Secure:  secure,
+			Expires: now.Add(ttl),
+		}
+	}
+}
+
+// nsecRelevant reports whether the NSEC record matches or covers one of the
+// names.
+func nsecRelevant(nsec dns.NSECRecord, names []string) bool {
+	for _, name := range names {
+		if dns.CompareNames(nsec.Domain, name) == 0 || dns.NSECCovers(nsec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Hashes hashes the names with the parameters of the NSEC3 record,
+// leaving out the names that can't be hashed.
+func nsec3Hashes(nsec3 dns.NSEC3Record, names []string) [][]byte {
+	hashes := [][]byte{}
+	if nsec3.Iterations > maxNSEC3Iterations {
+		return hashes
+	}
+
+	for _, name := range names {
+		hash, err := dns.NSEC3Hash(name, nsec3.HashAlgorithm, nsec3.Iterations, nsec3.Salt)
+		if err == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// nsec3Relevant reports whether the NSEC3 record matches or covers one of
+// the hashes.
+func nsec3Relevant(nsec3 dns.NSEC3Record, hashes [][]byte) bool {
+	for _, hash := range hashes {
+		if dns.NSEC3Matches(nsec3, hash) || dns.NSEC3Covers(nsec3, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Denies reports whether the NSEC3 records of zone securely prove the
+// denial.
+func nsec3Denies(zone string, qname string, qtype dns.QueryType, nxdomain bool, nsec3s []dns.NSEC3Record) bool {
+	proof, ok := newNSEC3Proof(zone, nsec3s)
+	if !ok {
+		return false
+	}
+
+	secure, err := proof.proveDenial(qname, qtype, nxdomain)
+	return err == nil && secure
+}
+
+// recordAddrs returns the addresses found in the A and AAAA records.
+func recordAddrs(records []dns.DnsRecord) []net.IP {
+	var addrs []net.IP
+	for _, record := range records {
+		switch addrRecord := record.(type) {
+		case dns.ARecord:
+			addrs = append(addrs, addrRecord.Addr)
+		case dns.AAAARecord:
+			addrs = append(addrs, addrRecord.Addr)
+		}
+	}
+	return addrs
+}
+
+// parentDomain strips the leftmost label from a domain name.
+func parentDomain(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i < 0 {
+		return ""
+	}
+	return name[i+1:]
+}
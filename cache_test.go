@@ -0,0 +1,410 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+func negativeResponse(rescode dns.ResultCode) *dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.Rescode = rescode
+	packet.Authorities = append(packet.Authorities, dns.SOARecord{
+		Domain:  "example.com",
+		MName:   "ns1.example.com",
+		RName:   "hostmaster.example.com",
+		Serial:  1,
+		Minimum: 300,
+		TTL:     3600,
+	})
+	return &packet
+}
+
+func TestNegativeCache(t *testing.T) {
+	txt := uint16(16)
+	ptr := uint16(12)
+
+	tests := []struct {
+		name        string
+		storeName   string
+		storeType   uint16
+		rescode     dns.ResultCode
+		lookupName  string
+		lookupType  uint16
+		wantFound   bool
+		wantRescode dns.ResultCode
+	}{
+		{"NODATA for the same type", "host.example.com", dns.A.ToNum(), dns.NOERROR, "host.example.com", dns.A.ToNum(), true, dns.NOERROR},
+		{"NODATA for another type", "host.example.com", dns.A.ToNum(), dns.NOERROR, "host.example.com", dns.AAAA.ToNum(), false, dns.NOERROR},
+		{"NODATA for a type without a constant", "host.example.com", txt, dns.NOERROR, "host.example.com", dns.A.ToNum(), false, dns.NOERROR},
+		{"NODATA between types without a constant", "host.example.com", txt, dns.NOERROR, "host.example.com", ptr, false, dns.NOERROR},
+		{"NODATA for the same type without a constant", "host.example.com", txt, dns.NOERROR, "host.example.com", txt, true, dns.NOERROR},
+		{"NXDOMAIN for every type", "gone.example.com", dns.A.ToNum(), dns.NXDOMAIN, "gone.example.com", txt, true, dns.NXDOMAIN},
+		{"NXDOMAIN ignoring case", "gone.example.com", dns.A.ToNum(), dns.NXDOMAIN, "Gone.Example.com.", dns.MX.ToNum(), true, dns.NXDOMAIN},
+		{"NXDOMAIN for another name", "gone.example.com", dns.A.ToNum(), dns.NXDOMAIN, "other.example.com", dns.A.ToNum(), false, dns.NOERROR},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newRecordCache()
+			c.StoreNegative(test.storeName, test.storeType, negativeResponse(test.rescode))
+
+			packet, found := c.LookupNegative(test.lookupName, test.lookupType)
+			if found != test.wantFound {
+				t.Fatalf("found = %v, want %v", found, test.wantFound)
+			}
+			if !found {
+				return
+			}
+			if packet.Header.Rescode != test.wantRescode {
+				t.Errorf("rescode = %v, want %v", packet.Header.Rescode, test.wantRescode)
+			}
+			soa := packet.GetSOA()
+			if soa == nil || soa.TTL > 300 {
+				t.Errorf("SOA = %+v, want one with a TTL of at most the SOA minimum", soa)
+			}
+		})
+	}
+}
+
+func TestNegativeCacheWithoutSOA(t *testing.T) {
+	c := newRecordCache()
+	packet := dns.NewDnsPacket()
+	packet.Header.Rescode = dns.NXDOMAIN
+	c.StoreNegative("gone.example.com", dns.A.ToNum(), &packet)
+
+	_, found := c.LookupNegative("gone.example.com", dns.A.ToNum())
+	if found {
+		t.Error("negative response without an SOA record was cached")
+	}
+}
+
+// storeSecureDenial caches a validated negative answer from zone for qname,
+// proven by the records.
+func storeSecureDenial(c *recordCache, zone string, qname string, rescode dns.ResultCode, proof ...dns.DnsRecord) {
+	packet := dns.NewDnsPacket()
+	packet.Header.Rescode = rescode
+	packet.Header.AuthedData = true
+	packet.Authorities = append(packet.Authorities, dns.SOARecord{Domain: zone, MName: "ns1." + zone, RName: "hostmaster." + zone, Serial: 1, Minimum: 300, TTL: 3600})
+	packet.Authorities = append(packet.Authorities, proof...)
+	c.StoreNegative(qname, dns.A.ToNum(), &packet)
+}
+
+func nsecRecord(name string, next string, types ...dns.QueryType) dns.NSECRecord {
+	var nums []uint16
+	for _, qtype := range types {
+		nums = append(nums, qtype.ToNum())
+	}
+	return dns.NSECRecord{Domain: name, NextDomain: next, Types: nums, TTL: 3600}
+}
+
+func TestSynthesizeDenial(t *testing.T) {
+	// The zone holds example.com, a.example.com and m.example.com. The
+	// record of the apex also rules out the wildcard *.example.com.
+	apex := nsecRecord("example.com", "a.example.com", dns.NS, dns.SOA, dns.RRSIG, dns.NSEC, dns.DNSKEY)
+	a := nsecRecord("a.example.com", "m.example.com", dns.A, dns.RRSIG, dns.NSEC)
+	m := nsecRecord("m.example.com", "example.com", dns.MX, dns.RRSIG, dns.NSEC)
+
+	tests := []struct {
+		name        string
+		proof       []dns.DnsRecord
+		qname       string
+		qtype       dns.QueryType
+		wantFound   bool
+		rescode     dns.ResultCode
+		authorities []string
+	}{
+		{"name error", []dns.DnsRecord{apex, a}, "c.example.com", dns.A, true, dns.NXDOMAIN,
+			[]string{"a.example.com NSEC m.example.com", "example.com NSEC a.example.com", "example.com SOA"}},
+		{"name error below a missing name", []dns.DnsRecord{apex, a}, "x.c.example.com", dns.MX, true, dns.NXDOMAIN,
+			[]string{"a.example.com NSEC m.example.com", "example.com NSEC a.example.com", "example.com SOA"}},
+		{"name error without the wildcard ruled out", []dns.DnsRecord{a}, "c.example.com", dns.A, false, dns.NOERROR, nil},
+		{"no data", []dns.DnsRecord{a}, "a.example.com", dns.AAAA, true, dns.NOERROR,
+			[]string{"a.example.com NSEC m.example.com", "example.com SOA"}},
+		{"no data ignoring case", []dns.DnsRecord{a}, "A.Example.COM", dns.AAAA, true, dns.NOERROR,
+			[]string{"a.example.com NSEC m.example.com", "example.com SOA"}},
+		{"type in the bitmap", []dns.DnsRecord{a}, "a.example.com", dns.A, false, dns.NOERROR, nil},
+		{"name without a covering record", []dns.DnsRecord{apex, a}, "x.example.com", dns.A, false, dns.NOERROR, nil},
+		{"no data at the last name", []dns.DnsRecord{apex, a, m}, "m.example.com", dns.A, true, dns.NOERROR,
+			[]string{"example.com NSEC a.example.com", "example.com SOA", "m.example.com NSEC example.com"}},
+		{"name in another zone", []dns.DnsRecord{apex, a, m}, "c.example.org", dns.A, false, dns.NOERROR, nil},
+		{"name above the zone", []dns.DnsRecord{apex, a, m}, "com", dns.A, false, dns.NOERROR, nil},
+		{"DS at the apex", []dns.DnsRecord{apex, a, m}, "example.com", dns.DS, false, dns.NOERROR, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newRecordCache()
+			storeSecureDenial(c, "example.com", "b.example.com", dns.NXDOMAIN, test.proof...)
+
+			packet, found := c.SynthesizeDenial(test.qname, test.qtype)
+			if found != test.wantFound {
+				t.Fatalf("found = %v, want %v", found, test.wantFound)
+			}
+			if !found {
+				return
+			}
+
+			if packet.Header.Rescode != test.rescode || !packet.Header.AuthedData || len(packet.Answers) != 0 {
+				t.Errorf("rescode = %v, AD = %v, %d answers, want a secure %v", packet.Header.Rescode, packet.Header.AuthedData, len(packet.Answers), test.rescode)
+			}
+			got := answerSummary(packet.Authorities)
+			sort.Strings(got)
+			if !sameSummary(got, test.authorities) {
+				t.Errorf("authorities = %v, want %v", got, test.authorities)
+			}
+		})
+	}
+}
+
+func TestSynthesizeDenialInsecure(t *testing.T) {
+	apex := nsecRecord("example.com", "a.example.com", dns.NS, dns.SOA, dns.RRSIG, dns.NSEC, dns.DNSKEY)
+	a := nsecRecord("a.example.com", "m.example.com", dns.A, dns.RRSIG, dns.NSEC)
+
+	// A denial that didn't validate as secure proves nothing about other
+	// names.
+	c := newRecordCache()
+	packet := negativeResponse(dns.NXDOMAIN)
+	packet.Authorities = append(packet.Authorities, apex, a)
+	c.StoreNegative("b.example.com", dns.A.ToNum(), packet)
+
+	if _, found := c.SynthesizeDenial("c.example.com", dns.A); found {
+		t.Error("denial synthesized from an insecure answer")
+	}
+}
+
+func TestSynthesizeDenialExpiry(t *testing.T) {
+	apex := nsecRecord("example.com", "a.example.com", dns.NS, dns.SOA, dns.RRSIG, dns.NSEC, dns.DNSKEY)
+	a := nsecRecord("a.example.com", "m.example.com", dns.A, dns.RRSIG, dns.NSEC)
+
+	c := newRecordCache()
+	storeSecureDenial(c, "example.com", "b.example.com", dns.NXDOMAIN, apex, a)
+	if _, found := c.SynthesizeDenial("c.example.com", dns.A); !found {
+		t.Fatal("no denial synthesized before the NSEC records expired")
+	}
+
+	// The NSEC records run out while the SOA record is still cached.
+	for _, entries := range c.denials {
+		for key, entry := range entries {
+			if key.Qtype == dns.NSEC.ToNum() {
+				entry.Expires = time.Now()
+				entries[key] = entry
+			}
+		}
+	}
+	if _, found := c.SynthesizeDenial("c.example.com", dns.A); found {
+		t.Error("denial synthesized from expired NSEC records")
+	}
+}
+
+func TestSynthesizeDenialNSEC3(t *testing.T) {
+	tooManyIterations := nsec3Chain(t, 0)
+	for i := range tooManyIterations {
+		tooManyIterations[i].Iterations = maxNSEC3Iterations + 1
+	}
+
+	tests := []struct {
+		name      string
+		chain     []dns.NSEC3Record
+		qname     string
+		qtype     dns.QueryType
+		wantFound bool
+		rescode   dns.ResultCode
+	}{
+		{"name error", nsec3Chain(t, 0), "c.example", dns.A, true, dns.NXDOMAIN},
+		{"no data", nsec3Chain(t, 0), "ns1.example", dns.MX, true, dns.NOERROR},
+		{"name error in an opt-out span", nsec3Chain(t, dns.NSEC3FlagOptOut), "c.example", dns.A, false, dns.NOERROR},
+		{"chain with too many iterations", tooManyIterations, "c.example", dns.A, false, dns.NOERROR},
+		{"name that exists", nsec3Chain(t, 0), "ns1.example", dns.A, false, dns.NOERROR},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var proof []dns.DnsRecord
+			for _, record := range test.chain {
+				proof = append(proof, record)
+			}
+
+			c := newRecordCache()
+			storeSecureDenial(c, "example", "b.example", dns.NXDOMAIN, proof...)
+
+			packet, found := c.SynthesizeDenial(test.qname, test.qtype)
+			if found != test.wantFound {
+				t.Fatalf("found = %v, want %v", found, test.wantFound)
+			}
+			if found && packet.Header.Rescode != test.rescode {
+				t.Errorf("rescode = %v, want %v", packet.Header.Rescode, test.rescode)
+			}
+		})
+	}
+}
+
+// ageEntries moves the entries closer to their expiry, as if they had been
+// cached for that much longer.
+func ageEntries(entries map[cacheKey]cacheEntry, by time.Duration) {
+	for key, entry := range entries {
+		entry.Expires = entry.Expires.Add(-by)
+		entries[key] = entry
+	}
+}
+
+func TestCacheTTLDecrement(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []dns.DnsRecord
+		age     time.Duration
+		minTTL  uint32
+		maxTTL  uint32
+	}{
+		{"fresh entry", []dns.DnsRecord{addressRecord("www.example.com", "192.0.2.1")}, 0, 299, 300},
+		{"entry cached a while ago", []dns.DnsRecord{addressRecord("www.example.com", "192.0.2.1")}, 100 * time.Second, 199, 200},
+		{"set with the lowest TTL of its records", []dns.DnsRecord{
+			addressRecord("www.example.com", "192.0.2.1"),
+			dns.ARecord{Domain: "www.example.com", Addr: net.ParseIP("192.0.2.2").To4(), TTL: 60},
+		}, 0, 59, 60},
+		{"TTL above the cap", []dns.DnsRecord{
+			dns.ARecord{Domain: "www.example.com", Addr: net.ParseIP("192.0.2.1").To4(), TTL: 7 * 86400},
+		}, 0, uint32(maxCacheTTL/time.Second) - 1, uint32(maxCacheTTL / time.Second)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newRecordCache()
+			c.StoreAnswers(test.records, false)
+			ageEntries(c.answers, test.age)
+
+			packet, found := c.Lookup("www.example.com", dns.A.ToNum())
+			if !found {
+				t.Fatal("record set not found")
+			}
+			if len(packet.Answers) != len(test.records) {
+				t.Fatalf("answers = %+v, want %d records", packet.Answers, len(test.records))
+			}
+			for _, record := range packet.Answers {
+				ttl := dns.RecordTTL(record)
+				if ttl < test.minTTL || ttl > test.maxTTL {
+					t.Errorf("TTL = %d, want between %d and %d", ttl, test.minTTL, test.maxTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := newRecordCache()
+	c.StoreAnswers([]dns.DnsRecord{
+		addressRecord("www.example.com", "192.0.2.1"),
+		dns.ARecord{Domain: "zero.example.com", Addr: net.ParseIP("192.0.2.2").To4(), TTL: 0},
+	}, true)
+
+	if _, found := c.Lookup("zero.example.com", dns.A.ToNum()); found {
+		t.Error("record set with a zero TTL was cached")
+	}
+
+	packet, found := c.Lookup("WWW.Example.COM.", dns.A.ToNum())
+	if !found || !packet.Header.AuthedData {
+		t.Fatalf("secure record set not found by a name in another case: %+v, %v", packet, found)
+	}
+
+	ageEntries(c.answers, 300*time.Second)
+	if _, found := c.Lookup("www.example.com", dns.A.ToNum()); found {
+		t.Error("expired record set still found")
+	}
+
+	c.Prune()
+	if len(c.answers) != 0 {
+		t.Errorf("Prune kept %d expired entries", len(c.answers))
+	}
+}
+
+func TestCacheDelegationsApart(t *testing.T) {
+	c := newRecordCache()
+	c.StoreDelegation(
+		[]dns.DnsRecord{dns.NSRecord{Domain: "example.com", Host: "ns1.example.com", TTL: 3600}},
+		[]dns.DnsRecord{
+			addressRecord("ns1.example.com", "192.0.2.53"),
+			addressRecord("www.example.org", "198.51.100.1"),
+		},
+	)
+
+	// Referral data only serves to find the nameservers.
+	if _, found := c.Lookup("example.com", dns.NS.ToNum()); found {
+		t.Error("delegation NS records answered a query")
+	}
+	if _, found := c.Lookup("ns1.example.com", dns.A.ToNum()); found {
+		t.Error("glue answered a query")
+	}
+
+	zone, addrs := c.LookupNameservers("www.sub.example.com")
+	if zone != "example.com" || len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("192.0.2.53")) {
+		t.Errorf("nameservers = %s %v, want example.com [192.0.2.53]", zone, addrs)
+	}
+
+	// Addresses of hosts that are not nameservers of the zone aren't glue.
+	if len(c.glue) != 1 {
+		t.Errorf("glue = %+v, want the address of ns1.example.com alone", c.glue)
+	}
+
+	// Answers don't replace the glue, nor does the glue hide them.
+	c.StoreAnswers([]dns.DnsRecord{addressRecord("ns1.example.com", "192.0.2.54")}, false)
+	packet, found := c.Lookup("ns1.example.com", dns.A.ToNum())
+	if !found || !packet.Answers[0].(dns.ARecord).Addr.Equal(net.ParseIP("192.0.2.54")) {
+		t.Errorf("answer = %+v, want the address from the answer", packet)
+	}
+	_, addrs = c.LookupNameservers("www.example.com")
+	if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("192.0.2.53")) {
+		t.Errorf("nameserver addresses = %v, want the glue", addrs)
+	}
+
+	// Without glue, the addresses come from the answers.
+	ageEntries(c.glue, time.Hour)
+	_, addrs = c.LookupNameservers("www.example.com")
+	if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("192.0.2.54")) {
+		t.Errorf("nameserver addresses = %v, want the answer once the glue expired", addrs)
+	}
+
+	ageEntries(c.delegations, time.Hour)
+	if zone, addrs := c.LookupNameservers("www.example.com"); zone != "" || addrs != nil {
+		t.Errorf("nameservers = %s %v after the delegation expired", zone, addrs)
+	}
+}
+
+func TestCacheLookupReturnsCopy(t *testing.T) {
+	c := newRecordCache()
+	c.StoreAnswers([]dns.DnsRecord{
+		addressRecord("www.example.com", "192.0.2.1"),
+		addressRecord("www.example.com", "192.0.2.2"),
+	}, true)
+
+	packet, found := c.Lookup("www.example.com", dns.A.ToNum())
+	if !found {
+		t.Fatal("record set not found")
+	}
+
+	// Callers change the packets they get the way the resolver does.
+	packet.Header.Id = 99
+	packet.Header.AuthedData = false
+	packet.Answers[0] = cnameRecord("www.example.com", "web.example.com")
+	packet.Answers[1] = dns.WithTTL(packet.Answers[1], 1)
+	packet.Answers = append(packet.Answers[:1], addressRecord("web.example.com", "192.0.2.3"))
+
+	again, found := c.Lookup("www.example.com", dns.A.ToNum())
+	if !found {
+		t.Fatal("record set gone after changing a looked up packet")
+	}
+	want := []string{"www.example.com A 192.0.2.1", "www.example.com A 192.0.2.2"}
+	if got := answerSummary(again.Answers); !sameSummary(got, want) {
+		t.Errorf("answers = %v, want %v", got, want)
+	}
+	for _, record := range again.Answers {
+		if dns.RecordTTL(record) < 299 {
+			t.Errorf("TTL = %d after changing a looked up packet", dns.RecordTTL(record))
+		}
+	}
+	if again.Header.Id != 0 || !again.Header.AuthedData {
+		t.Errorf("header = %+v, want a new secure one", again.Header)
+	}
+}
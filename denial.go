@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/guoard/godns/dns"
+)
+
+// maxNSEC3Iterations is the most extra hash iterations we compute for an
+// NSEC3 chain. Denials using more are treated as insecure (RFC 9276 section
+// 3.2).
+const maxNSEC3Iterations = 150
+
+// validateDenial checks that the signed NSEC or NSEC3 records of a negative
+// response prove that qname doesn't exist, or that it has no records of
+// type qtype. It returns false without an error for denials that can't be
+// proven secure but are allowed to be insecure, such as opt-out spans.
+func validateDenial(signer string, qname string, qtype dns.QueryType, response *dns.DnsPacket, keys []dns.DNSKEYRecord) (bool, error) {
+	nsecs, nsec3s, err := denialRecords(signer, response.Authorities, keys)
+	if err != nil {
+		return false, err
+	}
+
+	nxdomain := response.Header.Rescode == dns.NXDOMAIN
+	if len(nsecs) > 0 {
+		return true, proveNSECDenial(qname, qtype, nxdomain, nsecs)
+	}
+	if len(nsec3s) > 0 {
+		proof, ok := newNSEC3Proof(signer, nsec3s)
+		if !ok {
+			return false, nil
+		}
+		return proof.proveDenial(qname, qtype, nxdomain)
+	}
+
+	return false, fmt.Errorf("%w: no NSEC or NSEC3 records to prove the denial of %s", errBogus, qname)
+}
+
+// validateWildcardAnswer checks that an answer expanded from a wildcard
+// comes with proof that there is no closer match for its owner than the
+// wildcard the signature names (RFC 4035 section 5.3.4).
+func validateWildcardAnswer(signer string, owner string, sig dns.RRSIGRecord, response *dns.DnsPacket, keys []dns.DNSKEYRecord) (bool, error) {
+	nsecs, nsec3s, err := denialRecords(signer, response.Authorities, keys)
+	if err != nil {
+		return false, err
+	}
+
+	for _, nsec := range nsecs {
+		if dns.NSECCovers(nsec, owner) {
+			return true, nil
+		}
+	}
+
+	if len(nsec3s) > 0 {
+		proof, ok := newNSEC3Proof(signer, nsec3s)
+		if !ok {
+			return false, nil
+		}
+
+		// The next closer name is the wildcard's parent plus one label of
+		// the owner.
+		nextCloser := owner
+		for dns.LabelCount(nextCloser) > int(sig.Labels)+1 {
+			nextCloser = parentDomain(nextCloser)
+		}
+
+		covering, found, err := proof.covering(nextCloser)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return covering.Flags&dns.NSEC3FlagOptOut == 0, nil
+		}
+	}
+
+	return false, fmt.Errorf("%w: no proof that %s doesn't exist besides its wildcard", errBogus, owner)
+}
+
+// denialRecords returns the NSEC and NSEC3 records found among records,
+// once their signatures by signer were checked.
+func denialRecords(signer string, records []dns.DnsRecord, keys []dns.DNSKEYRecord) ([]dns.NSECRecord, []dns.NSEC3Record, error) {
+	var nsecs []dns.NSECRecord
+	var nsec3s []dns.NSEC3Record
+	for _, rrset := range recordSets(records) {
+		qtype := dns.RecordType(rrset[0])
+		if qtype != dns.NSEC.ToNum() && qtype != dns.NSEC3.ToNum() {
+			continue
+		}
+
+		_, err := verifyRRset(signer, rrset, records, keys)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, record := range rrset {
+			switch record := record.(type) {
+			case dns.NSECRecord:
+				nsecs = append(nsecs, record)
+			case dns.NSEC3Record:
+				nsec3s = append(nsec3s, record)
+			}
+		}
+	}
+	return nsecs, nsec3s, nil
+}
+
+// proveNSECDenial checks an NSEC proof (RFC 4035 section 5.4). A name is
+// proven not to exist by a record covering it and another one covering the
+// wildcard that could have matched it. Missing types are proven by the
+// record at the name itself, or by the one at the wildcard that matches it.
+func proveNSECDenial(qname string, qtype dns.QueryType, nxdomain bool, nsecs []dns.NSECRecord) error {
+	for _, nsec := range nsecs {
+		if !nxdomain && dns.IsSubdomain(nsec.Domain, qname) && dns.IsSubdomain(qname, nsec.Domain) {
+			return checkDeniedTypes(nsec.Types, qname, qtype)
+		}
+	}
+
+	var covering *dns.NSECRecord
+	for i, nsec := range nsecs {
+		if dns.NSECCovers(nsec, qname) {
+			covering = &nsecs[i]
+			break
+		}
+	}
+	if covering == nil {
+		return fmt.Errorf("%w: no NSEC record covers %s", errBogus, qname)
+	}
+
+	// The owner of a delegation only speaks for the parent side of the zone
+	// cut, so it can't deny names below it.
+	if dns.IsSubdomain(qname, covering.Domain) && dns.HasType(covering.Types, dns.NS.ToNum()) && !dns.HasType(covering.Types, dns.SOA.ToNum()) {
+		return fmt.Errorf("%w: NSEC record of delegation %s denies %s", errBogus, covering.Domain, qname)
+	}
+
+	// An empty non-terminal has no record of its own, but the name after it
+	// lies below it (RFC 4035 section 3.1.3.2).
+	if !nxdomain && dns.IsSubdomain(covering.NextDomain, qname) && dns.CompareNames(covering.NextDomain, qname) != 0 {
+		return nil
+	}
+
+	// The closest encloser is the deepest existing ancestor of the name,
+	// which the names on either side of it share.
+	encloser := dns.CommonAncestor(qname, covering.Domain)
+	if next := dns.CommonAncestor(qname, covering.NextDomain); dns.LabelCount(next) > dns.LabelCount(encloser) {
+		encloser = next
+	}
+	wildcard := wildcardName(encloser)
+
+	for _, nsec := range nsecs {
+		if nxdomain && dns.NSECCovers(nsec, wildcard) {
+			return nil
+		}
+		if !nxdomain && dns.IsSubdomain(nsec.Domain, wildcard) && dns.IsSubdomain(wildcard, nsec.Domain) {
+			return checkDeniedTypes(nsec.Types, qname, qtype)
+		}
+	}
+
+	return fmt.Errorf("%w: no NSEC record rules out the wildcard %s", errBogus, wildcard)
+}
+
+// checkDeniedTypes checks that the type bit map of the record found at a
+// name proves that there are no records of type qtype there.
+func checkDeniedTypes(types []uint16, qname string, qtype dns.QueryType) error {
+	if dns.HasType(types, qtype.ToNum()) || dns.HasType(types, dns.CNAME.ToNum()) {
+		return fmt.Errorf("%w: type %d exists at %s", errBogus, qtype.ToNum(), qname)
+	}
+
+	// Only DS records can be denied from the parent side of a zone cut,
+	// and only from there.
+	delegation := dns.HasType(types, dns.NS.ToNum()) && !dns.HasType(types, dns.SOA.ToNum())
+	if qtype != dns.DS && delegation {
+		return fmt.Errorf("%w: denial for %s comes from the parent zone", errBogus, qname)
+	}
+	if qtype == dns.DS && dns.HasType(types, dns.SOA.ToNum()) {
+		return fmt.Errorf("%w: DS denial for %s comes from the child zone", errBogus, qname)
+	}
+	return nil
+}
+
+// wildcardName returns the name of the wildcard directly below a name.
+func wildcardName(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return "*." + name
+}
+
+// nsec3Proof holds the NSEC3 records of a response, which all hash names
+// the same way.
+type nsec3Proof struct {
+	zone       string
+	algorithm  uint8
+	iterations uint16
+	salt       []byte
+	records    []dns.NSEC3Record
+}
+
+// newNSEC3Proof gathers the NSEC3 records of zone. It reports false when
+// their hashes can't or shouldn't be computed, which leaves the denial
+// insecure.
+func newNSEC3Proof(zone string, records []dns.NSEC3Record) (*nsec3Proof, bool) {
+	first := records[0]
+	if first.HashAlgorithm != dns.NSEC3HashSHA1 || first.Iterations > maxNSEC3Iterations {
+		return nil, false
+	}
+
+	proof := &nsec3Proof{
+		zone:       zone,
+		algorithm:  first.HashAlgorithm,
+		iterations: first.Iterations,
+		salt:       first.Salt,
+	}
+
+	// NSEC3 records are owned by the hashes directly below the apex, and
+	// ones using other parameters belong to another chain.
+	for _, record := range records {
+		if record.HashAlgorithm != proof.algorithm || record.Iterations != proof.iterations || !bytes.Equal(record.Salt, proof.salt) {
+			continue
+		}
+		if parent := parentDomain(record.Domain); !dns.IsSubdomain(parent, zone) || !dns.IsSubdomain(zone, parent) {
+			continue
+		}
+		proof.records = append(proof.records, record)
+	}
+	return proof, true
+}
+
+// matching returns the record owned by the hash of name, if there is one.
+func (p *nsec3Proof) matching(name string) (dns.NSEC3Record, bool, error) {
+	hash, err := dns.NSEC3Hash(name, p.algorithm, p.iterations, p.salt)
+	if err != nil {
+		return dns.NSEC3Record{}, false, err
+	}
+
+	for _, record := range p.records {
+		if dns.NSEC3Matches(record, hash) {
+			return record, true, nil
+		}
+	}
+	return dns.NSEC3Record{}, false, nil
+}
+
+// covering returns the record whose range covers the hash of name, if
+// there is one.
+func (p *nsec3Proof) covering(name string) (dns.NSEC3Record, bool, error) {
+	hash, err := dns.NSEC3Hash(name, p.algorithm, p.iterations, p.salt)
+	if err != nil {
+		return dns.NSEC3Record{}, false, err
+	}
+
+	for _, record := range p.records {
+		if dns.NSEC3Covers(record, hash) {
+			return record, true, nil
+		}
+	}
+	return dns.NSEC3Record{}, false, nil
+}
+
+// closestEncloser finds the deepest ancestor of qname that exists, along
+// with the record covering the next closer name, the one just below it on
+// the way to qname (RFC 5155 section 8.3).
+func (p *nsec3Proof) closestEncloser(qname string) (string, dns.NSEC3Record, error) {
+	name := qname
+	nextCloser := ""
+	for {
+		record, found, err := p.matching(name)
+		if err != nil {
+			return "", dns.NSEC3Record{}, err
+		}
+		if found && nextCloser == "" {
+			return "", dns.NSEC3Record{}, fmt.Errorf("%w: NSEC3 record proves that %s exists", errBogus, qname)
+		}
+		if found {
+			if dns.HasType(record.Types, dns.NS.ToNum()) && !dns.HasType(record.Types, dns.SOA.ToNum()) {
+				return "", dns.NSEC3Record{}, fmt.Errorf("%w: NSEC3 record of delegation %s denies %s", errBogus, name, qname)
+			}
+			break
+		}
+
+		if dns.IsSubdomain(p.zone, name) {
+			return "", dns.NSEC3Record{}, fmt.Errorf("%w: no closest encloser proof for %s", errBogus, qname)
+		}
+		nextCloser = name
+		name = parentDomain(name)
+	}
+
+	covering, found, err := p.covering(nextCloser)
+	if err != nil {
+		return "", dns.NSEC3Record{}, err
+	}
+	if !found {
+		return "", dns.NSEC3Record{}, fmt.Errorf("%w: no NSEC3 record covers %s", errBogus, nextCloser)
+	}
+	return name, covering, nil
+}
+
+// proveDenial checks an NSEC3 proof (RFC 5155 sections 8.4 to 8.7). Names
+// covered by an opt-out span may exist as unsigned delegations, so denials
+// relying on one are only insecure.
+func (p *nsec3Proof) proveDenial(qname string, qtype dns.QueryType, nxdomain bool) (bool, error) {
+	if !nxdomain {
+		record, found, err := p.matching(qname)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, checkDeniedTypes(record.Types, qname, qtype)
+		}
+	}
+
+	encloser, covering, err := p.closestEncloser(qname)
+	if err != nil {
+		return false, err
+	}
+	optOut := covering.Flags&dns.NSEC3FlagOptOut != 0
+
+	wildcard := wildcardName(encloser)
+	if nxdomain {
+		_, found, err := p.covering(wildcard)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			return false, fmt.Errorf("%w: no NSEC3 record rules out the wildcard %s", errBogus, wildcard)
+		}
+		return !optOut, nil
+	}
+
+	// A DS record can only be missing without a matching NSEC3 record when
+	// the delegation is unsigned and covered by an opt-out span.
+	if qtype == dns.DS {
+		if !optOut {
+			return false, fmt.Errorf("%w: no NSEC3 record proves that %s has no DS records", errBogus, qname)
+		}
+		return false, nil
+	}
+
+	record, found, err := p.matching(wildcard)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, fmt.Errorf("%w: no NSEC3 record proves that %s has no records of type %d", errBogus, qname, qtype.ToNum())
+	}
+	return !optOut, checkDeniedTypes(record.Types, qname, qtype)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/guoard/godns/dns"
+)
+
+// The names of the example zone of RFC 5155 appendix A, with the types of
+// their NSEC3 records. w.example is an empty non-terminal.
+var nsec3TestNames = map[string][]uint16{
+	"example":       {dns.NS.ToNum(), dns.SOA.ToNum(), dns.MX.ToNum(), dns.RRSIG.ToNum(), dns.DNSKEY.ToNum(), dns.NSEC3PARAM.ToNum()},
+	"a.example":     {dns.NS.ToNum(), dns.DS.ToNum(), dns.RRSIG.ToNum()},
+	"ns1.example":   {dns.A.ToNum(), dns.RRSIG.ToNum()},
+	"ns2.example":   {dns.A.ToNum(), dns.RRSIG.ToNum()},
+	"w.example":     nil,
+	"*.w.example":   {dns.MX.ToNum(), dns.RRSIG.ToNum()},
+	"x.w.example":   {dns.MX.ToNum(), dns.RRSIG.ToNum()},
+	"y.w.example":   {dns.MX.ToNum(), dns.RRSIG.ToNum()},
+	"x.y.w.example": {dns.MX.ToNum(), dns.RRSIG.ToNum()},
+	"xx.example":    {dns.A.ToNum(), dns.RRSIG.ToNum()},
+}
+
+// nsec3Chain builds the NSEC3 chain of the example zone with the salt and
+// iterations of RFC 5155 appendix A, leaving out the records owned by the
+// hashes of the names in without.
+func nsec3Chain(t *testing.T, flags uint8, without ...string) []dns.NSEC3Record {
+	t.Helper()
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	encoding := base32.HexEncoding.WithPadding(base32.NoPadding)
+
+	type hashedName struct {
+		name string
+		hash []byte
+	}
+	var hashes []hashedName
+	for name := range nsec3TestNames {
+		hash, err := dns.NSEC3Hash(name, dns.NSEC3HashSHA1, 12, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hashedName{name, hash})
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i].hash, hashes[j].hash) < 0
+	})
+
+	var records []dns.NSEC3Record
+	for i, hashed := range hashes {
+		skip := false
+		for _, name := range without {
+			skip = skip || name == hashed.name
+		}
+		if skip {
+			continue
+		}
+
+		records = append(records, dns.NSEC3Record{
+			Domain:        strings.ToLower(encoding.EncodeToString(hashed.hash)) + ".example",
+			HashAlgorithm: dns.NSEC3HashSHA1,
+			Flags:         flags,
+			Iterations:    12,
+			Salt:          salt,
+			NextHashed:    hashes[(i+1)%len(hashes)].hash,
+			Types:         nsec3TestNames[hashed.name],
+			TTL:           3600,
+		})
+	}
+	return records
+}
+
+func TestClosestEncloser(t *testing.T) {
+	tests := []struct {
+		name         string
+		qname        string
+		without      []string
+		wantEncloser string
+		wantBogus    bool
+	}{
+		{"name below the apex", "b.example", nil, "example", false},
+		{"name two labels below the apex", "c.b.example", nil, "example", false},
+		{"name below an existing name", "q.x.w.example", nil, "x.w.example", false},
+		{"name below an empty non-terminal", "z.w.example", nil, "w.example", false},
+		{"existing name", "x.w.example", nil, "", true},
+		{"name below a delegation", "c.a.example", nil, "", true},
+		{"missing record of an existing name", "q.x.w.example", []string{"x.w.example"}, "", true},
+		{"no record for any ancestor", "b.example", []string{"example"}, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proof, ok := newNSEC3Proof("example", nsec3Chain(t, 0, test.without...))
+			if !ok {
+				t.Fatal("newNSEC3Proof refused the chain")
+			}
+
+			encloser, covering, err := proof.closestEncloser(test.qname)
+			if test.wantBogus {
+				if !errors.Is(err, errBogus) {
+					t.Errorf("err = %v, want a bogus result", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("closestEncloser: %v", err)
+			}
+			if encloser != test.wantEncloser {
+				t.Errorf("closest encloser = %q, want %q", encloser, test.wantEncloser)
+			}
+
+			// The next closer name is the one just below the encloser.
+			labels := strings.Split(test.qname, ".")
+			nextCloser := strings.Join(labels[len(labels)-dns.LabelCount(encloser)-1:], ".")
+			hash, err := dns.NSEC3Hash(nextCloser, dns.NSEC3HashSHA1, 12, covering.Salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !dns.NSEC3Covers(covering, hash) {
+				t.Errorf("%s does not cover the next closer name %s", covering.Domain, nextCloser)
+			}
+		})
+	}
+}
+
+func TestClosestEncloserMissingCover(t *testing.T) {
+	// A chain holding only the record of the apex proves that the apex
+	// exists, but covers no name below it.
+	var apex []dns.NSEC3Record
+	for _, record := range nsec3Chain(t, 0) {
+		proof, _ := newNSEC3Proof("example", []dns.NSEC3Record{record})
+		if _, found, _ := proof.matching("example"); found {
+			apex = append(apex, record)
+		}
+	}
+
+	proof, _ := newNSEC3Proof("example", apex)
+	_, _, err := proof.closestEncloser("b.example")
+	if !errors.Is(err, errBogus) {
+		t.Errorf("err = %v, want a bogus result", err)
+	}
+}
+
+func TestNSEC3ProveDenial(t *testing.T) {
+	tests := []struct {
+		name       string
+		qname      string
+		qtype      dns.QueryType
+		nxdomain   bool
+		flags      uint8
+		without    []string
+		wantSecure bool
+		wantBogus  bool
+	}{
+		{"name error", "b.example", dns.A, true, 0, nil, true, false},
+		{"name error in an opt-out span", "b.example", dns.A, true, dns.NSEC3FlagOptOut, nil, false, false},
+		{"name error for an existing name", "ns1.example", dns.A, true, 0, nil, false, true},
+		{"no data", "ns1.example", dns.MX, false, 0, nil, true, false},
+		{"no data for a type that exists", "ns1.example", dns.A, false, 0, nil, false, true},
+		{"no data at an empty non-terminal", "w.example", dns.A, false, 0, nil, true, false},
+		{"no data from a wildcard", "z.w.example", dns.A, false, 0, nil, true, false},
+		{"no data from a wildcard holding the type", "z.w.example", dns.MX, false, 0, nil, false, true},
+		{"no data without the wildcard", "z.w.example", dns.A, false, 0, []string{"*.w.example"}, false, true},
+		{"DS of a signed delegation", "a.example", dns.DS, false, 0, nil, false, true},
+		{"DS of a delegation in an opt-out span", "b.example", dns.DS, false, dns.NSEC3FlagOptOut, nil, false, false},
+		{"DS of a delegation outside an opt-out span", "b.example", dns.DS, false, 0, nil, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proof, ok := newNSEC3Proof("example", nsec3Chain(t, test.flags, test.without...))
+			if !ok {
+				t.Fatal("newNSEC3Proof refused the chain")
+			}
+
+			secure, err := proof.proveDenial(test.qname, test.qtype, test.nxdomain)
+			if test.wantBogus {
+				if !errors.Is(err, errBogus) {
+					t.Errorf("err = %v, want a bogus result", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("proveDenial: %v", err)
+			}
+			if secure != test.wantSecure {
+				t.Errorf("secure = %v, want %v", secure, test.wantSecure)
+			}
+		})
+	}
+}
+
+func TestNewNSEC3ProofLimits(t *testing.T) {
+	records := nsec3Chain(t, 0)
+	records[0].Iterations = maxNSEC3Iterations + 1
+	if _, ok := newNSEC3Proof("example", records); ok {
+		t.Error("accepted a chain with too many iterations")
+	}
+
+	// Records of another chain or zone are left out.
+	records = nsec3Chain(t, 0)
+	records[1].Salt = []byte{1}
+	records[2].Domain = strings.Replace(records[2].Domain, ".example", ".other", 1)
+	proof, ok := newNSEC3Proof("example", records)
+	if !ok || len(proof.records) != len(records)-2 {
+		t.Errorf("proof kept %d of %d records", len(proof.records), len(records))
+	}
+}
@@ -8,15 +8,43 @@ import (
 
 const maxJumps = 5
 
+const (
+	// UDPPacketSize is the classic maximum size of a DNS message sent over UDP.
+	UDPPacketSize = 512
+	// MaxPacketSize is the largest message that fits the two byte length
+	// prefix used for DNS over TCP.
+	MaxPacketSize = 65535
+)
+
+// ErrEndOfBuffer is returned when reading or writing past the end of a buffer.
+var ErrEndOfBuffer = errors.New("end of buffer")
+
+// maxPointerOffset is the largest offset a compression pointer can express.
+const maxPointerOffset = 0x3FFF
+
 // BytePacketBuffer represents a buffer for DNS packet contents.
 type BytePacketBuffer struct {
-	Buf [512]byte
+	Buf []byte
 	Pos int
+
+	// names maps the name suffixes written so far to their offset in the
+	// buffer. Names are only compressed while it is non-nil.
+	names map[string]int
 }
 
-// NewBytePacketBuffer creates a new BytePacketBuffer.
+// NewBytePacketBuffer creates a new BytePacketBuffer sized for a UDP packet.
 func NewBytePacketBuffer() *BytePacketBuffer {
-	return &BytePacketBuffer{}
+	return NewBytePacketBufferWithSize(UDPPacketSize)
+}
+
+// NewBytePacketBufferWithSize creates a new BytePacketBuffer holding up to size bytes.
+func NewBytePacketBufferWithSize(size int) *BytePacketBuffer {
+	return &BytePacketBuffer{Buf: make([]byte, size)}
+}
+
+// NewBytePacketBufferFromBytes creates a BytePacketBuffer for reading the given data.
+func NewBytePacketBufferFromBytes(data []byte) *BytePacketBuffer {
+	return &BytePacketBuffer{Buf: data}
 }
 
 // Step advances the buffer position by a specific number of steps.
@@ -33,8 +61,8 @@ func (bpb *BytePacketBuffer) Seek(pos int) error {
 
 // Read reads a single byte and advances the buffer position.
 func (bpb *BytePacketBuffer) Read() (byte, error) {
-	if bpb.Pos >= 512 {
-		return 0, errors.New("end of buffer")
+	if bpb.Pos >= len(bpb.Buf) {
+		return 0, ErrEndOfBuffer
 	}
 	res := bpb.Buf[bpb.Pos]
 	bpb.Pos++
@@ -43,16 +71,16 @@ func (bpb *BytePacketBuffer) Read() (byte, error) {
 
 // Get retrieves a single byte without changing the buffer position.
 func (bpb *BytePacketBuffer) Get(pos int) (byte, error) {
-	if pos >= 512 {
-		return 0, errors.New("end of buffer")
+	if pos >= len(bpb.Buf) {
+		return 0, ErrEndOfBuffer
 	}
 	return bpb.Buf[pos], nil
 }
 
 // GetRange retrieves a range of bytes.
 func (bpb *BytePacketBuffer) GetRange(start int, length int) ([]byte, error) {
-	if start+length >= 512 {
-		return nil, errors.New("end of buffer")
+	if start < 0 || length < 0 || start+length > len(bpb.Buf) {
+		return nil, ErrEndOfBuffer
 	}
 	return bpb.Buf[start : start+length], nil
 }
@@ -86,6 +114,21 @@ func (bpb *BytePacketBuffer) ReadU32() (uint32, error) {
 	return res, nil
 }
 
+// ReadBytes reads length bytes and returns a copy of them.
+func (bpb *BytePacketBuffer) ReadBytes(length int) ([]byte, error) {
+	data, err := bpb.GetRange(bpb.Pos, length)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bpb.Step(length)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
 // ReadQname reads a DNS domain name from the buffer.
 func (bpb *BytePacketBuffer) ReadQname(outstr *string) error {
 	pos := bpb.Pos
@@ -134,7 +177,7 @@ func (bpb *BytePacketBuffer) ReadQname(outstr *string) error {
 			if err != nil {
 				return err
 			}
-			*outstr += strings.ToLower(string(strBuffer))
+			*outstr += escapeLabel([]byte(strings.ToLower(string(strBuffer))))
 
 			delim = "."
 			pos += int(len)
@@ -153,8 +196,8 @@ func (bpb *BytePacketBuffer) ReadQname(outstr *string) error {
 
 // Write writes a single byte to the buffer and advances the position.
 func (bpb *BytePacketBuffer) Write(val uint8) error {
-	if bpb.Pos >= 512 {
-		return errors.New("end of buffer")
+	if bpb.Pos >= len(bpb.Buf) {
+		return ErrEndOfBuffer
 	}
 	bpb.Buf[bpb.Pos] = val
 	bpb.Pos++
@@ -192,20 +235,73 @@ func (bpb *BytePacketBuffer) WriteU32(val uint32) error {
 	return nil
 }
 
-// WriteQname writes a DNS domain name to the buffer.
+// WriteBytes writes a slice of bytes to the buffer.
+func (bpb *BytePacketBuffer) WriteBytes(data []byte) error {
+	for _, b := range data {
+		err := bpb.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteQname writes a DNS domain name to the buffer, replacing any suffix
+// that was already written with a compression pointer.
 func (bpb *BytePacketBuffer) WriteQname(qname string) error {
-	for _, label := range strings.Split(qname, ".") {
-		len := len(label)
+	return bpb.writeQname(qname, true)
+}
+
+// WriteQnameUncompressed writes a DNS domain name to the buffer without
+// compression, as required for names inside the RDATA of most record types.
+func (bpb *BytePacketBuffer) WriteQnameUncompressed(qname string) error {
+	return bpb.writeQname(qname, false)
+}
+
+// startCompression resets the table of names used for compression.
+func (bpb *BytePacketBuffer) startCompression() {
+	bpb.names = make(map[string]int)
+}
+
+func (bpb *BytePacketBuffer) writeQname(qname string, compress bool) error {
+	// The root domain is written as a single empty label.
+	qname = strings.TrimSuffix(qname, ".")
+	if qname == "" {
+		return bpb.WriteU8(0)
+	}
+
+	labels := strings.Split(qname, ".")
+	for i, label := range labels {
+		if bpb.names != nil {
+			suffix := strings.ToLower(strings.Join(labels[i:], "."))
+			offset, found := bpb.names[suffix]
+			if found && compress {
+				return bpb.WriteU16(0xC000 | uint16(offset))
+			}
+			if !found && bpb.Pos <= maxPointerOffset {
+				bpb.names[suffix] = bpb.Pos
+			}
+		}
+
+		data, err := unescapeLabel(label)
+		if err != nil {
+			return err
+		}
+
+		len := len(data)
+		if len == 0 {
+			return errors.New("empty label in domain name")
+		}
 		if len > 0x3f {
 			return errors.New("single label exceeds 63 characters of length")
 		}
 
-		err := bpb.WriteU8(uint8(len))
+		err = bpb.WriteU8(uint8(len))
 		if err != nil {
 			return err
 		}
 
-		for _, b := range []byte(label) {
+		for _, b := range data {
 			err := bpb.WriteU8(b)
 			if err != nil {
 				return err
@@ -226,6 +322,22 @@ const (
 	NXDOMAIN
 	NOTIMP
 	REFUSED
+	// The result codes below answer UPDATE messages (RFC 2136 section 2.2).
+	YXDOMAIN
+	YXRRSET
+	NXRRSET
+	NOTAUTH
+	NOTZONE
+)
+
+// Opcodes tell what kind of request a message is.
+const (
+	// OpcodeQuery is a standard query.
+	OpcodeQuery uint8 = 0
+	// OpcodeNotify tells a secondary that its zone changed (RFC 1996).
+	OpcodeNotify uint8 = 4
+	// OpcodeUpdate adds records to or deletes them from a zone (RFC 2136).
+	OpcodeUpdate uint8 = 5
 )
 
 // DnsHeader represents a DNS packet header.
@@ -324,7 +436,9 @@ func (h *DnsHeader) Write(buffer *BytePacketBuffer) error {
 		return err
 	}
 
-	flags2 := uint8(h.Rescode) |
+	// Result codes above 15 only fit with the help of an OPT record, which
+	// carries their upper bits.
+	flags2 := uint8(h.Rescode&0x0F) |
 		uint8(boolToUint(h.CheckingDisabled))<<4 |
 		uint8(boolToUint(h.AuthedData))<<5 |
 		uint8(boolToUint(h.Z))<<6 |
@@ -360,6 +474,9 @@ func (h *DnsHeader) Write(buffer *BytePacketBuffer) error {
 
 // Set updates a byte in the buffer at the specified position.
 func (bpb *BytePacketBuffer) Set(pos int, val byte) error {
+	if pos >= len(bpb.Buf) {
+		return ErrEndOfBuffer
+	}
 	bpb.Buf[pos] = val
 	return nil
 }
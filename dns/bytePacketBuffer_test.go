@@ -0,0 +1,232 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// compressionQuestion is written first in the packets of the compression
+// tests: "www.example.com" starts right after the header at offset 12, so
+// "example.com" is at offset 16.
+const compressionQuestion = "www.example.com"
+
+func TestCompressionPointers(t *testing.T) {
+	// Type, class and a TTL of 300 of a record of the type.
+	fields := func(qtype uint16) string {
+		return string([]byte{byte(qtype >> 8), byte(qtype), 0, 1, 0, 0, 1, 44})
+	}
+
+	tests := []struct {
+		name   string
+		record DnsRecord
+		want   string
+	}{
+		{
+			"owner name",
+			ARecord{Domain: "mail.example.com", Addr: net.ParseIP("192.0.2.1"), TTL: 300},
+			"\x04mail\xc0\x10" + fields(1) + "\x00\x04\xc0\x00\x02\x01",
+		},
+		{
+			"NS host",
+			NSRecord{Domain: "example.com", Host: "ns1.example.com", TTL: 300},
+			"\xc0\x10" + fields(2) + "\x00\x06\x03ns1\xc0\x10",
+		},
+		{
+			"CNAME host",
+			CNAMERecord{Domain: "www.example.com", Host: "web.example.com", TTL: 300},
+			"\xc0\x0c" + fields(5) + "\x00\x06\x03web\xc0\x10",
+		},
+		{
+			"MX host",
+			MXRecord{Domain: "example.com", Priority: 10, Host: "mail.example.com", TTL: 300},
+			"\xc0\x10" + fields(15) + "\x00\x09\x00\x0a\x04mail\xc0\x10",
+		},
+		{
+			"SOA names",
+			SOARecord{Domain: "example.com", MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5, TTL: 300},
+			"\xc0\x10" + fields(6) + "\x00\x27\x03ns1\xc0\x10\x0ahostmaster\xc0\x10" +
+				"\x00\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x03\x00\x00\x00\x04\x00\x00\x00\x05",
+		},
+		{
+			"suffix in another case",
+			CNAMERecord{Domain: "WWW.Example.COM", Host: "Web.EXAMPLE.com", TTL: 300},
+			"\xc0\x0c" + fields(5) + "\x00\x06\x03Web\xc0\x10",
+		},
+		{
+			"RRSIG signer name",
+			RRSIGRecord{Domain: "example.com", TypeCovered: 1, Algorithm: 13, Labels: 2, OriginalTTL: 300, Expiration: 2, Inception: 1, KeyTag: 7, SignerName: "example.com", Signature: []byte{0xaa, 0xbb}, TTL: 300},
+			"\xc0\x10" + fields(46) + "\x00\x21\x00\x01\x0d\x02\x00\x00\x01\x2c\x00\x00\x00\x02\x00\x00\x00\x01\x00\x07" +
+				"\x07example\x03com\x00\xaa\xbb",
+		},
+		{
+			"NSEC next name",
+			NSECRecord{Domain: "example.com", NextDomain: "www.example.com", Types: []uint16{1}, TTL: 300},
+			"\xc0\x10" + fields(47) + "\x00\x14\x03www\x07example\x03com\x00\x00\x01\x40",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := NewDnsPacket()
+			packet.Questions = append(packet.Questions, NewDnsQuestion(compressionQuestion, A.ToNum()))
+			packet.Answers = append(packet.Answers, test.record)
+
+			buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+			err := packet.Write(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The question takes the 17 bytes of its name and 4 more.
+			got := buffer.Buf[12+17+4 : buffer.Pos]
+			if !bytes.Equal(got, []byte(test.want)) {
+				t.Errorf("record written as\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompressionOffsetLimit(t *testing.T) {
+	buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+	buffer.startCompression()
+	buffer.Pos = maxPointerOffset
+
+	// Only the whole name starts at an offset a pointer can reach.
+	err := buffer.WriteQname("far.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"far.example.com": maxPointerOffset}
+	if !reflect.DeepEqual(buffer.names, want) {
+		t.Errorf("names = %v, want %v", buffer.names, want)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"far.example.com", "\xff\xff"},
+		{"near.example.com", "\x04near\x07example\x03com\x00"},
+		{"example.com", "\x07example\x03com\x00"},
+	}
+	for _, test := range tests {
+		start := buffer.Pos
+		err := buffer.WriteQname(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := buffer.Buf[start:buffer.Pos]
+		if !bytes.Equal(got, []byte(test.want)) {
+			t.Errorf("%s written as %q, want %q", test.name, got, test.want)
+		}
+	}
+	if !reflect.DeepEqual(buffer.names, want) {
+		t.Errorf("names past the pointer limit were registered: %v", buffer.names)
+	}
+}
+
+func TestCompressionResetBetweenPackets(t *testing.T) {
+	first := NewDnsPacket()
+	first.Questions = append(first.Questions, NewDnsQuestion("www.example.com", A.ToNum()))
+
+	second := NewDnsPacket()
+	second.Questions = append(second.Questions, NewDnsQuestion("other.org", A.ToNum()))
+	second.Answers = append(second.Answers, CNAMERecord{Domain: "other.org", Host: "www.example.com", TTL: 300})
+
+	buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+	err := first.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := buffer.names["example.com"]; !found {
+		t.Fatalf("names = %v after the first packet", buffer.names)
+	}
+
+	// A name of the first packet must not be pointed at from the second.
+	buffer.Pos = 0
+	err = second.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, offset := range buffer.names {
+		if name == "example.com" && offset == 16 {
+			t.Errorf("names kept %s at %d from the first packet", name, offset)
+		}
+	}
+
+	read, err := DnsPacketFromBuffer(NewBytePacketBufferFromBytes(buffer.Buf[:buffer.Pos]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Answers) != 1 || !reflect.DeepEqual(read.Answers[0], second.Answers[0]) {
+		t.Errorf("answers = %+v, want %+v", read.Answers, second.Answers)
+	}
+}
+
+func TestCompressedPacketRoundTrip(t *testing.T) {
+	packet := NewDnsPacket()
+	packet.Header.Id = 4321
+	packet.Header.Response = true
+	packet.Questions = append(packet.Questions, NewDnsQuestion("www.example.com", A.ToNum()))
+	packet.Answers = append(packet.Answers,
+		CNAMERecord{Domain: "www.example.com", Host: "web.example.com", TTL: 300},
+		RRSIGRecord{Domain: "www.example.com", TypeCovered: 5, Algorithm: 13, Labels: 3, OriginalTTL: 300, Expiration: 2, Inception: 1, KeyTag: 7, SignerName: "example.com", Signature: []byte{1, 2, 3}, TTL: 300},
+	)
+
+	// Enough records that the later names are written past the offsets a
+	// pointer can reach.
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("host%d.example.com", i)
+		packet.Answers = append(packet.Answers, ARecord{Domain: name, Addr: net.IPv4(192, 0, 2, byte(i)), TTL: 300})
+	}
+
+	packet.Authorities = append(packet.Authorities,
+		SOARecord{Domain: "example.com", MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 7, Refresh: 1, Retry: 2, Expire: 3, Minimum: 4, TTL: 3600},
+		NSECRecord{Domain: "example.com", NextDomain: "host0.example.com", Types: []uint16{2, 6, 46, 47}, TTL: 3600},
+	)
+	packet.Resources = append(packet.Resources,
+		MXRecord{Domain: "example.com", Priority: 10, Host: "host999.example.com", TTL: 300},
+		NSRecord{Domain: "example.com", Host: "ns1.example.com", TTL: 3600},
+	)
+
+	buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+	err := packet.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.Pos <= maxPointerOffset {
+		t.Fatalf("packet takes %d bytes, too few to pass the pointer limit", buffer.Pos)
+	}
+
+	read, err := DnsPacketFromBuffer(NewBytePacketBufferFromBytes(buffer.Buf[:buffer.Pos]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read.Header, packet.Header) {
+		t.Errorf("header = %+v, want %+v", read.Header, packet.Header)
+	}
+
+	sections := []struct {
+		name      string
+		got, want []DnsRecord
+	}{
+		{"answer", read.Answers, packet.Answers},
+		{"authority", read.Authorities, packet.Authorities},
+		{"additional", read.Resources, packet.Resources},
+	}
+	for _, section := range sections {
+		if len(section.got) != len(section.want) {
+			t.Errorf("%s section has %d records, want %d", section.name, len(section.got), len(section.want))
+			continue
+		}
+		for i := range section.want {
+			if !reflect.DeepEqual(section.got[i], section.want[i]) {
+				t.Errorf("%s %d = %+v, want %+v", section.name, i, section.got[i], section.want[i])
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package dns
 
 import (
+	"fmt"
+	"math/rand"
 	"net"
 	"strings"
 )
@@ -66,6 +68,13 @@ func DnsPacketFromBuffer(buffer *BytePacketBuffer) (DnsPacket, error) {
 		result.Resources = append(result.Resources, rec)
 	}
 
+	// The OPT record extends the result code of the header with eight more
+	// bits (RFC 6891 section 6.1.3).
+	opt := result.GetOPT()
+	if opt != nil {
+		result.Header.Rescode |= ResultCode(opt.ExtendedRcode) << 4
+	}
+
 	return result, nil
 }
 
@@ -76,6 +85,8 @@ func (p *DnsPacket) Write(buffer *BytePacketBuffer) error {
 	p.Header.AuthoritativeEntries = uint16(len(p.Authorities))
 	p.Header.ResourceEntries = uint16(len(p.Resources))
 
+	buffer.startCompression()
+
 	err := p.Header.Write(buffer)
 	if err != nil {
 		return err
@@ -103,6 +114,12 @@ func (p *DnsPacket) Write(buffer *BytePacketBuffer) error {
 	}
 
 	for _, rec := range p.Resources {
+		// The upper bits of the result code go in the OPT record.
+		if opt, ok := rec.(OPTRecord); ok {
+			opt.ExtendedRcode = uint8(p.Header.Rescode >> 4)
+			rec = opt
+		}
+
 		_, err := WriteDnsRecord(rec, buffer)
 		if err != nil {
 			return err
@@ -112,54 +129,156 @@ func (p *DnsPacket) Write(buffer *BytePacketBuffer) error {
 	return nil
 }
 
+// GetOPT retrieves the EDNS(0) OPT record from the Resources section, or nil
+// if the packet carries none.
+func (p *DnsPacket) GetOPT() *OPTRecord {
+	for _, record := range p.Resources {
+		optRecord, ok := record.(OPTRecord)
+		if ok {
+			return &optRecord
+		}
+	}
+	return nil
+}
+
+// GetSOA retrieves the first SOA record from the Authorities section, or nil
+// if there is none.
+func (p *DnsPacket) GetSOA() *SOARecord {
+	for _, record := range p.Authorities {
+		soaRecord, ok := record.(SOARecord)
+		if ok {
+			return &soaRecord
+		}
+	}
+	return nil
+}
+
 // GetRandomA retrieves a random A record from the Answers section.
 func (p *DnsPacket) GetRandomA() net.IP {
+	var addrs []net.IP
 	for _, record := range p.Answers {
 		aRecord, ok := record.(ARecord)
 		if ok {
-			return aRecord.Addr
+			addrs = append(addrs, aRecord.Addr)
 		}
 	}
-	return nil
+
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[rand.Intn(len(addrs))]
 }
 
-// getNs retrieves NS records matching the domain suffix.
+// getNs retrieves the NS records of the deepest zone enclosing qname found
+// in the authority section.
 func (p *DnsPacket) getNs(qname string) []NSRecord {
 	var nsRecords []NSRecord
 
 	for _, record := range p.Authorities {
 		nsRecord, ok := record.(NSRecord)
-		if ok && strings.HasSuffix(qname, nsRecord.Domain) {
-			nsRecords = append(nsRecords, nsRecord)
+		if !ok || !IsSubdomain(qname, nsRecord.Domain) {
+			continue
 		}
+
+		if len(nsRecords) > 0 {
+			current := nsRecords[0].Domain
+			if !IsSubdomain(nsRecord.Domain, current) {
+				continue
+			}
+			if !IsSubdomain(current, nsRecord.Domain) {
+				nsRecords = nil
+			}
+		}
+		nsRecords = append(nsRecords, nsRecord)
 	}
 
 	return nsRecords
 }
 
-// GetResolvedNs retrieves the resolved IP for an NS record matching the domain suffix.
-func (p *DnsPacket) GetResolvedNs(qname string) net.IP {
+// GetReferralZone returns the zone delegated to by the NS records in the
+// authority section, and false if there are none for qname.
+func (p *DnsPacket) GetReferralZone(qname string) (string, bool) {
+	nsRecords := p.getNs(qname)
+	if len(nsRecords) == 0 {
+		return "", false
+	}
+	return nsRecords[0].Domain, true
+}
+
+// GetResolvedNs retrieves the IPv4 and IPv6 glue of the NS records for qname.
+func (p *DnsPacket) GetResolvedNs(qname string) []net.IP {
+	var addrs []net.IP
 	nsRecords := p.getNs(qname)
 
 	for _, nsRecord := range nsRecords {
 		for _, record := range p.Resources {
-			aRecord, ok := record.(ARecord)
-			if ok && aRecord.Domain == nsRecord.Host {
-				return aRecord.Addr
+			switch glue := record.(type) {
+			case ARecord:
+				if strings.EqualFold(glue.Domain, nsRecord.Host) {
+					addrs = append(addrs, glue.Addr)
+				}
+			case AAAARecord:
+				if strings.EqualFold(glue.Domain, nsRecord.Host) {
+					addrs = append(addrs, glue.Addr)
+				}
 			}
 		}
 	}
 
-	return nil
+	return addrs
 }
 
-// GetUnresolvedNS retrieves the host of the first NS record matching the domain suffix.
-func (p *DnsPacket) GetUnresolvedNS(qname string) string {
+// GetUnresolvedNS retrieves the hosts of the NS records for qname.
+func (p *DnsPacket) GetUnresolvedNS(qname string) []string {
+	var hosts []string
 	nsRecords := p.getNs(qname)
 
 	for _, nsRecord := range nsRecords {
-		return nsRecord.Host
+		hosts = append(hosts, nsRecord.Host)
 	}
 
-	return ""
+	return hosts
+}
+
+// Sanitize drops the records that a server authoritative for zone has no
+// say over, so that a malicious server cannot inject records for unrelated
+// names: answers and additional records outside of the zone, and NS and SOA
+// records in the authority section that aren't for qname or one of its
+// ancestors within the zone.
+func (p *DnsPacket) Sanitize(zone string, qname string) {
+	inZone := func(record DnsRecord) bool {
+		return IsSubdomain(RecordDomain(record), zone)
+	}
+
+	p.Answers = filterRecords(p.Answers, inZone)
+
+	p.Authorities = filterRecords(p.Authorities, func(record DnsRecord) bool {
+		switch record.(type) {
+		case NSRecord, SOARecord:
+			if !IsSubdomain(qname, RecordDomain(record)) {
+				return false
+			}
+		}
+		return inZone(record)
+	})
+
+	p.Resources = filterRecords(p.Resources, func(record DnsRecord) bool {
+		if _, ok := record.(OPTRecord); ok {
+			return true
+		}
+		return inZone(record)
+	})
+}
+
+// filterRecords returns the records for which keep returns true.
+func filterRecords(records []DnsRecord, keep func(DnsRecord) bool) []DnsRecord {
+	var kept []DnsRecord
+	for _, record := range records {
+		if keep(record) {
+			kept = append(kept, record)
+		} else {
+			fmt.Printf("Dropping out-of-bailiwick record: %+v\n", record)
+		}
+	}
+	return kept
 }
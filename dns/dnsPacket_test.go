@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func roundTrip(t *testing.T, packet DnsPacket) DnsPacket {
+	t.Helper()
+	buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+	err := packet.Write(buffer)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	read, err := DnsPacketFromBuffer(NewBytePacketBufferFromBytes(buffer.Buf[:buffer.Pos]))
+	if err != nil {
+		t.Fatalf("DnsPacketFromBuffer: %v", err)
+	}
+	return read
+}
+
+func TestExtendedRcode(t *testing.T) {
+	tests := []struct {
+		name    string
+		rescode ResultCode
+		opt     bool
+		want    ResultCode
+	}{
+		{"NXDOMAIN without OPT", NXDOMAIN, false, NXDOMAIN},
+		{"NXDOMAIN with OPT", NXDOMAIN, true, NXDOMAIN},
+		{"BADVERS", BADVERS, true, BADVERS},
+		{"BADVERS without OPT keeps the lower bits", BADVERS, false, BADVERS & 0x0F},
+		{"highest extended rcode", 0xFFF, true, 0xFFF},
+		{"highest extended rcode without OPT", 0xFFF, false, 0x0F},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := NewDnsPacket()
+			packet.Header.Response = true
+			packet.Header.Rescode = test.rescode
+			if test.opt {
+				packet.Resources = append(packet.Resources, NewOPTRecord(1232))
+			}
+
+			read := roundTrip(t, packet)
+			if read.Header.Rescode != test.want {
+				t.Errorf("rescode = %v, want %v", read.Header.Rescode, test.want)
+			}
+			if read.Header.AuthedData || read.Header.CheckingDisabled || read.Header.Z {
+				t.Errorf("result code leaked into the flags: %+v", read.Header)
+			}
+		})
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	packet := NewDnsPacket()
+	packet.Header.Id = 1234
+	packet.Header.Response = true
+	packet.Header.AuthoritativeAnswer = true
+	packet.Questions = append(packet.Questions, NewDnsQuestion("www.example.com", A.ToNum()))
+	packet.Answers = append(packet.Answers,
+		CNAMERecord{Domain: "www.example.com", Host: "web.example.com", TTL: 300},
+		ARecord{Domain: "web.example.com", Addr: net.ParseIP("192.0.2.1"), TTL: 300},
+		AAAARecord{Domain: "web.example.com", Addr: net.ParseIP("2001:db8::1"), TTL: 300},
+		MXRecord{Domain: "example.com", Priority: 10, Host: "mail.example.com", TTL: 300},
+		UnknownRecord{Domain: "example.com", QType: 16, Data: []byte("\x05hello"), TTL: 300},
+	)
+	packet.Authorities = append(packet.Authorities,
+		NSRecord{Domain: "example.com", Host: "ns1.example.com", TTL: 3600},
+		SOARecord{Domain: "example.com", MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 7, Refresh: 1, Retry: 2, Expire: 3, Minimum: 4, TTL: 3600},
+	)
+
+	read := roundTrip(t, packet)
+	if read.Header.Id != 1234 || !read.Header.AuthoritativeAnswer {
+		t.Errorf("header = %+v", read.Header)
+	}
+	if len(read.Answers) != len(packet.Answers) || len(read.Authorities) != len(packet.Authorities) {
+		t.Fatalf("read %d answers and %d authorities", len(read.Answers), len(read.Authorities))
+	}
+	for i, record := range packet.Answers {
+		if RecordDomain(read.Answers[i]) != RecordDomain(record) || RecordType(read.Answers[i]) != RecordType(record) {
+			t.Errorf("answer %d = %+v, want %+v", i, read.Answers[i], record)
+		}
+	}
+	if soa := read.GetSOA(); soa == nil || soa.Serial != 7 || soa.Minimum != 4 {
+		t.Errorf("SOA = %+v", soa)
+	}
+}
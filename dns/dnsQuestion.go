@@ -46,7 +46,7 @@ func (dq *DnsQuestion) Write(buffer *BytePacketBuffer) error {
 		return err
 	}
 
-	err = buffer.WriteU16(1)
+	err = buffer.WriteU16(ClassIN)
 	if err != nil {
 		return err
 	}
@@ -8,11 +8,13 @@ import (
 
 type DnsRecord interface{}
 
+// UnknownRecord is a record of a type we don't understand, whose data is
+// kept as is so that it can be passed on intact (RFC 3597).
 type UnknownRecord struct {
-	Domain  string
-	QType   uint16
-	DataLen uint16
-	TTL     uint32
+	Domain string
+	QType  uint16
+	Data   []byte
+	TTL    uint32
 }
 
 type ARecord struct {
@@ -33,6 +35,18 @@ type CNAMERecord struct {
 	TTL    uint32
 }
 
+type SOARecord struct {
+	Domain  string
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+	TTL     uint32
+}
+
 type MXRecord struct {
 	Domain   string
 	Priority uint16
@@ -59,7 +73,7 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 	}
 	qtype := QueryTypeFromNum(qtypeNum)
 
-	_, err = buffer.ReadU16()
+	class, err := buffer.ReadU16()
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +88,34 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 		return nil, err
 	}
 
+	// Records of another class only show up in the prerequisite and update
+	// sections of UPDATE messages, where many of them have no data.
+	if class != ClassIN && qtype != OPT {
+		return readUpdateRecord(buffer, domain, qtypeNum, class, ttl, dataLen)
+	}
+
+	return readRecordData(buffer, domain, qtypeNum, class, ttl, dataLen)
+}
+
+// readRecordData reads the data of a record whose header was just read and
+// checks that it took up exactly the length given in the header.
+func readRecordData(buffer *BytePacketBuffer, domain string, qtypeNum uint16, class uint16, ttl uint32, dataLen uint16) (DnsRecord, error) {
+	start := buffer.Pos
+	record, err := readRecordFields(buffer, domain, qtypeNum, class, ttl, dataLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if buffer.Pos-start != int(dataLen) {
+		return nil, fmt.Errorf("type %d record for %s takes %d bytes, but its length is %d",
+			qtypeNum, domain, buffer.Pos-start, dataLen)
+	}
+
+	return record, nil
+}
+
+func readRecordFields(buffer *BytePacketBuffer, domain string, qtypeNum uint16, class uint16, ttl uint32, dataLen uint16) (DnsRecord, error) {
+	qtype := QueryTypeFromNum(qtypeNum)
 	switch qtype {
 	case A:
 		rawAddr, err := buffer.ReadU32()
@@ -112,11 +154,14 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 			return nil, err
 		}
 
-		addr := net.IP{
-			byte((rawAddr1 >> 16) & 0xFFFF), byte(rawAddr1 & 0xFFFF),
-			byte((rawAddr2 >> 16) & 0xFFFF), byte(rawAddr2 & 0xFFFF),
-			byte((rawAddr3 >> 16) & 0xFFFF), byte(rawAddr3 & 0xFFFF),
-			byte((rawAddr4 >> 16) & 0xFFFF), byte(rawAddr4 & 0xFFFF),
+		addr := make(net.IP, 0, net.IPv6len)
+		for _, rawAddr := range []uint32{rawAddr1, rawAddr2, rawAddr3, rawAddr4} {
+			addr = append(addr,
+				byte((rawAddr>>24)&0xFF),
+				byte((rawAddr>>16)&0xFF),
+				byte((rawAddr>>8)&0xFF),
+				byte((rawAddr>>0)&0xFF),
+			)
 		}
 
 		return AAAARecord{
@@ -145,12 +190,45 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 			return nil, err
 		}
 
-		return NSRecord{
+		return CNAMERecord{
 			Domain: domain,
 			Host:   cname,
 			TTL:    ttl,
 		}, nil
 
+	case SOA:
+		var mname string
+		err := buffer.ReadQname(&mname)
+		if err != nil {
+			return nil, err
+		}
+
+		var rname string
+		err = buffer.ReadQname(&rname)
+		if err != nil {
+			return nil, err
+		}
+
+		var fields [5]uint32
+		for i := range fields {
+			fields[i], err = buffer.ReadU32()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return SOARecord{
+			Domain:  domain,
+			MName:   mname,
+			RName:   rname,
+			Serial:  fields[0],
+			Refresh: fields[1],
+			Retry:   fields[2],
+			Expire:  fields[3],
+			Minimum: fields[4],
+			TTL:     ttl,
+		}, nil
+
 	case MX:
 		priority, err := buffer.ReadU16()
 		if err != nil {
@@ -169,121 +247,484 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 			TTL:      ttl,
 		}, nil
 
+	case OPT:
+		return readOPTRecord(buffer, class, ttl, dataLen)
+
+	case DNSKEY:
+		return readDNSKEYRecord(buffer, domain, ttl, dataLen)
+
+	case DS:
+		return readDSRecord(buffer, domain, ttl, dataLen)
+
+	case RRSIG:
+		return readRRSIGRecord(buffer, domain, ttl, dataLen)
+
+	case NSEC:
+		return readNSECRecord(buffer, domain, ttl, dataLen)
+
+	case NSEC3:
+		return readNSEC3Record(buffer, domain, ttl, dataLen)
+
+	case NSEC3PARAM:
+		return readNSEC3PARAMRecord(buffer, domain, ttl)
+
 	default:
-		err := buffer.Step(int(dataLen))
+		data, err := buffer.ReadBytes(int(dataLen))
 		if err != nil {
 			return nil, err
 		}
 
 		return UnknownRecord{
-			Domain:  domain,
-			QType:   qtypeNum,
-			DataLen: dataLen,
-			TTL:     ttl,
+			Domain: domain,
+			QType:  qtypeNum,
+			Data:   data,
+			TTL:    ttl,
 		}, nil
 	}
 }
 
-// TODO: handle errors for all writes
+// WriteDnsRecord writes a DNS record to the buffer and returns the number
+// of bytes written.
 func WriteDnsRecord(dr DnsRecord, buffer *BytePacketBuffer) (int, error) {
 	startPos := buffer.Pos
 
 	switch record := (dr).(type) {
 	case ARecord:
-		buffer.WriteQname(record.Domain)
-		buffer.WriteU16(A.ToNum())
-		buffer.WriteU16(1)
-		buffer.WriteU32(record.TTL)
-		buffer.WriteU16(4)
-
 		octets := record.Addr.To4()
-		buffer.WriteU8(octets[0])
-		buffer.WriteU8(octets[1])
-		buffer.WriteU8(octets[2])
-		buffer.WriteU8(octets[3])
-	case NSRecord:
-		buffer.WriteQname(record.Domain)
-		buffer.WriteU16(NS.ToNum())
-		buffer.WriteU16(1)
-		buffer.WriteU32(record.TTL)
+		if octets == nil {
+			return 0, fmt.Errorf("invalid IPv4 address %v for %s", record.Addr, record.Domain)
+		}
+
+		err := writeRecordHeader(buffer, record.Domain, A, record.TTL)
+		if err != nil {
+			return 0, err
+		}
 
-		pos := buffer.Pos
-		buffer.WriteU16(0)
+		err = writeRdata(buffer, func() error {
+			return buffer.WriteBytes(octets)
+		})
+		if err != nil {
+			return 0, err
+		}
 
-		buffer.WriteQname(record.Host)
+	case NSRecord:
+		err := writeRecordHeader(buffer, record.Domain, NS, record.TTL)
+		if err != nil {
+			return 0, err
+		}
 
-		size := buffer.Pos - (pos + 2)
-		buffer.SetU16(pos, uint16(size))
+		err = writeRdata(buffer, func() error {
+			return buffer.WriteQname(record.Host)
+		})
+		if err != nil {
+			return 0, err
+		}
 
 	case CNAMERecord:
-		err := buffer.WriteQname(record.Domain)
+		err := writeRecordHeader(buffer, record.Domain, CNAME, record.TTL)
 		if err != nil {
 			return 0, err
 		}
 
-		err = buffer.WriteU16(CNAME.ToNum())
+		err = writeRdata(buffer, func() error {
+			return buffer.WriteQname(record.Host)
+		})
 		if err != nil {
 			return 0, err
 		}
 
-		err = buffer.WriteU16(1)
+	case SOARecord:
+		err := writeRecordHeader(buffer, record.Domain, SOA, record.TTL)
 		if err != nil {
 			return 0, err
 		}
 
-		err = buffer.WriteU32(record.TTL)
+		err = writeRdata(buffer, func() error {
+			err := buffer.WriteQname(record.MName)
+			if err != nil {
+				return err
+			}
+
+			err = buffer.WriteQname(record.RName)
+			if err != nil {
+				return err
+			}
+
+			for _, field := range []uint32{record.Serial, record.Refresh, record.Retry, record.Expire, record.Minimum} {
+				err := buffer.WriteU32(field)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
 		if err != nil {
 			return 0, err
 		}
 
-		pos := buffer.Pos
-		err = buffer.WriteU16(0)
+	case MXRecord:
+		err := writeRecordHeader(buffer, record.Domain, MX, record.TTL)
 		if err != nil {
 			return 0, err
 		}
 
-		err = buffer.WriteQname(record.Host)
+		err = writeRdata(buffer, func() error {
+			err := buffer.WriteU16(record.Priority)
+			if err != nil {
+				return err
+			}
+			return buffer.WriteQname(record.Host)
+		})
 		if err != nil {
 			return 0, err
 		}
 
-		size := buffer.Pos - (pos + 2)
-		err = buffer.SetU16(pos, uint16(size))
+	case AAAARecord:
+		octets := record.Addr.To16()
+		if octets == nil {
+			return 0, fmt.Errorf("invalid IPv6 address %v for %s", record.Addr, record.Domain)
+		}
+
+		err := writeRecordHeader(buffer, record.Domain, AAAA, record.TTL)
 		if err != nil {
 			return 0, err
 		}
 
-	case MXRecord:
-		buffer.WriteQname(record.Domain)
-		buffer.WriteU16(MX.ToNum())
-		buffer.WriteU16(1)
-		buffer.WriteU32(record.TTL)
+		err = writeRdata(buffer, func() error {
+			return buffer.WriteBytes(octets)
+		})
+		if err != nil {
+			return 0, err
+		}
 
-		pos := buffer.Pos
-		buffer.WriteU16(0)
+	case OPTRecord:
+		err := writeOPTRecord(record, buffer)
+		if err != nil {
+			return 0, err
+		}
 
-		buffer.WriteU16(record.Priority)
-		buffer.WriteQname(record.Host)
+	case DNSKEYRecord:
+		err := writeDNSKEYRecord(record, buffer)
+		if err != nil {
+			return 0, err
+		}
 
-		size := buffer.Pos - (pos + 2)
-		buffer.SetU16(pos, uint16(size))
+	case DSRecord:
+		err := writeDSRecord(record, buffer)
+		if err != nil {
+			return 0, err
+		}
 
-	case AAAARecord:
-		buffer.WriteQname(record.Domain)
-		buffer.WriteU16(AAAA.ToNum())
-		buffer.WriteU16(1)
-		buffer.WriteU32(record.TTL)
-		buffer.WriteU16(16)
+	case RRSIGRecord:
+		err := writeRRSIGRecord(record, buffer)
+		if err != nil {
+			return 0, err
+		}
 
-		for octet := range record.Addr.To16() {
-			buffer.WriteU16(uint16(octet))
+	case NSECRecord:
+		err := writeNSECRecord(record, buffer)
+		if err != nil {
+			return 0, err
+		}
+
+	case NSEC3Record:
+		err := writeNSEC3Record(record, buffer)
+		if err != nil {
+			return 0, err
+		}
+
+	case NSEC3PARAMRecord:
+		err := writeNSEC3PARAMRecord(record, buffer)
+		if err != nil {
+			return 0, err
+		}
+
+	case UpdateRecord:
+		err := writeUpdateRecord(record, buffer)
+		if err != nil {
+			return 0, err
 		}
 
 	case UnknownRecord:
-		fmt.Printf("Skipping record: %+v\n", record)
+		// The type is written as is since it has no QueryType.
+		err := buffer.WriteQname(record.Domain)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, field := range []uint16{record.QType, ClassIN} {
+			err := buffer.WriteU16(field)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		err = buffer.WriteU32(record.TTL)
+		if err != nil {
+			return 0, err
+		}
+
+		err = writeRdata(buffer, func() error {
+			return buffer.WriteBytes(record.Data)
+		})
+		if err != nil {
+			return 0, err
+		}
+
 	default:
 		return 0, errors.New("unknown record type")
 	}
 
 	return buffer.Pos - startPos, nil
 }
+
+// writeRecordHeader writes the owner name, type, class and TTL of a record.
+func writeRecordHeader(buffer *BytePacketBuffer, domain string, qtype QueryType, ttl uint32) error {
+	err := buffer.WriteQname(domain)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU16(qtype.ToNum())
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU16(ClassIN)
+	if err != nil {
+		return err
+	}
+
+	return buffer.WriteU32(ttl)
+}
+
+// writeRdata writes the record data produced by write, preceded by its length.
+func writeRdata(buffer *BytePacketBuffer, write func() error) error {
+	pos := buffer.Pos
+	err := buffer.WriteU16(0)
+	if err != nil {
+		return err
+	}
+
+	err = write()
+	if err != nil {
+		return err
+	}
+
+	size := buffer.Pos - (pos + 2)
+	return buffer.SetU16(pos, uint16(size))
+}
+
+// RecordDomain returns the owner name of a record.
+func RecordDomain(dr DnsRecord) string {
+	switch record := dr.(type) {
+	case ARecord:
+		return record.Domain
+	case NSRecord:
+		return record.Domain
+	case CNAMERecord:
+		return record.Domain
+	case SOARecord:
+		return record.Domain
+	case MXRecord:
+		return record.Domain
+	case AAAARecord:
+		return record.Domain
+	case DNSKEYRecord:
+		return record.Domain
+	case DSRecord:
+		return record.Domain
+	case RRSIGRecord:
+		return record.Domain
+	case NSECRecord:
+		return record.Domain
+	case NSEC3Record:
+		return record.Domain
+	case NSEC3PARAMRecord:
+		return record.Domain
+	case UpdateRecord:
+		return record.Domain
+	case UnknownRecord:
+		return record.Domain
+	default:
+		return ""
+	}
+}
+
+// RecordType returns the numeric type of a record.
+func RecordType(dr DnsRecord) uint16 {
+	switch record := dr.(type) {
+	case ARecord:
+		return A.ToNum()
+	case NSRecord:
+		return NS.ToNum()
+	case CNAMERecord:
+		return CNAME.ToNum()
+	case SOARecord:
+		return SOA.ToNum()
+	case MXRecord:
+		return MX.ToNum()
+	case AAAARecord:
+		return AAAA.ToNum()
+	case OPTRecord:
+		return OPT.ToNum()
+	case DNSKEYRecord:
+		return DNSKEY.ToNum()
+	case DSRecord:
+		return DS.ToNum()
+	case RRSIGRecord:
+		return RRSIG.ToNum()
+	case NSECRecord:
+		return NSEC.ToNum()
+	case NSEC3Record:
+		return NSEC3.ToNum()
+	case NSEC3PARAMRecord:
+		return NSEC3PARAM.ToNum()
+	case UpdateRecord:
+		return record.QType
+	case UnknownRecord:
+		return record.QType
+	default:
+		return 0
+	}
+}
+
+// RecordTTL returns the TTL of a record.
+func RecordTTL(dr DnsRecord) uint32 {
+	switch record := dr.(type) {
+	case ARecord:
+		return record.TTL
+	case NSRecord:
+		return record.TTL
+	case CNAMERecord:
+		return record.TTL
+	case SOARecord:
+		return record.TTL
+	case MXRecord:
+		return record.TTL
+	case AAAARecord:
+		return record.TTL
+	case DNSKEYRecord:
+		return record.TTL
+	case DSRecord:
+		return record.TTL
+	case RRSIGRecord:
+		return record.TTL
+	case NSECRecord:
+		return record.TTL
+	case NSEC3Record:
+		return record.TTL
+	case NSEC3PARAMRecord:
+		return record.TTL
+	case UpdateRecord:
+		return record.TTL
+	case UnknownRecord:
+		return record.TTL
+	default:
+		return 0
+	}
+}
+
+// WithTTL returns a copy of the record with its TTL replaced.
+func WithTTL(dr DnsRecord, ttl uint32) DnsRecord {
+	switch record := dr.(type) {
+	case ARecord:
+		record.TTL = ttl
+		return record
+	case NSRecord:
+		record.TTL = ttl
+		return record
+	case CNAMERecord:
+		record.TTL = ttl
+		return record
+	case SOARecord:
+		record.TTL = ttl
+		return record
+	case MXRecord:
+		record.TTL = ttl
+		return record
+	case AAAARecord:
+		record.TTL = ttl
+		return record
+	case DNSKEYRecord:
+		record.TTL = ttl
+		return record
+	case DSRecord:
+		record.TTL = ttl
+		return record
+	case RRSIGRecord:
+		record.TTL = ttl
+		return record
+	case NSECRecord:
+		record.TTL = ttl
+		return record
+	case NSEC3Record:
+		record.TTL = ttl
+		return record
+	case NSEC3PARAMRecord:
+		record.TTL = ttl
+		return record
+	case UpdateRecord:
+		record.TTL = ttl
+		return record
+	case UnknownRecord:
+		record.TTL = ttl
+		return record
+	default:
+		return dr
+	}
+}
+
+// WithDomain returns a copy of the record with its owner name replaced, as
+// done when synthesizing records from a wildcard.
+func WithDomain(dr DnsRecord, domain string) DnsRecord {
+	switch record := dr.(type) {
+	case ARecord:
+		record.Domain = domain
+		return record
+	case NSRecord:
+		record.Domain = domain
+		return record
+	case CNAMERecord:
+		record.Domain = domain
+		return record
+	case SOARecord:
+		record.Domain = domain
+		return record
+	case MXRecord:
+		record.Domain = domain
+		return record
+	case AAAARecord:
+		record.Domain = domain
+		return record
+	case DNSKEYRecord:
+		record.Domain = domain
+		return record
+	case DSRecord:
+		record.Domain = domain
+		return record
+	case RRSIGRecord:
+		record.Domain = domain
+		return record
+	case NSECRecord:
+		record.Domain = domain
+		return record
+	case NSEC3Record:
+		record.Domain = domain
+		return record
+	case NSEC3PARAMRecord:
+		record.Domain = domain
+		return record
+	case UpdateRecord:
+		record.Domain = domain
+		if record.Record != nil {
+			record.Record = WithDomain(record.Record, domain)
+		}
+		return record
+	case UnknownRecord:
+		record.Domain = domain
+		return record
+	default:
+		return dr
+	}
+}
@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"testing"
+)
+
+// rawRecord builds a record for example.com with the given type, length
+// field and data.
+func rawRecord(qtype uint16, dataLen uint16, data []byte) *BytePacketBuffer {
+	raw := []byte("\x07example\x03com\x00")
+	raw = append(raw, byte(qtype>>8), byte(qtype), 0, 1, 0, 0, 0x0e, 0x10)
+	raw = append(raw, byte(dataLen>>8), byte(dataLen))
+	raw = append(raw, data...)
+	return NewBytePacketBufferFromBytes(raw)
+}
+
+func TestReadDnsRecordLength(t *testing.T) {
+	name := []byte("\x02ns\x07example\x03com\x00")
+	soa := append(append(append([]byte{}, name...), name...), make([]byte, 20)...)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		dataLen uint16
+		data    []byte
+		wantErr bool
+	}{
+		{"A", 1, 4, []byte{192, 0, 2, 1}, false},
+		{"A longer than four bytes", 1, 5, []byte{192, 0, 2, 1, 0}, true},
+		{"A shorter than four bytes", 1, 3, []byte{192, 0, 2, 1}, true},
+		{"AAAA", 28, 16, make([]byte, 16), false},
+		{"AAAA with a bad length", 28, 17, make([]byte, 17), true},
+		{"NS", 2, uint16(len(name)), name, false},
+		{"NS with trailing data", 2, uint16(len(name)) + 2, append(append([]byte{}, name...), 0, 0), true},
+		{"NS name beyond the length", 2, 3, name, true},
+		{"CNAME with trailing data", 5, uint16(len(name)) + 1, append(append([]byte{}, name...), 0), true},
+		{"MX", 15, uint16(len(name)) + 2, append([]byte{0, 10}, name...), false},
+		{"MX with a bad length", 15, uint16(len(name)), append([]byte{0, 10}, name...), true},
+		{"SOA", 6, uint16(len(soa)), soa, false},
+		{"SOA with trailing data", 6, uint16(len(soa)) + 4, append(append([]byte{}, soa...), 0, 0, 0, 0), true},
+		{"unknown type", 16, 3, []byte("\x02hi"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadDnsRecord(rawRecord(test.qtype, test.dataLen, test.data))
+			if (err != nil) != test.wantErr {
+				t.Errorf("err = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package dns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNSSEC algorithms we can verify signatures of.
+const (
+	AlgorithmRSASHA256       = 8
+	AlgorithmRSASHA512       = 10
+	AlgorithmECDSAP256SHA256 = 13
+	AlgorithmECDSAP384SHA384 = 14
+	AlgorithmED25519         = 15
+)
+
+// DS digest types we can check.
+const (
+	DigestSHA1   = 1
+	DigestSHA256 = 2
+	DigestSHA384 = 4
+)
+
+// DNSKEY flags.
+const (
+	DNSKEYFlagZone   = 0x0100
+	DNSKEYFlagRevoke = 0x0080
+	DNSKEYFlagSEP    = 0x0001
+)
+
+// ErrUnsupportedAlgorithm is returned for keys, signatures and digests using
+// an algorithm we don't implement.
+var ErrUnsupportedAlgorithm = errors.New("unsupported DNSSEC algorithm")
+
+// SupportedAlgorithm reports whether signatures made with the algorithm can
+// be verified.
+func SupportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case AlgorithmRSASHA256, AlgorithmRSASHA512, AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384, AlgorithmED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// SupportedDigest reports whether DS records with the digest type can be
+// checked.
+func SupportedDigest(digestType uint8) bool {
+	switch digestType {
+	case DigestSHA1, DigestSHA256, DigestSHA384:
+		return true
+	default:
+		return false
+	}
+}
+
+// KeyTag computes the tag identifying a key in DS and RRSIG records
+// (RFC 4034 appendix B).
+func KeyTag(key DNSKEYRecord) uint16 {
+	buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+	err := writeDNSKEYRdata(key, buffer)
+	if err != nil {
+		return 0
+	}
+
+	var sum uint32
+	for i, b := range buffer.Buf[:buffer.Pos] {
+		if i&1 == 0 {
+			sum += uint32(b) << 8
+		} else {
+			sum += uint32(b)
+		}
+	}
+	sum += sum >> 16 & 0xFFFF
+	return uint16(sum)
+}
+
+// DSDigest computes the digest of a key as published in the DS records of
+// the parent zone (RFC 4034 section 5.1.4).
+func DSDigest(key DNSKEYRecord, digestType uint8) ([]byte, error) {
+	buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+	err := buffer.WriteQnameUncompressed(strings.ToLower(key.Domain))
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeDNSKEYRdata(key, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	data := buffer.Buf[:buffer.Pos]
+	switch digestType {
+	case DigestSHA1:
+		digest := sha1.Sum(data)
+		return digest[:], nil
+	case DigestSHA256:
+		digest := sha256.Sum256(data)
+		return digest[:], nil
+	case DigestSHA384:
+		digest := sha512.Sum384(data)
+		return digest[:], nil
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+}
+
+// MatchesDS reports whether the DS record designates the key.
+func MatchesDS(ds DSRecord, key DNSKEYRecord) bool {
+	if ds.Algorithm != key.Algorithm || ds.KeyTag != KeyTag(key) || !IsSubdomain(ds.Domain, key.Domain) || !IsSubdomain(key.Domain, ds.Domain) {
+		return false
+	}
+
+	digest, err := DSDigest(key, ds.DigestType)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(digest, ds.Digest)
+}
+
+// SignatureValidAt reports whether t falls within the validity period of
+// the signature, using serial number arithmetic as RFC 4034 requires.
+func SignatureValidAt(sig RRSIGRecord, t time.Time) bool {
+	now := uint32(t.Unix())
+	return int32(now-sig.Inception) >= 0 && int32(sig.Expiration-now) >= 0
+}
+
+// VerifyRRSIG checks the signature of a record set with the key. It does not
+// look at the validity period of the signature.
+func VerifyRRSIG(sig RRSIGRecord, key DNSKEYRecord, rrset []DnsRecord) error {
+	if sig.Algorithm != key.Algorithm || sig.KeyTag != KeyTag(key) {
+		return errors.New("signature was not made with this key")
+	}
+	if key.Flags&DNSKEYFlagZone == 0 || key.Protocol != 3 {
+		return errors.New("key is not a zone key")
+	}
+	if len(rrset) == 0 {
+		return errors.New("empty record set")
+	}
+
+	data, err := signedData(sig, rrset)
+	if err != nil {
+		return err
+	}
+
+	return verifySignature(key, data, sig.Signature)
+}
+
+// signedData builds the data covered by the signature: the RRSIG RDATA
+// without the signature, followed by the records of the set in canonical
+// form and order (RFC 4034 section 3.1.8.1). Names in the records are
+// expected to be lowercase already, as ReadQname leaves them.
+func signedData(sig RRSIGRecord, rrset []DnsRecord) ([]byte, error) {
+	buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+	sig.SignerName = strings.ToLower(sig.SignerName)
+	err := writeRRSIGFields(sig, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	// A record synthesized from a wildcard is signed under the name of
+	// the wildcard, which has fewer labels than the record itself.
+	owner := strings.ToLower(strings.TrimSuffix(RecordDomain(rrset[0]), "."))
+	labels := strings.Split(owner, ".")
+	if owner != "" && len(labels) > int(sig.Labels) {
+		owner = strings.Join(append([]string{"*"}, labels[len(labels)-int(sig.Labels):]...), ".")
+	}
+
+	ownerBuffer := NewBytePacketBufferWithSize(256)
+	err = ownerBuffer.WriteQnameUncompressed(owner)
+	if err != nil {
+		return nil, err
+	}
+	ownerWire := ownerBuffer.Buf[:ownerBuffer.Pos]
+
+	var rdatas [][]byte
+	for _, record := range rrset {
+		recordBuffer := NewBytePacketBufferWithSize(MaxPacketSize)
+		_, err := WriteDnsRecord(WithTTL(record, sig.OriginalTTL), recordBuffer)
+		if err != nil {
+			return nil, err
+		}
+
+		// Everything after the owner name: type, class, TTL and RDATA.
+		rest := recordBuffer.Buf[nameWireLength(RecordDomain(record)):recordBuffer.Pos]
+		rdatas = append(rdatas, rest)
+	}
+
+	// Records are sorted by their RDATA, which follows the ten bytes of
+	// type, class, TTL and RDATA length, and duplicates are dropped.
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i][10:], rdatas[j][10:]) < 0
+	})
+
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+
+		err := buffer.WriteBytes(ownerWire)
+		if err != nil {
+			return nil, err
+		}
+
+		err = buffer.WriteBytes(rdata)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer.Buf[:buffer.Pos], nil
+}
+
+// nameWireLength returns the length of a name written without compression.
+func nameWireLength(name string) int {
+	length := 1
+	for _, label := range nameLabels(name) {
+		length += len(labelBytes(label)) + 1
+	}
+	return length
+}
+
+// verifySignature checks a signature made over data with the key.
+func verifySignature(key DNSKEYRecord, data []byte, signature []byte) error {
+	switch key.Algorithm {
+	case AlgorithmRSASHA256, AlgorithmRSASHA512:
+		publicKey, err := parseRSAKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+
+		hash := crypto.SHA256
+		if key.Algorithm == AlgorithmRSASHA512 {
+			hash = crypto.SHA512
+		}
+		hasher := hash.New()
+		hasher.Write(data)
+
+		return rsa.VerifyPKCS1v15(publicKey, hash, hasher.Sum(nil), signature)
+
+	case AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384:
+		curve, hash := elliptic.P256(), crypto.SHA256
+		if key.Algorithm == AlgorithmECDSAP384SHA384 {
+			curve, hash = elliptic.P384(), crypto.SHA384
+		}
+
+		size := curve.Params().BitSize / 8
+		if len(key.PublicKey) != 2*size || len(signature) != 2*size {
+			return errors.New("malformed ECDSA key or signature")
+		}
+
+		publicKey := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		hasher := hash.New()
+		hasher.Write(data)
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, hasher.Sum(nil), r, s) {
+			return errors.New("ECDSA signature verification failed")
+		}
+		return nil
+
+	case AlgorithmED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("malformed Ed25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, signature) {
+			return errors.New("Ed25519 signature verification failed")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("%w %d", ErrUnsupportedAlgorithm, key.Algorithm)
+	}
+}
+
+// parseRSAKey decodes an RSA public key in the format of RFC 3110: the
+// exponent length, the exponent and then the modulus.
+func parseRSAKey(data []byte) (*rsa.PublicKey, error) {
+	if len(data) < 3 {
+		return nil, errors.New("malformed RSA key")
+	}
+
+	exponentLen := int(data[0])
+	data = data[1:]
+	if exponentLen == 0 {
+		exponentLen = int(data[0])<<8 | int(data[1])
+		data = data[2:]
+	}
+
+	if exponentLen == 0 || exponentLen > 4 || len(data) <= exponentLen {
+		return nil, errors.New("malformed RSA key")
+	}
+
+	exponent := 0
+	for _, b := range data[:exponentLen] {
+		exponent = exponent<<8 | int(b)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(data[exponentLen:]),
+		E: exponent,
+	}, nil
+}
@@ -0,0 +1,535 @@
+package dns
+
+import (
+	"errors"
+	"sort"
+)
+
+// DNSKEYRecord holds a public key used to verify the signatures of a zone
+// (RFC 4034 section 2).
+type DNSKEYRecord struct {
+	Domain    string
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+	TTL       uint32
+}
+
+// DSRecord holds the digest of a DNSKEY of a child zone, which is published
+// in the parent zone to link the two (RFC 4034 section 5).
+type DSRecord struct {
+	Domain     string
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+	TTL        uint32
+}
+
+// RRSIGRecord holds the signature of a record set (RFC 4034 section 3).
+type RRSIGRecord struct {
+	Domain      string
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+	TTL         uint32
+}
+
+// NSECRecord proves that no name exists between its owner and NextDomain,
+// and lists the types present at its owner (RFC 4034 section 4).
+type NSECRecord struct {
+	Domain     string
+	NextDomain string
+	Types      []uint16
+	TTL        uint32
+}
+
+// NSEC3Record is the hashed counterpart of NSECRecord (RFC 5155 section 3).
+type NSEC3Record struct {
+	Domain        string
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []uint16
+	TTL           uint32
+}
+
+// NSEC3PARAMRecord holds the parameters used to hash the names of a zone
+// (RFC 5155 section 4).
+type NSEC3PARAMRecord struct {
+	Domain        string
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	TTL           uint32
+}
+
+func readDNSKEYRecord(buffer *BytePacketBuffer, domain string, ttl uint32, dataLen uint16) (DNSKEYRecord, error) {
+	record := DNSKEYRecord{Domain: domain, TTL: ttl}
+	if dataLen < 4 {
+		return record, errors.New("DNSKEY record too short")
+	}
+
+	var err error
+	record.Flags, err = buffer.ReadU16()
+	if err != nil {
+		return record, err
+	}
+
+	record.Protocol, err = buffer.Read()
+	if err != nil {
+		return record, err
+	}
+
+	record.Algorithm, err = buffer.Read()
+	if err != nil {
+		return record, err
+	}
+
+	record.PublicKey, err = buffer.ReadBytes(int(dataLen) - 4)
+	return record, err
+}
+
+func readDSRecord(buffer *BytePacketBuffer, domain string, ttl uint32, dataLen uint16) (DSRecord, error) {
+	record := DSRecord{Domain: domain, TTL: ttl}
+	if dataLen < 4 {
+		return record, errors.New("DS record too short")
+	}
+
+	var err error
+	record.KeyTag, err = buffer.ReadU16()
+	if err != nil {
+		return record, err
+	}
+
+	record.Algorithm, err = buffer.Read()
+	if err != nil {
+		return record, err
+	}
+
+	record.DigestType, err = buffer.Read()
+	if err != nil {
+		return record, err
+	}
+
+	record.Digest, err = buffer.ReadBytes(int(dataLen) - 4)
+	return record, err
+}
+
+func readRRSIGRecord(buffer *BytePacketBuffer, domain string, ttl uint32, dataLen uint16) (RRSIGRecord, error) {
+	record := RRSIGRecord{Domain: domain, TTL: ttl}
+	end := buffer.Pos + int(dataLen)
+
+	var err error
+	record.TypeCovered, err = buffer.ReadU16()
+	if err != nil {
+		return record, err
+	}
+
+	record.Algorithm, err = buffer.Read()
+	if err != nil {
+		return record, err
+	}
+
+	record.Labels, err = buffer.Read()
+	if err != nil {
+		return record, err
+	}
+
+	record.OriginalTTL, err = buffer.ReadU32()
+	if err != nil {
+		return record, err
+	}
+
+	record.Expiration, err = buffer.ReadU32()
+	if err != nil {
+		return record, err
+	}
+
+	record.Inception, err = buffer.ReadU32()
+	if err != nil {
+		return record, err
+	}
+
+	record.KeyTag, err = buffer.ReadU16()
+	if err != nil {
+		return record, err
+	}
+
+	err = buffer.ReadQname(&record.SignerName)
+	if err != nil {
+		return record, err
+	}
+
+	if buffer.Pos > end {
+		return record, errors.New("RRSIG signer name exceeds record data")
+	}
+
+	record.Signature, err = buffer.ReadBytes(end - buffer.Pos)
+	return record, err
+}
+
+func readNSECRecord(buffer *BytePacketBuffer, domain string, ttl uint32, dataLen uint16) (NSECRecord, error) {
+	record := NSECRecord{Domain: domain, TTL: ttl}
+	end := buffer.Pos + int(dataLen)
+
+	err := buffer.ReadQname(&record.NextDomain)
+	if err != nil {
+		return record, err
+	}
+
+	record.Types, err = readTypeBitMap(buffer, end)
+	return record, err
+}
+
+func readNSEC3Record(buffer *BytePacketBuffer, domain string, ttl uint32, dataLen uint16) (NSEC3Record, error) {
+	record := NSEC3Record{Domain: domain, TTL: ttl}
+	end := buffer.Pos + int(dataLen)
+
+	var err error
+	record.HashAlgorithm, record.Flags, record.Iterations, record.Salt, err = readNSEC3Params(buffer)
+	if err != nil {
+		return record, err
+	}
+
+	hashLen, err := buffer.Read()
+	if err != nil {
+		return record, err
+	}
+
+	record.NextHashed, err = buffer.ReadBytes(int(hashLen))
+	if err != nil {
+		return record, err
+	}
+
+	record.Types, err = readTypeBitMap(buffer, end)
+	return record, err
+}
+
+func readNSEC3PARAMRecord(buffer *BytePacketBuffer, domain string, ttl uint32) (NSEC3PARAMRecord, error) {
+	record := NSEC3PARAMRecord{Domain: domain, TTL: ttl}
+
+	var err error
+	record.HashAlgorithm, record.Flags, record.Iterations, record.Salt, err = readNSEC3Params(buffer)
+	return record, err
+}
+
+// readNSEC3Params reads the hashing parameters shared by NSEC3 and
+// NSEC3PARAM records.
+func readNSEC3Params(buffer *BytePacketBuffer) (uint8, uint8, uint16, []byte, error) {
+	hashAlgorithm, err := buffer.Read()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	flags, err := buffer.Read()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	iterations, err := buffer.ReadU16()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	saltLen, err := buffer.Read()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	salt, err := buffer.ReadBytes(int(saltLen))
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	return hashAlgorithm, flags, iterations, salt, nil
+}
+
+// readTypeBitMap reads the type bitmap of NSEC and NSEC3 records, which runs
+// until end (RFC 4034 section 4.1.2).
+func readTypeBitMap(buffer *BytePacketBuffer, end int) ([]uint16, error) {
+	var types []uint16
+	for buffer.Pos < end {
+		window, err := buffer.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := buffer.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		if length == 0 || length > 32 || buffer.Pos+int(length) > end {
+			return nil, errors.New("malformed type bitmap")
+		}
+
+		bitmap, err := buffer.ReadBytes(int(length))
+		if err != nil {
+			return nil, err
+		}
+
+		for i, octet := range bitmap {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, uint16(window)<<8|uint16(i*8+bit))
+				}
+			}
+		}
+	}
+
+	if buffer.Pos != end {
+		return nil, errors.New("type bitmap exceeds record data")
+	}
+
+	return types, nil
+}
+
+// writeTypeBitMap writes the types as a sequence of window blocks, each
+// holding a bitmap of the types present in one of 256 ranges of types.
+func writeTypeBitMap(buffer *BytePacketBuffer, types []uint16) error {
+	sorted := append([]uint16(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var bitmap [32]byte
+	window, length := -1, 0
+	flush := func() error {
+		if window < 0 {
+			return nil
+		}
+
+		err := buffer.WriteU8(uint8(window))
+		if err != nil {
+			return err
+		}
+
+		err = buffer.WriteU8(uint8(length))
+		if err != nil {
+			return err
+		}
+
+		return buffer.WriteBytes(bitmap[:length])
+	}
+
+	for _, qtype := range sorted {
+		if int(qtype>>8) != window {
+			err := flush()
+			if err != nil {
+				return err
+			}
+
+			window, length = int(qtype>>8), 0
+			bitmap = [32]byte{}
+		}
+
+		low := qtype & 0xFF
+		bitmap[low/8] |= 0x80 >> (low % 8)
+		length = int(low/8) + 1
+	}
+
+	return flush()
+}
+
+func writeDNSKEYRecord(record DNSKEYRecord, buffer *BytePacketBuffer) error {
+	err := writeRecordHeader(buffer, record.Domain, DNSKEY, record.TTL)
+	if err != nil {
+		return err
+	}
+
+	return writeRdata(buffer, func() error {
+		return writeDNSKEYRdata(record, buffer)
+	})
+}
+
+// writeDNSKEYRdata writes the RDATA of a DNSKEY record, which is also what
+// key tags and DS digests are computed over.
+func writeDNSKEYRdata(record DNSKEYRecord, buffer *BytePacketBuffer) error {
+	err := buffer.WriteU16(record.Flags)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU8(record.Protocol)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU8(record.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	return buffer.WriteBytes(record.PublicKey)
+}
+
+func writeDSRecord(record DSRecord, buffer *BytePacketBuffer) error {
+	err := writeRecordHeader(buffer, record.Domain, DS, record.TTL)
+	if err != nil {
+		return err
+	}
+
+	return writeRdata(buffer, func() error {
+		err := buffer.WriteU16(record.KeyTag)
+		if err != nil {
+			return err
+		}
+
+		err = buffer.WriteU8(record.Algorithm)
+		if err != nil {
+			return err
+		}
+
+		err = buffer.WriteU8(record.DigestType)
+		if err != nil {
+			return err
+		}
+
+		return buffer.WriteBytes(record.Digest)
+	})
+}
+
+func writeRRSIGRecord(record RRSIGRecord, buffer *BytePacketBuffer) error {
+	err := writeRecordHeader(buffer, record.Domain, RRSIG, record.TTL)
+	if err != nil {
+		return err
+	}
+
+	return writeRdata(buffer, func() error {
+		err := writeRRSIGFields(record, buffer)
+		if err != nil {
+			return err
+		}
+
+		return buffer.WriteBytes(record.Signature)
+	})
+}
+
+// writeRRSIGFields writes the RDATA of an RRSIG record up to, but excluding,
+// the signature itself, which is also the start of the signed data.
+func writeRRSIGFields(record RRSIGRecord, buffer *BytePacketBuffer) error {
+	err := buffer.WriteU16(record.TypeCovered)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU8(record.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU8(record.Labels)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range []uint32{record.OriginalTTL, record.Expiration, record.Inception} {
+		err := buffer.WriteU32(field)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = buffer.WriteU16(record.KeyTag)
+	if err != nil {
+		return err
+	}
+
+	return buffer.WriteQnameUncompressed(record.SignerName)
+}
+
+func writeNSECRecord(record NSECRecord, buffer *BytePacketBuffer) error {
+	err := writeRecordHeader(buffer, record.Domain, NSEC, record.TTL)
+	if err != nil {
+		return err
+	}
+
+	return writeRdata(buffer, func() error {
+		err := buffer.WriteQnameUncompressed(record.NextDomain)
+		if err != nil {
+			return err
+		}
+
+		return writeTypeBitMap(buffer, record.Types)
+	})
+}
+
+func writeNSEC3Record(record NSEC3Record, buffer *BytePacketBuffer) error {
+	err := writeRecordHeader(buffer, record.Domain, NSEC3, record.TTL)
+	if err != nil {
+		return err
+	}
+
+	return writeRdata(buffer, func() error {
+		err := writeNSEC3Params(buffer, record.HashAlgorithm, record.Flags, record.Iterations, record.Salt)
+		if err != nil {
+			return err
+		}
+
+		if len(record.NextHashed) > 255 {
+			return errors.New("NSEC3 next hashed owner name too long")
+		}
+
+		err = buffer.WriteU8(uint8(len(record.NextHashed)))
+		if err != nil {
+			return err
+		}
+
+		err = buffer.WriteBytes(record.NextHashed)
+		if err != nil {
+			return err
+		}
+
+		return writeTypeBitMap(buffer, record.Types)
+	})
+}
+
+func writeNSEC3PARAMRecord(record NSEC3PARAMRecord, buffer *BytePacketBuffer) error {
+	err := writeRecordHeader(buffer, record.Domain, NSEC3PARAM, record.TTL)
+	if err != nil {
+		return err
+	}
+
+	return writeRdata(buffer, func() error {
+		return writeNSEC3Params(buffer, record.HashAlgorithm, record.Flags, record.Iterations, record.Salt)
+	})
+}
+
+// writeNSEC3Params writes the hashing parameters shared by NSEC3 and
+// NSEC3PARAM records.
+func writeNSEC3Params(buffer *BytePacketBuffer, hashAlgorithm uint8, flags uint8, iterations uint16, salt []byte) error {
+	if len(salt) > 255 {
+		return errors.New("NSEC3 salt too long")
+	}
+
+	err := buffer.WriteU8(hashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU8(flags)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU16(iterations)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU8(uint8(len(salt)))
+	if err != nil {
+		return err
+	}
+
+	return buffer.WriteBytes(salt)
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The vectors below are the examples of RFC 4034 section 5.4, RFC 6605
+// section 6 and RFC 8080 section 6.
+const dnssecVectors = `
+dskey.example.com. 86400 IN DNSKEY 256 3 5 ( AQOeiiR0GOMYkDshWoSKz9Xz
+                                             fwJr1AYtsmx3TGkJaNXVbfi/
+                                             2pHm822aJ5iI9BMzNXxeYCmZ
+                                             DRD99WYwYqUSdjMmmAphXdvx
+                                             egXd/M5+X7OrzKBaMbCVdFLU
+                                             Uh6DhweJBjEVv5f2wwjM9Xzc
+                                             nOf+EPbtG9DMBmADjFDc2w/r
+                                             ljwvFw==
+                                             ) ;  key id = 60485
+dskey.example.com. 86400 IN DS 60485 5 1 ( 2BB183AF5F22588179A53B0A
+                                           98631FAD1A292118 )
+
+example.net. 3600 IN DNSKEY 257 3 13 (
+        GojIhhXUN/u4v54ZQqGSnyhWJwaubCvTmeexv7bR6edb
+        krSqQpF64cYbcB7wNcP+e+MAnLr+Wi9xMWyQLc8NAA== )
+example.net. 3600 IN DS 55648 13 2 (
+        b4c8c1fe2e7477127b27115656ad6256f424625bf5c1
+        e2770ce6d6e37df61d17 )
+www.example.net. 3600 IN A 192.0.2.1
+www.example.net. 3600 IN RRSIG A 13 3 3600 (
+        20100909100439 20100812100439 55648 example.net.
+        qx6wLYqmh+l9oCKTN6qIc+bw6ya+KJ8oMz0YP107epXA
+        yGmt+3SNruPFKG7tZoLBLlUzGGus7ZwmwWep666VCw== )
+
+example.com. 3600 IN DNSKEY 257 3 15 (
+        l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4= )
+example.com. 3600 IN DS 3613 15 2 (
+        3aa5ab37efce57f737fc1627013fee07bdf241bd10f3b1964ab55c78e79
+        a304b )
+example.com. 3600 IN MX 10 mail.example.com.
+example.com. 3600 IN RRSIG MX 15 2 3600 (
+        1440021600 1438207200 3613 example.com.
+        oL9krJun7xfBOIWcGHi7mag5/hdZrKWw15jPGrHpjQeRAvTdszaPD+QLs3f
+        x8A4M3e23mRZ9VrbpMngwcrqNAg== )
+`
+
+type dnssecVector struct {
+	key  DNSKEYRecord
+	ds   DSRecord
+	sig  *RRSIGRecord
+	data []DnsRecord
+}
+
+// readDNSSECVectors groups the vectors by the domain of their key.
+func readDNSSECVectors(t *testing.T) map[string]*dnssecVector {
+	t.Helper()
+	records, err := readTestZone(t, dnssecVectors)
+	if err != nil {
+		t.Fatalf("ReadZoneFile: %v", err)
+	}
+
+	vectors := make(map[string]*dnssecVector)
+	var current *dnssecVector
+	for _, record := range records {
+		switch record := record.(type) {
+		case DNSKEYRecord:
+			current = &dnssecVector{key: record}
+			vectors[record.Domain] = current
+		case DSRecord:
+			current.ds = record
+		case RRSIGRecord:
+			current.sig = &record
+		default:
+			current.data = append(current.data, record)
+		}
+	}
+	return vectors
+}
+
+func TestKeyTagAndDSDigest(t *testing.T) {
+	vectors := readDNSSECVectors(t)
+	for _, name := range []string{"dskey.example.com", "example.net", "example.com"} {
+		t.Run(name, func(t *testing.T) {
+			vector := vectors[name]
+			if vector == nil {
+				t.Fatal("missing vector")
+			}
+
+			if tag := KeyTag(vector.key); tag != vector.ds.KeyTag {
+				t.Errorf("KeyTag = %d, want %d", tag, vector.ds.KeyTag)
+			}
+			digest, err := DSDigest(vector.key, vector.ds.DigestType)
+			if err != nil {
+				t.Fatalf("DSDigest: %v", err)
+			}
+			if !bytes.Equal(digest, vector.ds.Digest) {
+				t.Errorf("DSDigest = %x, want %x", digest, vector.ds.Digest)
+			}
+			if !MatchesDS(vector.ds, vector.key) {
+				t.Error("MatchesDS = false")
+			}
+		})
+	}
+}
+
+func TestVerifyRRSIG(t *testing.T) {
+	vectors := readDNSSECVectors(t)
+
+	tests := []struct {
+		name    string
+		key     string
+		change  func(sig *RRSIGRecord, data []DnsRecord) []DnsRecord
+		wantErr bool
+	}{
+		{"ECDSA P-256", "example.net", nil, false},
+		{"Ed25519", "example.com", nil, false},
+		{"ECDSA P-256 with changed data", "example.net", func(sig *RRSIGRecord, data []DnsRecord) []DnsRecord {
+			record := data[0].(ARecord)
+			record.Addr = []byte{192, 0, 2, 2}
+			return []DnsRecord{record}
+		}, true},
+		{"Ed25519 with changed data", "example.com", func(sig *RRSIGRecord, data []DnsRecord) []DnsRecord {
+			record := data[0].(MXRecord)
+			record.Priority = 20
+			return []DnsRecord{record}
+		}, true},
+		{"Ed25519 with another TTL", "example.com", func(sig *RRSIGRecord, data []DnsRecord) []DnsRecord {
+			return []DnsRecord{WithTTL(data[0], 60)}
+		}, false},
+		{"Ed25519 with another original TTL", "example.com", func(sig *RRSIGRecord, data []DnsRecord) []DnsRecord {
+			sig.OriginalTTL = 60
+			return data
+		}, true},
+		{"Ed25519 with another key tag", "example.com", func(sig *RRSIGRecord, data []DnsRecord) []DnsRecord {
+			sig.KeyTag++
+			return data
+		}, true},
+		{"empty record set", "example.com", func(sig *RRSIGRecord, data []DnsRecord) []DnsRecord {
+			return nil
+		}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vector := vectors[test.key]
+			sig := *vector.sig
+			data := append([]DnsRecord(nil), vector.data...)
+			if test.change != nil {
+				data = test.change(&sig, data)
+			}
+
+			err := VerifyRRSIG(sig, vector.key, data)
+			if (err != nil) != test.wantErr {
+				t.Errorf("VerifyRRSIG = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
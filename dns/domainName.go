@@ -0,0 +1,153 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+)
+
+// IsSubdomain reports whether name is zone itself or lies below it. Names
+// are compared label by label without regard to case, so "evilexample.com"
+// is not below "example.com". Every name lies below the root zone "".
+func IsSubdomain(name string, zone string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+
+	if zone == "" {
+		return true
+	}
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// LabelCount returns the number of labels in a name, not counting the root.
+func LabelCount(name string) int {
+	return len(nameLabels(name))
+}
+
+// SignatureLabelCount returns the number of labels in a name as the Labels
+// field of RRSIG records counts them, leaving out the root and a leading
+// wildcard label (RFC 4034 section 3.1.3).
+func SignatureLabelCount(name string) int {
+	labels := nameLabels(name)
+	if len(labels) > 0 && labels[0] == "*" {
+		return len(labels) - 1
+	}
+	return len(labels)
+}
+
+// escapeLabel turns the bytes of a label into the form names are kept in.
+// Names are dotted strings, so a dot or backslash inside a label is written
+// as a \DDD escape (RFC 1035 section 5.1), which keeps every dot of a name a
+// label separator.
+func escapeLabel(label []byte) string {
+	var escaped strings.Builder
+	for _, b := range label {
+		switch b {
+		case '.':
+			escaped.WriteString(`\046`)
+		case '\\':
+			escaped.WriteString(`\092`)
+		default:
+			escaped.WriteByte(b)
+		}
+	}
+	return escaped.String()
+}
+
+// unescapeLabel decodes the \X and \DDD escapes of a label (RFC 1035
+// section 5.1) into its bytes.
+func unescapeLabel(label string) ([]byte, error) {
+	if !strings.Contains(label, `\`) {
+		return []byte(label), nil
+	}
+
+	data := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' {
+			data = append(data, label[i])
+			continue
+		}
+
+		i++
+		if i == len(label) {
+			return nil, errors.New("escape at the end of a label")
+		}
+		if label[i] < '0' || label[i] > '9' {
+			data = append(data, label[i])
+			continue
+		}
+
+		if i+3 > len(label) {
+			return nil, errors.New("escape with fewer than three digits")
+		}
+		value := 0
+		for _, digit := range []byte(label[i : i+3]) {
+			if digit < '0' || digit > '9' {
+				return nil, errors.New("escape with fewer than three digits")
+			}
+			value = value*10 + int(digit-'0')
+		}
+		if value > 255 {
+			return nil, errors.New("escape above 255")
+		}
+		data = append(data, byte(value))
+		i += 2
+	}
+	return data, nil
+}
+
+// CompareNames orders two names the way DNSSEC does (RFC 4034 section 6.1):
+// label by label starting from the root, comparing lowercase labels as
+// bytes, with a name sorting before the names below it. It returns -1, 0 or
+// +1 like strings.Compare.
+func CompareNames(a string, b string) int {
+	aLabels := nameLabels(a)
+	bLabels := nameLabels(b)
+
+	for i := 1; i <= len(aLabels) && i <= len(bLabels); i++ {
+		c := strings.Compare(labelBytes(aLabels[len(aLabels)-i]), labelBytes(bLabels[len(bLabels)-i]))
+		if c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(aLabels) < len(bLabels):
+		return -1
+	case len(aLabels) > len(bLabels):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// CommonAncestor returns the deepest name that both names are equal to or
+// lie below.
+func CommonAncestor(a string, b string) string {
+	aLabels := nameLabels(a)
+	bLabels := nameLabels(b)
+
+	i := 0
+	for i < len(aLabels) && i < len(bLabels) && aLabels[len(aLabels)-1-i] == bLabels[len(bLabels)-1-i] {
+		i++
+	}
+	return strings.Join(aLabels[len(aLabels)-i:], ".")
+}
+
+// nameLabels splits a name into its lowercase labels.
+func nameLabels(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// labelBytes returns the bytes a label stands for, or the label itself if
+// it holds a malformed escape.
+func labelBytes(label string) string {
+	data, err := unescapeLabel(label)
+	if err != nil {
+		return label
+	}
+	return string(data)
+}
@@ -0,0 +1,74 @@
+package dns
+
+import "testing"
+
+func TestLabelCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    int
+		signature int
+	}{
+		{"", 0, 0},
+		{"com", 1, 1},
+		{"www.example.com.", 3, 3},
+		{"*.example.com", 3, 2},
+		{"*", 1, 0},
+		{"a.*.example.com", 4, 4},
+	}
+
+	for _, test := range tests {
+		if got := LabelCount(test.name); got != test.labels {
+			t.Errorf("LabelCount(%q) = %d, want %d", test.name, got, test.labels)
+		}
+		if got := SignatureLabelCount(test.name); got != test.signature {
+			t.Errorf("SignatureLabelCount(%q) = %d, want %d", test.name, got, test.signature)
+		}
+	}
+}
+
+func TestIsSubdomain(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		want bool
+	}{
+		{"www.example.com", "example.com", true},
+		{"Example.COM.", "example.com", true},
+		{"evilexample.com", "example.com", false},
+		{"example.com", "www.example.com", false},
+		{"anything", "", true},
+	}
+
+	for _, test := range tests {
+		if got := IsSubdomain(test.name, test.zone); got != test.want {
+			t.Errorf("IsSubdomain(%q, %q) = %v, want %v", test.name, test.zone, got, test.want)
+		}
+	}
+}
+
+func TestCompareNames(t *testing.T) {
+	// The canonical order of RFC 4034 section 6.1.
+	ordered := []string{
+		"example",
+		"a.example",
+		"yljkjljk.a.example",
+		"z.a.example",
+		"zabc.a.example",
+		"z.example",
+		"*.z.example",
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := CompareNames(ordered[i], ordered[j]); got != want {
+				t.Errorf("CompareNames(%q, %q) = %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+}
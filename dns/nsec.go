@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"strings"
+)
+
+// NSEC3 hash algorithm and flags (RFC 5155 section 11).
+const (
+	NSEC3HashSHA1   = 1
+	NSEC3FlagOptOut = 0x01
+)
+
+// nsec3Encoding is the alphabet the hashes in NSEC3 owner names are written
+// in (RFC 4648 section 7).
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// HasType reports whether the type bit map of an NSEC or NSEC3 record lists
+// the type.
+func HasType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// NSECCovers reports whether name falls strictly between the owner of the
+// record and its next name, which proves that it doesn't exist.
+func NSECCovers(nsec NSECRecord, name string) bool {
+	return covers(CompareNames(nsec.Domain, name), CompareNames(name, nsec.NextDomain), CompareNames(nsec.Domain, nsec.NextDomain))
+}
+
+// NSEC3Hash computes the hashed form of a name with the parameters of an
+// NSEC3 chain (RFC 5155 section 5).
+func NSEC3Hash(name string, algorithm uint8, iterations uint16, salt []byte) ([]byte, error) {
+	if algorithm != NSEC3HashSHA1 {
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	buffer := NewBytePacketBufferWithSize(256)
+	err := buffer.WriteQnameUncompressed(strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum(append(buffer.Buf[:buffer.Pos], salt...))
+	for i := 0; i < int(iterations); i++ {
+		hash = sha1.Sum(append(hash[:], salt...))
+	}
+	return hash[:], nil
+}
+
+// NSEC3OwnerHash decodes the hash held in the first label of the owner name
+// of the record.
+func NSEC3OwnerHash(nsec3 NSEC3Record) ([]byte, error) {
+	label, _, _ := strings.Cut(nsec3.Domain, ".")
+	return nsec3Encoding.DecodeString(strings.ToUpper(label))
+}
+
+// NSEC3Matches reports whether the record is the one owned by the hash.
+func NSEC3Matches(nsec3 NSEC3Record, hash []byte) bool {
+	owner, err := NSEC3OwnerHash(nsec3)
+	return err == nil && bytes.Equal(owner, hash)
+}
+
+// NSEC3Covers reports whether the hash falls strictly between the owner hash
+// of the record and its next hash, which proves that no name with that hash
+// exists.
+func NSEC3Covers(nsec3 NSEC3Record, hash []byte) bool {
+	owner, err := NSEC3OwnerHash(nsec3)
+	if err != nil {
+		return false
+	}
+	return covers(bytes.Compare(owner, hash), bytes.Compare(hash, nsec3.NextHashed), bytes.Compare(owner, nsec3.NextHashed))
+}
+
+// covers tells from the ordering of the owner of a record, a name and the
+// next name of the record whether the name falls between the two. The last
+// record of a chain points back to the first one, so its range wraps around.
+func covers(ownerToName int, nameToNext int, ownerToNext int) bool {
+	if ownerToNext < 0 {
+		return ownerToName < 0 && nameToNext < 0
+	}
+	return ownerToName < 0 || nameToNext < 0
+}
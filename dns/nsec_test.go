@@ -0,0 +1,63 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNSEC3Hash(t *testing.T) {
+	// The hashes of RFC 5155 appendix A, with salt aabbccdd and 12 extra
+	// iterations.
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"example", "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"},
+		{"a.example", "35mthgpgcu1qg68fab165klnsnk3dpvl"},
+		{"ai.example", "gjeqe526plbf1g8mklp59enfd789njgi"},
+		{"ns1.example", "2t7b4g4vsa5smi47k61mv5bv1a22bojr"},
+		{"ns2.example", "q04jkcevqvmu85r014c7dkba38o0ji5r"},
+		{"w.example", "k8udemvp1j2f7eg6jebps17vp3n8i58h"},
+		{"*.w.example", "r53bq7cc2uvmubfu5ocmm6pers9tk9en"},
+		{"x.w.example", "b4um86eghhds6nea196smvmlo4ors995"},
+		{"y.w.example", "ji6neoaepv8b5o6k4ev33abha8ht9fgc"},
+		{"x.y.w.example", "2vptu5timamqttgl4luu9kg21e0aor3s"},
+		{"xx.example", "t644ebqk9bibcna874givr6joj62mlhv"},
+		{"XX.Example.", "t644ebqk9bibcna874givr6joj62mlhv"},
+	}
+
+	for _, test := range tests {
+		hash, err := NSEC3Hash(test.name, NSEC3HashSHA1, 12, []byte{0xaa, 0xbb, 0xcc, 0xdd})
+		if err != nil {
+			t.Fatalf("NSEC3Hash(%q): %v", test.name, err)
+		}
+		if got := strings.ToLower(nsec3Encoding.EncodeToString(hash)); got != test.hash {
+			t.Errorf("NSEC3Hash(%q) = %s, want %s", test.name, got, test.hash)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner string
+		next  string
+		want  bool
+	}{
+		{"b.example", "a.example", "c.example", true},
+		{"a.example", "a.example", "c.example", false},
+		{"c.example", "a.example", "c.example", false},
+		{"d.example", "a.example", "c.example", false},
+		{"b.a.example", "a.example", "c.example", true},
+		{"z.example", "x.example", "example", true},
+		{"b.example", "x.example", "example", false},
+		{"a.example", "example", "b.example", true},
+	}
+
+	for _, test := range tests {
+		nsec := NSECRecord{Domain: test.owner, NextDomain: test.next}
+		if got := NSECCovers(nsec, test.name); got != test.want {
+			t.Errorf("NSECCovers(%s -> %s, %s) = %v, want %v", test.owner, test.next, test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package dns
+
+import "errors"
+
+// EDNS0Version is the only EDNS version we implement.
+const EDNS0Version = 0
+
+// BADVERS is the extended result code returned for an unsupported EDNS
+// version. Its upper eight bits go in OPTRecord.ExtendedRcode, which
+// DnsPacket fills from the result code of the header when writing.
+const BADVERS ResultCode = 16
+
+// EDNSOption is a single option carried in the RDATA of an OPT record.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPTRecord is the EDNS(0) pseudo-record defined in RFC 6891. It is always
+// owned by the root domain and reuses the class and TTL fields of the record
+// header for the payload size and extended flags.
+type OPTRecord struct {
+	UDPPayloadSize uint16
+	ExtendedRcode  uint8
+	Version        uint8
+	DnssecOK       bool
+	Options        []EDNSOption
+}
+
+// NewOPTRecord creates an OPTRecord advertising the given UDP payload size.
+func NewOPTRecord(udpPayloadSize uint16) OPTRecord {
+	return OPTRecord{
+		UDPPayloadSize: udpPayloadSize,
+		Version:        EDNS0Version,
+	}
+}
+
+func readOPTRecord(buffer *BytePacketBuffer, class uint16, ttl uint32, dataLen uint16) (OPTRecord, error) {
+	record := OPTRecord{
+		UDPPayloadSize: class,
+		ExtendedRcode:  uint8(ttl >> 24),
+		Version:        uint8(ttl >> 16),
+		DnssecOK:       ttl&(1<<15) > 0,
+	}
+
+	end := buffer.Pos + int(dataLen)
+	for buffer.Pos < end {
+		code, err := buffer.ReadU16()
+		if err != nil {
+			return record, err
+		}
+
+		length, err := buffer.ReadU16()
+		if err != nil {
+			return record, err
+		}
+
+		if buffer.Pos+int(length) > end {
+			return record, errors.New("EDNS option exceeds record data")
+		}
+
+		data, err := buffer.GetRange(buffer.Pos, int(length))
+		if err != nil {
+			return record, err
+		}
+
+		err = buffer.Step(int(length))
+		if err != nil {
+			return record, err
+		}
+
+		record.Options = append(record.Options, EDNSOption{
+			Code: code,
+			Data: append([]byte(nil), data...),
+		})
+	}
+
+	return record, nil
+}
+
+func writeOPTRecord(record OPTRecord, buffer *BytePacketBuffer) error {
+	err := buffer.WriteQname("")
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU16(OPT.ToNum())
+	if err != nil {
+		return err
+	}
+
+	err = buffer.WriteU16(record.UDPPayloadSize)
+	if err != nil {
+		return err
+	}
+
+	ttl := uint32(record.ExtendedRcode)<<24 |
+		uint32(record.Version)<<16 |
+		uint32(boolToUint(record.DnssecOK))<<15
+
+	err = buffer.WriteU32(ttl)
+	if err != nil {
+		return err
+	}
+
+	return writeRdata(buffer, func() error {
+		for _, option := range record.Options {
+			err := buffer.WriteU16(option.Code)
+			if err != nil {
+				return err
+			}
+
+			err = buffer.WriteU16(uint16(len(option.Data)))
+			if err != nil {
+				return err
+			}
+
+			err = buffer.WriteBytes(option.Data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -1,33 +1,70 @@
 package dns
 
-type QueryType uint16
+import (
+	"strconv"
+	"strings"
+)
+
+type QueryType uint32
+
+// ClassIN is the Internet class, the only one we serve.
+const ClassIN uint16 = 1
 
 const (
 	UNKNOWN QueryType = iota
 	A
 	NS
 	CNAME
+	SOA
 	MX
 	AAAA
+	OPT
+	DS
+	RRSIG
+	NSEC
+	DNSKEY
+	NSEC3
+	NSEC3PARAM
+	IXFR
+	AXFR
 )
 
 var queryTypeMapping = map[uint16]QueryType{
 	1:  A,
 	2:  NS,
 	5:  CNAME,
+	6:  SOA,
 	15: MX,
 	28: AAAA,
+	41: OPT,
+	43: DS,
+	46: RRSIG,
+	47: NSEC,
+	48: DNSKEY,
+	50: NSEC3,
+	51: NSEC3PARAM,
+	// Transfer types only appear in questions.
+	251: IXFR,
+	252: AXFR,
 }
 
+// unknownQueryType marks the types without a constant of their own. Their
+// number is kept in the lower 16 bits, so that it survives the round trip
+// through QueryTypeFromNum and ToNum.
+const unknownQueryType QueryType = 1 << 16
+
 func QueryTypeFromNum(num uint16) QueryType {
 	qt, found := queryTypeMapping[num]
 	if found {
 		return qt
 	}
-	return UNKNOWN
+	return unknownQueryType | QueryType(num)
 }
 
 func (qt QueryType) ToNum() uint16 {
+	if qt&unknownQueryType != 0 {
+		return uint16(qt)
+	}
 	for num, queryType := range queryTypeMapping {
 		if qt == queryType {
 			return num
@@ -35,3 +72,39 @@ func (qt QueryType) ToNum() uint16 {
 	}
 	return 0
 }
+
+// queryTypeNames maps the mnemonics used in zone files to type numbers.
+var queryTypeNames = map[string]uint16{
+	"A":          1,
+	"NS":         2,
+	"CNAME":      5,
+	"SOA":        6,
+	"MX":         15,
+	"TXT":        16,
+	"AAAA":       28,
+	"DS":         43,
+	"RRSIG":      46,
+	"NSEC":       47,
+	"DNSKEY":     48,
+	"NSEC3":      50,
+	"NSEC3PARAM": 51,
+}
+
+// TypeFromName returns the number of a record type given its mnemonic, or
+// in the generic "TYPEnnn" form (RFC 3597).
+func TypeFromName(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	num, found := queryTypeNames[name]
+	if found {
+		return num, true
+	}
+
+	if !strings.HasPrefix(name, "TYPE") {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(name[len("TYPE"):], 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(value), true
+}
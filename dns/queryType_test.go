@@ -0,0 +1,34 @@
+package dns
+
+import "testing"
+
+func TestQueryTypeRoundTrip(t *testing.T) {
+	for _, num := range []uint16{1, 5, 6, 12, 16, 33, 252, 257, 65535} {
+		got := QueryTypeFromNum(num).ToNum()
+		if got != num {
+			t.Errorf("QueryTypeFromNum(%d).ToNum() = %d", num, got)
+		}
+	}
+}
+
+func TestTypeFromName(t *testing.T) {
+	tests := []struct {
+		name  string
+		want  uint16
+		found bool
+	}{
+		{"A", 1, true},
+		{"aaaa", 28, true},
+		{"TXT", 16, true},
+		{"TYPE65534", 65534, true},
+		{"TYPE65536", 0, false},
+		{"BOGUS", 0, false},
+	}
+
+	for _, test := range tests {
+		got, found := TypeFromName(test.name)
+		if got != test.want || found != test.found {
+			t.Errorf("TypeFromName(%q) = %d, %v, want %d, %v", test.name, got, found, test.want, test.found)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ReadTCPMessage reads a single length-prefixed DNS message from a TCP stream.
+// It returns io.EOF only when the stream ends before a new message starts.
+func ReadTCPMessage(r io.Reader) (*BytePacketBuffer, error) {
+	var prefix [2]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(prefix[:])
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if errors.Is(err, io.EOF) {
+		// The stream ended after the length prefix, in the middle of the
+		// message.
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBytePacketBufferFromBytes(data), nil
+}
+
+// WriteTCPMessage writes the contents of the buffer to a TCP stream,
+// preceded by the two byte length prefix.
+func WriteTCPMessage(w io.Writer, buffer *BytePacketBuffer) error {
+	if buffer.Pos > MaxPacketSize {
+		return errors.New("message exceeds maximum TCP message size")
+	}
+
+	data := make([]byte, 2+buffer.Pos)
+	binary.BigEndian.PutUint16(data, uint16(buffer.Pos))
+	copy(data[2:], buffer.Buf[:buffer.Pos])
+
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,94 @@
+package dns
+
+const (
+	// ClassNONE marks the prerequisites that a name or RRset doesn't exist
+	// and the updates deleting a single record (RFC 2136 section 2.4).
+	ClassNONE uint16 = 254
+	// ClassANY marks the prerequisites that a name or RRset exists and the
+	// updates deleting a whole name or RRset.
+	ClassANY uint16 = 255
+)
+
+// TypeANY stands for the records of every type at a name.
+const TypeANY uint16 = 255
+
+// UpdateRecord is a record of class NONE or ANY, found in the prerequisite
+// and update sections of UPDATE messages. Record holds its data, read as a
+// record of class IN, and is nil when there is none.
+type UpdateRecord struct {
+	Domain string
+	QType  uint16
+	Class  uint16
+	TTL    uint32
+	Record DnsRecord
+}
+
+func readUpdateRecord(buffer *BytePacketBuffer, domain string, qtypeNum uint16, class uint16, ttl uint32, dataLen uint16) (UpdateRecord, error) {
+	record := UpdateRecord{
+		Domain: domain,
+		QType:  qtypeNum,
+		Class:  class,
+		TTL:    ttl,
+	}
+	if dataLen == 0 {
+		return record, nil
+	}
+
+	data, err := readRecordData(buffer, domain, qtypeNum, class, ttl, dataLen)
+	if err != nil {
+		return record, err
+	}
+	record.Record = data
+	return record, nil
+}
+
+func writeUpdateRecord(record UpdateRecord, buffer *BytePacketBuffer) error {
+	if record.Record == nil {
+		err := buffer.WriteQname(record.Domain)
+		if err != nil {
+			return err
+		}
+
+		for _, field := range []uint16{record.QType, record.Class} {
+			err := buffer.WriteU16(field)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = buffer.WriteU32(record.TTL)
+		if err != nil {
+			return err
+		}
+
+		return buffer.WriteU16(0)
+	}
+
+	// The data is written along with the record holding it, whose class is
+	// then replaced. It follows the owner name, which may be compressed.
+	start := buffer.Pos
+	_, err := WriteDnsRecord(WithTTL(record.Record, record.TTL), buffer)
+	if err != nil {
+		return err
+	}
+	end := buffer.Pos
+
+	err = buffer.Seek(start)
+	if err != nil {
+		return err
+	}
+
+	var domain string
+	err = buffer.ReadQname(&domain)
+	if err != nil {
+		return err
+	}
+	classPos := buffer.Pos + 2
+
+	err = buffer.Seek(end)
+	if err != nil {
+		return err
+	}
+
+	return buffer.SetU16(classPos, record.Class)
+}
@@ -0,0 +1,737 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxIncludeDepth bounds nested $INCLUDE directives, so that a file
+// including itself is reported instead of looping forever.
+const maxIncludeDepth = 8
+
+// zoneEntry is a single logical line of a zone file, that is a directive or
+// a record, with parenthesized continuations joined.
+type zoneEntry struct {
+	Fields []string
+	// Line is where the entry starts, for error messages.
+	Line int
+	// BlankOwner is set when the line starts with a space, in which case the
+	// record belongs to the previous owner.
+	BlankOwner bool
+}
+
+// zoneParser keeps the state that carries over from one entry of a zone
+// file to the next.
+type zoneParser struct {
+	origin     string
+	defaultTTL uint32
+	hasTTL     bool
+	lastOwner  string
+	hasOwner   bool
+	lastTTL    uint32
+	hasLastTTL bool
+	records    []DnsRecord
+}
+
+// ReadZoneFile parses a zone file in the master file format (RFC 1035
+// section 5), with names relative to origin until a $ORIGIN directive says
+// otherwise. The records are returned in file order with lowercase names.
+func ReadZoneFile(path string, origin string) ([]DnsRecord, error) {
+	parser := &zoneParser{origin: normalizeName(origin)}
+	err := parser.parseFile(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return parser.records, nil
+}
+
+// parseFile reads the records of a single file into the parser.
+func (p *zoneParser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested $INCLUDE directives", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	entries, err := splitZoneEntries(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, entry := range entries {
+		err := p.parseEntry(path, entry, depth)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, entry.Line, err)
+		}
+	}
+	return nil
+}
+
+// parseEntry handles a directive or adds a record.
+func (p *zoneParser) parseEntry(path string, entry zoneEntry, depth int) error {
+	fields := entry.Fields
+
+	switch strings.ToUpper(fields[0]) {
+	case "$ORIGIN":
+		if len(fields) != 2 {
+			return errors.New("malformed $ORIGIN")
+		}
+		origin, err := p.name(fields[1])
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+		return nil
+
+	case "$TTL":
+		if len(fields) != 2 {
+			return errors.New("malformed $TTL")
+		}
+		ttl, err := ParseTTL(fields[1])
+		if err != nil {
+			return err
+		}
+		p.defaultTTL = ttl
+		p.hasTTL = true
+		return nil
+
+	case "$INCLUDE":
+		if len(fields) != 2 && len(fields) != 3 {
+			return errors.New("malformed $INCLUDE")
+		}
+		includePath := fields[1]
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+
+		// The included file starts from the current state, but its $ORIGIN
+		// and owner don't leak back into this file (RFC 1035 section 5.1).
+		included := *p
+		if len(fields) == 3 {
+			origin, err := p.name(fields[2])
+			if err != nil {
+				return err
+			}
+			included.origin = origin
+		}
+		err := included.parseFile(includePath, depth+1)
+		if err != nil {
+			return err
+		}
+		p.records = included.records
+		return nil
+	}
+
+	owner := p.lastOwner
+	if !entry.BlankOwner {
+		name, err := p.name(fields[0])
+		if err != nil {
+			return err
+		}
+		owner = name
+		fields = fields[1:]
+	} else if !p.hasOwner {
+		return errors.New("record without an owner")
+	}
+	p.lastOwner = owner
+	p.hasOwner = true
+
+	// The TTL and class may come in either order before the type.
+	var ttl uint32
+	hasTTL := false
+	for len(fields) > 0 {
+		if strings.EqualFold(fields[0], "IN") {
+			fields = fields[1:]
+			continue
+		}
+		if strings.EqualFold(fields[0], "CH") || strings.EqualFold(fields[0], "HS") {
+			return fmt.Errorf("unsupported class %s", fields[0])
+		}
+		if hasTTL || fields[0] == "" || fields[0][0] < '0' || fields[0][0] > '9' {
+			break
+		}
+		value, err := ParseTTL(fields[0])
+		if err != nil {
+			return err
+		}
+		ttl = value
+		hasTTL = true
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return errors.New("missing record type")
+	}
+
+	qtype, ok := TypeFromName(fields[0])
+	if !ok {
+		return fmt.Errorf("unknown record type %s", fields[0])
+	}
+
+	switch {
+	case hasTTL:
+		p.lastTTL = ttl
+		p.hasLastTTL = true
+	case p.hasTTL:
+		ttl = p.defaultTTL
+	case p.hasLastTTL:
+		ttl = p.lastTTL
+	case qtype != 6:
+		return errors.New("no TTL given and no $TTL directive")
+	}
+
+	record, err := p.parseRecord(owner, ttl, qtype, fields[1:])
+	if err != nil {
+		return fmt.Errorf("malformed %s record: %w", strings.ToUpper(fields[0]), err)
+	}
+
+	// Without any TTL, an SOA record uses its minimum field (RFC 1035
+	// section 5.1), and so do the records that follow it.
+	if soa, ok := record.(SOARecord); ok && !hasTTL && !p.hasTTL && !p.hasLastTTL {
+		soa.TTL = soa.Minimum
+		record = soa
+		p.lastTTL = soa.Minimum
+		p.hasLastTTL = true
+	}
+
+	p.records = append(p.records, record)
+	return nil
+}
+
+// parseRecord builds a record from the fields following its type.
+func (p *zoneParser) parseRecord(owner string, ttl uint32, qtype uint16, rdata []string) (DnsRecord, error) {
+	if len(rdata) > 0 && rdata[0] == `\#` {
+		return parseGenericRdata(owner, ttl, qtype, rdata[1:])
+	}
+
+	switch QueryTypeFromNum(qtype) {
+	case A:
+		if len(rdata) != 1 {
+			return nil, errors.New("expected an address")
+		}
+		addr := net.ParseIP(rdata[0]).To4()
+		if addr == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %s", rdata[0])
+		}
+		return ARecord{Domain: owner, Addr: addr, TTL: ttl}, nil
+
+	case AAAA:
+		if len(rdata) != 1 {
+			return nil, errors.New("expected an address")
+		}
+		addr := net.ParseIP(rdata[0])
+		if addr == nil || addr.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %s", rdata[0])
+		}
+		return AAAARecord{Domain: owner, Addr: addr, TTL: ttl}, nil
+
+	case NS:
+		if len(rdata) != 1 {
+			return nil, errors.New("expected a host name")
+		}
+		host, err := p.name(rdata[0])
+		if err != nil {
+			return nil, err
+		}
+		return NSRecord{Domain: owner, Host: host, TTL: ttl}, nil
+
+	case CNAME:
+		if len(rdata) != 1 {
+			return nil, errors.New("expected a host name")
+		}
+		host, err := p.name(rdata[0])
+		if err != nil {
+			return nil, err
+		}
+		return CNAMERecord{Domain: owner, Host: host, TTL: ttl}, nil
+
+	case MX:
+		if len(rdata) != 2 {
+			return nil, errors.New("expected a preference and a host name")
+		}
+		priority, err := strconv.ParseUint(rdata[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		host, err := p.name(rdata[1])
+		if err != nil {
+			return nil, err
+		}
+		return MXRecord{Domain: owner, Priority: uint16(priority), Host: host, TTL: ttl}, nil
+
+	case SOA:
+		if len(rdata) != 7 {
+			return nil, errors.New("expected seven fields")
+		}
+		mname, err := p.name(rdata[0])
+		if err != nil {
+			return nil, err
+		}
+		rname, err := p.name(rdata[1])
+		if err != nil {
+			return nil, err
+		}
+		var numbers [5]uint32
+		for i, field := range rdata[2:] {
+			value, err := ParseTTL(field)
+			if err != nil {
+				return nil, err
+			}
+			numbers[i] = value
+		}
+		return SOARecord{
+			Domain:  owner,
+			MName:   mname,
+			RName:   rname,
+			Serial:  numbers[0],
+			Refresh: numbers[1],
+			Retry:   numbers[2],
+			Expire:  numbers[3],
+			Minimum: numbers[4],
+			TTL:     ttl,
+		}, nil
+
+	case DS:
+		if len(rdata) < 4 {
+			return nil, errors.New("expected a key tag, algorithm, digest type and digest")
+		}
+		numbers, err := parseNumbers(rdata[:3], 16, 8, 8)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(strings.Join(rdata[3:], ""))
+		if err != nil {
+			return nil, err
+		}
+		return DSRecord{Domain: owner, KeyTag: uint16(numbers[0]), Algorithm: uint8(numbers[1]), DigestType: uint8(numbers[2]), Digest: digest, TTL: ttl}, nil
+
+	case DNSKEY:
+		if len(rdata) < 4 {
+			return nil, errors.New("expected flags, protocol, algorithm and public key")
+		}
+		numbers, err := parseNumbers(rdata[:3], 16, 8, 8)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := base64.StdEncoding.DecodeString(strings.Join(rdata[3:], ""))
+		if err != nil {
+			return nil, err
+		}
+		return DNSKEYRecord{Domain: owner, Flags: uint16(numbers[0]), Protocol: uint8(numbers[1]), Algorithm: uint8(numbers[2]), PublicKey: publicKey, TTL: ttl}, nil
+
+	case RRSIG:
+		if len(rdata) < 9 {
+			return nil, errors.New("expected nine fields")
+		}
+		typeCovered, ok := TypeFromName(rdata[0])
+		if !ok {
+			return nil, fmt.Errorf("unknown type covered %s", rdata[0])
+		}
+		numbers, err := parseNumbers(rdata[1:4], 8, 8, 32)
+		if err != nil {
+			return nil, err
+		}
+		expiration, err := parseSignatureTime(rdata[4])
+		if err != nil {
+			return nil, err
+		}
+		inception, err := parseSignatureTime(rdata[5])
+		if err != nil {
+			return nil, err
+		}
+		keyTag, err := strconv.ParseUint(rdata[6], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		signerName, err := p.name(rdata[7])
+		if err != nil {
+			return nil, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.Join(rdata[8:], ""))
+		if err != nil {
+			return nil, err
+		}
+		return RRSIGRecord{
+			Domain:      owner,
+			TypeCovered: typeCovered,
+			Algorithm:   uint8(numbers[0]),
+			Labels:      uint8(numbers[1]),
+			OriginalTTL: uint32(numbers[2]),
+			Expiration:  expiration,
+			Inception:   inception,
+			KeyTag:      uint16(keyTag),
+			SignerName:  signerName,
+			Signature:   signature,
+			TTL:         ttl,
+		}, nil
+
+	case NSEC:
+		if len(rdata) < 1 {
+			return nil, errors.New("expected a next domain name")
+		}
+		nextDomain, err := p.name(rdata[0])
+		if err != nil {
+			return nil, err
+		}
+		types, err := parseTypeList(rdata[1:])
+		if err != nil {
+			return nil, err
+		}
+		return NSECRecord{Domain: owner, NextDomain: nextDomain, Types: types, TTL: ttl}, nil
+
+	case NSEC3:
+		if len(rdata) < 5 {
+			return nil, errors.New("expected hash algorithm, flags, iterations, salt and next hashed owner")
+		}
+		numbers, err := parseNumbers(rdata[:3], 8, 8, 16)
+		if err != nil {
+			return nil, err
+		}
+		salt, err := parseSalt(rdata[3])
+		if err != nil {
+			return nil, err
+		}
+		nextHashed, err := nsec3Encoding.DecodeString(strings.ToUpper(rdata[4]))
+		if err != nil {
+			return nil, err
+		}
+		types, err := parseTypeList(rdata[5:])
+		if err != nil {
+			return nil, err
+		}
+		return NSEC3Record{
+			Domain:        owner,
+			HashAlgorithm: uint8(numbers[0]),
+			Flags:         uint8(numbers[1]),
+			Iterations:    uint16(numbers[2]),
+			Salt:          salt,
+			NextHashed:    nextHashed,
+			Types:         types,
+			TTL:           ttl,
+		}, nil
+
+	case NSEC3PARAM:
+		if len(rdata) != 4 {
+			return nil, errors.New("expected hash algorithm, flags, iterations and salt")
+		}
+		numbers, err := parseNumbers(rdata[:3], 8, 8, 16)
+		if err != nil {
+			return nil, err
+		}
+		salt, err := parseSalt(rdata[3])
+		if err != nil {
+			return nil, err
+		}
+		return NSEC3PARAMRecord{Domain: owner, HashAlgorithm: uint8(numbers[0]), Flags: uint8(numbers[1]), Iterations: uint16(numbers[2]), Salt: salt, TTL: ttl}, nil
+
+	case OPT:
+		return nil, errors.New("OPT records can't appear in zone files")
+	}
+
+	// TXT records are kept as unknown records holding their character
+	// strings.
+	if qtype == 16 {
+		var data []byte
+		for _, text := range rdata {
+			if len(text) > 255 {
+				return nil, errors.New("character string longer than 255 bytes")
+			}
+			data = append(data, byte(len(text)))
+			data = append(data, text...)
+		}
+		return UnknownRecord{Domain: owner, QType: qtype, Data: data, TTL: ttl}, nil
+	}
+
+	return nil, errors.New(`unsupported type, use the \# syntax`)
+}
+
+// name turns a domain name of a zone file into an absolute name without
+// the trailing dot, appending the origin to relative names. Escapes are
+// decoded (RFC 1035 section 5.1), so an escaped dot stays in its label.
+func (p *zoneParser) name(name string) (string, error) {
+	if name == "@" {
+		return p.origin, nil
+	}
+	if name == "." {
+		return "", nil
+	}
+
+	labels, absolute := splitNameLabels(name)
+	for i, label := range labels {
+		if label == "" {
+			return "", fmt.Errorf("empty label in %s", name)
+		}
+		data, err := unescapeLabel(label)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		labels[i] = strings.ToLower(escapeLabel(data))
+	}
+
+	result := strings.Join(labels, ".")
+	if !absolute && p.origin != "" {
+		result += "." + p.origin
+	}
+	return result, nil
+}
+
+// splitNameLabels splits a name at the dots that aren't escaped, and
+// reports whether it ended with one, making it absolute.
+func splitNameLabels(name string) ([]string, bool) {
+	var labels []string
+	start := 0
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			labels = append(labels, name[start:i])
+			start = i + 1
+		}
+	}
+	if start == len(name) && len(labels) > 0 {
+		return labels, true
+	}
+	return append(labels, name[start:]), false
+}
+
+// normalizeName lowercases an absolute name and drops its trailing dot.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// splitZoneEntries splits the text of a zone file into entries, dropping
+// comments and joining the lines of parenthesized records. Quoted strings
+// are returned as a single field without the quotes and with their escapes
+// decoded. Other fields keep their escapes, for names to decode by label.
+func splitZoneEntries(data string) ([]zoneEntry, error) {
+	var entries []zoneEntry
+	var entry zoneEntry
+	var field strings.Builder
+
+	line := 1
+	depth := 0
+	inField := false
+	inQuotes := false
+	startOfLine := true
+
+	endField := func() {
+		if inField {
+			entry.Fields = append(entry.Fields, field.String())
+			field.Reset()
+			inField = false
+		}
+	}
+	endEntry := func() {
+		endField()
+		if len(entry.Fields) > 0 {
+			entries = append(entries, entry)
+		}
+		entry = zoneEntry{}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+
+		if inQuotes {
+			switch c {
+			case '"':
+				inQuotes = false
+			case '\\':
+				// A backslash quotes the next character, or gives a byte
+				// as three decimal digits (RFC 1035 section 5.1).
+				end := i + 2
+				if i+1 < len(data) && data[i+1] >= '0' && data[i+1] <= '9' {
+					end = i + 4
+				}
+				if end > len(data) {
+					return nil, fmt.Errorf("%d: unterminated escape", line)
+				}
+				decoded, err := unescapeLabel(data[i:end])
+				if err != nil {
+					return nil, fmt.Errorf("%d: %w", line, err)
+				}
+				field.Write(decoded)
+				i = end - 1
+			case '\n':
+				return nil, fmt.Errorf("%d: unterminated quoted string", line)
+			default:
+				field.WriteByte(c)
+			}
+			continue
+		}
+
+		if startOfLine {
+			entry.Line = line
+			entry.BlankOwner = c == ' ' || c == '\t'
+			startOfLine = false
+		}
+
+		switch c {
+		case '\n':
+			line++
+			if depth == 0 {
+				endEntry()
+				startOfLine = true
+			} else {
+				endField()
+			}
+		case ' ', '\t', '\r':
+			endField()
+		case ';':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case '(':
+			endField()
+			depth++
+		case ')':
+			endField()
+			if depth == 0 {
+				return nil, fmt.Errorf("%d: unbalanced parenthesis", line)
+			}
+			depth--
+		case '"':
+			inQuotes = true
+			inField = true
+		case '\\':
+			field.WriteByte(c)
+			if i+1 < len(data) {
+				i++
+				field.WriteByte(data[i])
+			}
+			inField = true
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("%d: unterminated quoted string", line)
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("%d: unbalanced parenthesis", line)
+	}
+	endEntry()
+	return entries, nil
+}
+
+// ParseTTL parses a TTL given in seconds, or with the unit suffixes BIND
+// accepts, such as "1h30m" or "2w".
+func ParseTTL(value string) (uint32, error) {
+	total, err := strconv.ParseUint(value, 10, 32)
+	if err == nil {
+		return uint32(total), nil
+	}
+
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	total = 0
+	number := ""
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= '0' && c <= '9' {
+			number += string(c)
+			continue
+		}
+
+		unit, found := units[c|0x20]
+		if !found || number == "" {
+			return 0, fmt.Errorf("invalid TTL %s", value)
+		}
+		n, err := strconv.ParseUint(number, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid TTL %s", value)
+		}
+		total += n * unit
+		number = ""
+	}
+	if number != "" || total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("invalid TTL %s", value)
+	}
+	return uint32(total), nil
+}
+
+// parseNumbers parses decimal fields, each of them with its own size in
+// bits.
+func parseNumbers(fields []string, bits ...int) ([]uint64, error) {
+	numbers := make([]uint64, len(fields))
+	for i, field := range fields {
+		value, err := strconv.ParseUint(field, 10, bits[i])
+		if err != nil {
+			return nil, err
+		}
+		numbers[i] = value
+	}
+	return numbers, nil
+}
+
+// parseSignatureTime parses the expiration and inception fields of an
+// RRSIG record, given either as YYYYMMDDHHmmSS or as seconds since the
+// epoch (RFC 4034 section 3.2).
+func parseSignatureTime(value string) (uint32, error) {
+	if len(value) == 14 {
+		t, err := time.Parse("20060102150405", value)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(t.Unix()), nil
+	}
+
+	seconds, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(seconds), nil
+}
+
+// parseSalt parses the salt of NSEC3 records, where "-" is the empty salt.
+func parseSalt(value string) ([]byte, error) {
+	if value == "-" {
+		return nil, nil
+	}
+	return hex.DecodeString(value)
+}
+
+// parseTypeList parses the type mnemonics of an NSEC or NSEC3 type bitmap.
+func parseTypeList(fields []string) ([]uint16, error) {
+	var types []uint16
+	for _, field := range fields {
+		qtype, ok := TypeFromName(field)
+		if !ok {
+			return nil, fmt.Errorf("unknown type %s", field)
+		}
+		types = append(types, qtype)
+	}
+	return types, nil
+}
+
+// parseGenericRdata parses record data in the "\# length hex" form of RFC
+// 3597 into an unknown record.
+func parseGenericRdata(owner string, ttl uint32, qtype uint16, fields []string) (DnsRecord, error) {
+	if len(fields) < 1 {
+		return nil, errors.New("missing data length")
+	}
+	length, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(length) {
+		return nil, fmt.Errorf("expected %d bytes of data, got %d", length, len(data))
+	}
+	return UnknownRecord{Domain: owner, QType: qtype, Data: data, TTL: ttl}, nil
+}
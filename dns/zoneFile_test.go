@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readTestZone(t *testing.T, content string) ([]DnsRecord, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zone")
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ReadZoneFile(path, "example.com")
+}
+
+func TestZoneFileNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		owner  string
+		want   string
+		labels int
+	}{
+		{"relative", "www", "www.example.com", 3},
+		{"absolute", "www.example.org.", "www.example.org", 3},
+		{"apex", "@", "example.com", 2},
+		{"escaped dot", `a\.b`, `a\046b.example.com`, 3},
+		{"escaped dot in an absolute name", `a\.b.example.org.`, `a\046b.example.org`, 3},
+		{"decimal escape", `\065\.`, `a\046.example.com`, 3},
+		{"escaped trailing dot keeps the name relative", `a\.`, `a\046.example.com`, 3},
+		{"escaped letter", `\W\w\w`, "www.example.com", 3},
+		{"escaped backslash", `a\\b`, `a\092b.example.com`, 3},
+		{"escaped space", `a\ b`, "a b.example.com", 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := readTestZone(t, test.owner+" 300 IN A 192.0.2.1\n")
+			if err != nil {
+				t.Fatalf("ReadZoneFile: %v", err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("read %d records", len(records))
+			}
+			if domain := RecordDomain(records[0]); domain != test.want {
+				t.Errorf("owner = %q, want %q", domain, test.want)
+			}
+			if labels := LabelCount(RecordDomain(records[0])); labels != test.labels {
+				t.Errorf("%d labels, want %d", labels, test.labels)
+			}
+		})
+	}
+}
+
+func TestZoneFileBadEscapes(t *testing.T) {
+	for _, owner := range []string{`a\256`, `a\12`, `a\1b`, `a..b`} {
+		_, err := readTestZone(t, owner+" 300 IN A 192.0.2.1\n")
+		if err == nil {
+			t.Errorf("%s: no error", owner)
+		}
+	}
+}
+
+func TestZoneFileQuotedEscapes(t *testing.T) {
+	records, err := readTestZone(t, `txt 300 IN TXT "say \"hi\"\059 \065\066"`+"\n")
+	if err != nil {
+		t.Fatalf("ReadZoneFile: %v", err)
+	}
+	want := "\x0csay \"hi\"; AB"
+	record, ok := records[0].(UnknownRecord)
+	if !ok || string(record.Data) != want {
+		t.Errorf("TXT = %+v, want data %q", records[0], want)
+	}
+}
+
+func TestEscapedNameOnTheWire(t *testing.T) {
+	records, err := readTestZone(t, `a\.b 300 IN CNAME c\\d`+"\n")
+	if err != nil {
+		t.Fatalf("ReadZoneFile: %v", err)
+	}
+
+	buffer := NewBytePacketBufferWithSize(MaxPacketSize)
+	_, err = WriteDnsRecord(records[0], buffer)
+	if err != nil {
+		t.Fatalf("WriteDnsRecord: %v", err)
+	}
+	wantOwner := "\x03a.b\x07example\x03com\x00"
+	if owner := string(buffer.Buf[:len(wantOwner)]); owner != wantOwner {
+		t.Errorf("owner on the wire = %q, want %q", owner, wantOwner)
+	}
+
+	read, err := ReadDnsRecord(NewBytePacketBufferFromBytes(buffer.Buf[:buffer.Pos]))
+	if err != nil {
+		t.Fatalf("ReadDnsRecord: %v", err)
+	}
+	cname, ok := read.(CNAMERecord)
+	if !ok || cname.Domain != `a\046b.example.com` || cname.Host != `c\092d.example.com` {
+		t.Errorf("read %+v", read)
+	}
+	if length := nameWireLength(cname.Domain); length != len(wantOwner) {
+		t.Errorf("nameWireLength = %d, want %d", length, len(wantOwner))
+	}
+}
+
+// recordLines sums up records as "<owner> <type> <TTL>" for comparison.
+func recordLines(records []DnsRecord) []string {
+	var lines []string
+	for _, record := range records {
+		lines = append(lines, fmt.Sprintf("%s %d %d", RecordDomain(record), RecordType(record), RecordTTL(record)))
+	}
+	return lines
+}
+
+func TestZoneFileEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"TTL before the class", "www 300 IN A 192.0.2.1\n", []string{"www.example.com 1 300"}},
+		{"TTL after the class", "www IN 300 A 192.0.2.1\n", []string{"www.example.com 1 300"}},
+		{"TTL without a class", "www 300 A 192.0.2.1\n", []string{"www.example.com 1 300"}},
+		{"TTL with units", "www 1h30m A 192.0.2.1\n", []string{"www.example.com 1 5400"}},
+		{"TTL of the previous record", "www 300 A 192.0.2.1\nmail A 192.0.2.2\n", []string{"www.example.com 1 300", "mail.example.com 1 300"}},
+		{"TTL of the $TTL directive", "$TTL 600\nwww 300 A 192.0.2.1\nmail A 192.0.2.2\n", []string{"www.example.com 1 300", "mail.example.com 1 600"}},
+		{"no TTL at all", "www A 192.0.2.1\n", nil},
+		{"owner of the previous record", "www 300 A 192.0.2.1\n     300 AAAA 2001:db8::1\n", []string{"www.example.com 1 300", "www.example.com 28 300"}},
+		{"$ORIGIN for the names that follow", "www 300 A 192.0.2.1\n$ORIGIN example.org.\nwww 300 A 192.0.2.2\n", []string{"www.example.com 1 300", "www.example.org 1 300"}},
+		{"relative $ORIGIN", "$ORIGIN sub\nwww 300 A 192.0.2.1\n", []string{"www.sub.example.com 1 300"}},
+		{"comments", "; a comment\nwww 300 A 192.0.2.1 ; another one\n", []string{"www.example.com 1 300"}},
+		{"parenthesized SOA", `@ 3600 IN SOA ns1 hostmaster (
+	2024010101 ; serial
+	7200       ; refresh
+	3600       ; retry
+	1209600    ; expire
+	300 )      ; minimum
+`, []string{"example.com 6 3600"}},
+		{"SOA without a TTL", "@ IN SOA ns1 hostmaster 1 7200 3600 1209600 300\nwww A 192.0.2.1\n", []string{"example.com 6 300", "www.example.com 1 300"}},
+		{"unbalanced parenthesis", "@ 3600 SOA ns1 hostmaster ( 1 2 3 4 5\n", nil},
+		{"unsupported class", "www 300 CH A 192.0.2.1\n", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := readTestZone(t, test.content)
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("no error, read %q", recordLines(records))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadZoneFile: %v", err)
+			}
+
+			lines := recordLines(records)
+			if strings.Join(lines, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("records = %q, want %q", lines, test.want)
+			}
+		})
+	}
+}
+
+func TestZoneFileSOAFields(t *testing.T) {
+	records, err := readTestZone(t, "@ 3600 IN SOA ns1 hostmaster.example.com. (\n 2024010101 2h 1h 2w 5m )\n")
+	if err != nil {
+		t.Fatalf("ReadZoneFile: %v", err)
+	}
+
+	want := SOARecord{Domain: "example.com", MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300, TTL: 3600}
+	if len(records) != 1 || records[0] != DnsRecord(want) {
+		t.Errorf("records = %+v, want %+v", records, want)
+	}
+}
+
+func TestZoneFileInclude(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main":  "$TTL 300\nwww A 192.0.2.1\n$INCLUDE hosts sub.example.com.\n$INCLUDE mail\nafter A 192.0.2.4\n",
+		"hosts": "host A 192.0.2.2\n$ORIGIN example.org.\nother A 192.0.2.3\n",
+		"mail":  "mail 60 A 192.0.2.5\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := ReadZoneFile(filepath.Join(dir, "main"), "example.com")
+	if err != nil {
+		t.Fatalf("ReadZoneFile: %v", err)
+	}
+
+	// The $ORIGIN of an included file doesn't leak back into the file that
+	// included it.
+	want := []string{
+		"www.example.com 1 300",
+		"host.sub.example.com 1 300",
+		"other.example.org 1 300",
+		"mail.example.com 1 60",
+		"after.example.com 1 300",
+	}
+	if lines := recordLines(records); strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records = %q, want %q", lines, want)
+	}
+}
+
+func TestZoneFileIncludeDepth(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "loop")
+	err := os.WriteFile(path, []byte("www 300 A 192.0.2.1\n$INCLUDE loop\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ReadZoneFile(path, "example.com")
+	if err == nil || !strings.Contains(err.Error(), "too many nested $INCLUDE") {
+		t.Errorf("err = %v, want the include depth to be exceeded", err)
+	}
+
+	// Nesting up to the limit is fine.
+	for i := 0; i < maxIncludeDepth; i++ {
+		content := fmt.Sprintf("$INCLUDE %d\n", i+1)
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprint(i)), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.WriteFile(filepath.Join(dir, fmt.Sprint(maxIncludeDepth)), []byte("www 300 A 192.0.2.1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := ReadZoneFile(filepath.Join(dir, "0"), "example.com")
+	if err != nil || len(records) != 1 {
+		t.Errorf("ReadZoneFile = %d records, %v", len(records), err)
+	}
+}
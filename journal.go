@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/guoard/godns/dns"
+)
+
+// maxJournalDiffs bounds how many changes of a zone are remembered for
+// incremental transfers. Secondaries lagging further behind get the whole
+// zone instead.
+const maxJournalDiffs = 100
+
+// zoneDiff is a change from one version of a zone to the next, the unit
+// incremental transfers are made of (RFC 1995 section 4).
+type zoneDiff struct {
+	From    dns.SOARecord
+	To      dns.SOARecord
+	Deleted []dns.DnsRecord
+	Added   []dns.DnsRecord
+}
+
+// serialLess reports whether serial a comes before serial b, following the
+// serial number arithmetic of RFC 1982.
+func serialLess(a uint32, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// diffZones returns the records that were deleted and added going from one
+// version of a zone to the next. SOA records are left out, as they are
+// carried by the diff itself.
+func diffZones(from *zone, to *zone) zoneDiff {
+	diff := zoneDiff{From: from.SOA(), To: to.SOA()}
+
+	fromKeys := recordKeys(from.Records())
+	toKeys := recordKeys(to.Records())
+
+	toSet := make(map[string]bool, len(toKeys))
+	for _, key := range toKeys {
+		toSet[key] = true
+	}
+	fromSet := make(map[string]bool, len(fromKeys))
+	for _, key := range fromKeys {
+		fromSet[key] = true
+	}
+
+	for i, record := range from.Records() {
+		if _, ok := record.(dns.SOARecord); !ok && !toSet[fromKeys[i]] {
+			diff.Deleted = append(diff.Deleted, record)
+		}
+	}
+	for i, record := range to.Records() {
+		if _, ok := record.(dns.SOARecord); !ok && !fromSet[toKeys[i]] {
+			diff.Added = append(diff.Added, record)
+		}
+	}
+	return diff
+}
+
+// recordKeys returns the wire form of each record, owner name and TTL
+// included, which tells records apart even though they hold slices.
+func recordKeys(records []dns.DnsRecord) []string {
+	keys := make([]string, len(records))
+	buffer := dns.NewBytePacketBufferWithSize(dns.MaxPacketSize)
+	for i, record := range records {
+		buffer.Pos = 0
+		_, err := dns.WriteDnsRecord(record, buffer)
+		if err != nil {
+			keys[i] = fmt.Sprintf("%T%+v", record, record)
+			continue
+		}
+		keys[i] = string(buffer.Buf[:buffer.Pos])
+	}
+	return keys
+}
+
+// journalSince returns the diffs leading from the version of the zone with
+// the given serial to the current one, or false when the journal doesn't
+// go back that far.
+func (z *zone) journalSince(serial uint32) ([]zoneDiff, bool) {
+	for i, diff := range z.journal {
+		if diff.From.Serial == serial {
+			return z.journal[i:], true
+		}
+	}
+	return nil, false
+}
+
+// withJournal records in the journal of z the changes made since the
+// previous version of the zone, keeping the older changes as well. It is
+// called before z is served, since zones are immutable afterwards.
+func (z *zone) withJournal(previous *zone) {
+	if !previous.Loaded() || !z.Loaded() || !serialLess(previous.SOA().Serial, z.SOA().Serial) {
+		return
+	}
+
+	journal := append([]zoneDiff(nil), previous.journal...)
+	journal = append(journal, diffZones(previous, z))
+	if len(journal) > maxJournalDiffs {
+		journal = journal[len(journal)-maxJournalDiffs:]
+	}
+	z.journal = journal
+}
+
+// applyDiff returns the records of a zone after the change, with the SOA
+// record of the new version first. Adding a record that is already there
+// changes nothing.
+func applyDiff(records []dns.DnsRecord, diff zoneDiff) []dns.DnsRecord {
+	deleted := make(map[string]bool, len(diff.Deleted))
+	for _, key := range recordKeys(diff.Deleted) {
+		deleted[key] = true
+	}
+
+	applied := []dns.DnsRecord{diff.To}
+	present := make(map[string]bool, len(records))
+	for i, key := range recordKeys(records) {
+		if _, ok := records[i].(dns.SOARecord); !ok && !deleted[key] {
+			applied = append(applied, records[i])
+			present[key] = true
+		}
+	}
+
+	for i, key := range recordKeys(diff.Added) {
+		if !present[key] {
+			applied = append(applied, diff.Added[i])
+			present[key] = true
+		}
+	}
+	return applied
+}
@@ -1,187 +1,124 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"net"
-	"os"
+	"strings"
+	"time"
+)
 
-	"github.com/guoard/godns/dns"
+var (
+	workers           = flag.Int("workers", 64, "number of queries resolved concurrently")
+	queryTimeout      = flag.Duration("query-timeout", 10*time.Second, "deadline for answering a single query")
+	rootHintsFile     = flag.String("root-hints", "", "root hints file in named.root format (defaults to the built-in list)")
+	listen            = flag.String("listen", "0.0.0.0:2053,[::]:2053", "comma separated IPv4 and IPv6 addresses to serve on, over both UDP and TCP")
+	ipv6Upstream      = flag.Bool("ipv6-upstream", true, "query nameservers over IPv6 as well as IPv4")
+	preferIPv6        = flag.Bool("prefer-ipv6", true, "try IPv6 nameservers first until their RTT says otherwise")
+	dnssecValidation  = flag.Bool("dnssec", false, "validate answers with DNSSEC, answering SERVFAIL when validation fails")
+	trustAnchors      = flag.String("trust-anchor", defaultTrustAnchors, "comma separated DS records of the root keys, as \"<key tag> <algorithm> <digest type> <digest>\"")
+	trustAnchorFile   = flag.String("trust-anchor-file", "", "file of root DS or DNSKEY records in presentation format, used instead of -trust-anchor")
+	trustAnchorState  = flag.String("trust-anchor-state", "", "file keeping track of root key rollovers (RFC 5011), created from the trust anchors when missing")
+	qnameMinimisation = flag.Bool("qname-minimisation", false, "only reveal to each nameserver the part of the query name it needs (RFC 9156)")
+	zoneFiles         = flag.String("zones", "", "comma separated zones to serve authoritatively, as \"<origin>=<zone file>\"")
+	secondaryZones    = flag.String("secondary-zones", "", "comma separated zones to serve as a secondary, as \"<origin>=<primary address>\"")
+	notify            = flag.String("notify", "", "comma separated addresses of the secondaries to send NOTIFY to when a zone we serve changes")
+	allowNotify       = flag.String("allow-notify", "", "comma separated addresses and networks allowed to send NOTIFY for our secondary zones, besides their primary")
+	allowTransfer     = flag.String("allow-transfer", "", "comma separated addresses and networks allowed to transfer the zones we serve with AXFR and IXFR")
+	allowUpdate       = flag.String("allow-update", "", "comma separated addresses and networks allowed to change the zones we serve with UPDATE messages")
+	aggressiveNSEC    = flag.Bool("aggressive-nsec", true, "answer negatively from cached NSEC and NSEC3 records when validating with DNSSEC (RFC 8198)")
 )
 
 func main() {
-	// Bind an UDP socket on port 2053
-	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:2053")
-	if err != nil {
-		fmt.Printf("Failed to resolve UDP address: %+v\n", err)
-		return
-	}
+	flag.Parse()
 
-	socket, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		fmt.Printf("Failed to bind UDP socket: %+v\n", err)
+	if *workers < 1 {
+		fmt.Printf("Invalid number of workers: %d\n", *workers)
 		return
 	}
-	defer socket.Close()
 
-	// For now, queries are handled sequentially, so an infinite loop for servicing
-	// requests is initiated.
-	for {
-		err := handleQuery(socket)
+	if *rootHintsFile != "" {
+		hints, err := loadRootHints(*rootHintsFile)
 		if err != nil {
-			fmt.Printf("An error occurred: %+v\n", err)
+			fmt.Printf("Failed to load root hints: %+v\n", err)
+			return
 		}
+		rootHints = hints
 	}
-}
 
-func lookup(qname string, qtype dns.QueryType, server net.UDPAddr) (dns.DnsPacket, error) {
-	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 43210})
+	targets, err := parseNotifyTargets(*notify)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error binding UDP socket:", err)
-		os.Exit(1)
-	}
-	defer socket.Close()
-
-	packet := dns.DnsPacket{
-		Header: dns.DnsHeader{
-			Id:               6666,
-			Questions:        1,
-			RecursionDesired: true,
-		},
-		Questions: []dns.DnsQuestion{
-			{
-				Name:  qname,
-				Qtype: qtype.ToNum(),
-			},
-		},
-	}
-
-	var reqBuffer dns.BytePacketBuffer
-	packet.Write(&reqBuffer)
-
-	_, err = socket.WriteTo(reqBuffer.Buf[:reqBuffer.Pos], &server)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error sending packet to server:", err)
-		os.Exit(1)
+		fmt.Printf("Invalid NOTIFY targets: %+v\n", err)
+		return
 	}
+	notifyTargets = targets
 
-	var resBuffer dns.BytePacketBuffer
-	_, _, err = socket.ReadFrom(resBuffer.Buf[:])
+	notifyACL, err = parseAddressList(*allowNotify)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error receiving response from server:", err)
-		os.Exit(1)
+		fmt.Printf("Invalid NOTIFY ACL: %+v\n", err)
+		return
 	}
 
-	return dns.DnsPacketFromBuffer(&resBuffer)
-}
-
-// Handle a single incoming packet
-func handleQuery(socket *net.UDPConn) error {
-	reqBuffer := dns.NewBytePacketBuffer()
-
-	_, src, err := socket.ReadFromUDP(reqBuffer.Buf[:])
+	err = loadZones(*zoneFiles)
 	if err != nil {
-		return err
+		fmt.Printf("Failed to load zones: %+v\n", err)
+		return
 	}
 
-	request, err := dns.DnsPacketFromBuffer(reqBuffer)
+	err = loadSecondaryZones(*secondaryZones)
 	if err != nil {
-		return err
-	}
-
-	packet := dns.NewDnsPacket()
-	packet.Header.Id = request.Header.Id
-	packet.Header.RecursionDesired = true
-	packet.Header.RecursionAvailable = true
-	packet.Header.Response = true
-
-	if len(request.Questions) > 0 {
-		question := request.Questions[0]
-		fmt.Printf("Received query: %+v\n", question)
-
-		result, err := recursiveLookup(question.Name, dns.QueryTypeFromNum(question.Qtype))
-		if err == nil {
-			packet.Questions = append(packet.Questions, question)
-			packet.Header.Rescode = result.Header.Rescode
-
-			for _, rec := range result.Answers {
-				fmt.Printf("Answer: %+v\n", rec)
-				packet.Answers = append(packet.Answers, rec)
-			}
-			for _, rec := range result.Authorities {
-				fmt.Printf("Authority: %+v\n", rec)
-				packet.Authorities = append(packet.Authorities, rec)
-			}
-			for _, rec := range result.Resources {
-				fmt.Printf("Resource: %+v\n", rec)
-				packet.Resources = append(packet.Resources, rec)
-			}
-		} else {
-			packet.Header.Rescode = dns.SERVFAIL
-		}
-	} else {
-		packet.Header.Rescode = dns.SERVFAIL
+		fmt.Printf("Invalid secondary zones: %+v\n", err)
+		return
 	}
 
-	resBuffer := dns.NewBytePacketBuffer()
-	err = packet.Write(resBuffer)
+	transferACL, err = parseAddressList(*allowTransfer)
 	if err != nil {
-		return err
+		fmt.Printf("Invalid transfer ACL: %+v\n", err)
+		return
 	}
 
-	data, err := resBuffer.GetRange(0, resBuffer.Pos)
+	updateACL, err = parseAddressList(*allowUpdate)
 	if err != nil {
-		return err
+		fmt.Printf("Invalid update ACL: %+v\n", err)
+		return
 	}
 
-	_, err = socket.WriteToUDP(data, src)
-	return err
-}
+	nsStats.preferIPv6 = *preferIPv6
 
-func recursiveLookup(qname string, qtype dns.QueryType) (*dns.DnsPacket, error) {
-	// For now we're always starting with *a.root-servers.net*.
-	ns := net.ParseIP("198.41.0.4").To4()
-	if ns == nil {
-		return nil, fmt.Errorf("failed to parse initial nameserver IP")
+	anchors, err := loadTrustAnchorStore(*trustAnchorFile, *trustAnchorState, *trustAnchors)
+	if err != nil {
+		fmt.Printf("Invalid trust anchors: %+v\n", err)
+		return
 	}
+	rootAnchors = anchors
 
-	for {
-		fmt.Printf("attempting lookup of %v %s with ns %s\n", qtype, qname, ns.String())
+	// Queries from every listener are answered by a fixed pool of workers.
+	jobs := make(chan queryJob, *workers)
 
-		server := net.UDPAddr{IP: ns, Port: 53}
-		response, err := lookup(qname, qtype, server)
+	for _, address := range strings.Split(*listen, ",") {
+		address = strings.TrimSpace(address)
+		err := listenOn(address, jobs)
 		if err != nil {
-			return nil, err
+			fmt.Printf("Failed to listen on %s: %+v\n", address, err)
+			return
 		}
+		fmt.Printf("Listening on %s\n", address)
+	}
 
-		if len(response.Answers) > 0 && response.Header.Rescode == dns.NOERROR {
-			return &response, nil
-		}
+	startWorkers(*workers, *queryTimeout, jobs)
 
-		if response.Header.Rescode == dns.NXDOMAIN {
-			return &response, nil
-		}
+	go maintainRootServers()
+	go reloadZonesOnHangup(*zoneFiles)
 
-		newNS := response.GetResolvedNs(qname)
-		if newNS != nil {
-			ns = newNS
-			continue
-		}
+	for _, sz := range secondaries {
+		go sz.maintain()
+	}
 
-		newNSName := response.GetUnresolvedNS(qname)
-		if newNSName != "" {
-			recursiveResponse, err := recursiveLookup(newNSName, dns.A)
-			if err != nil {
-				return &response, err
-			}
-
-			newNS := recursiveResponse.GetRandomA()
-			if newNS != nil {
-				ns = newNS
-			} else {
-				return &response, nil
-			}
-		} else {
-			return &response, nil
-		}
+	if *dnssecValidation {
+		go maintainTrustAnchors()
+	}
+
+	for range time.Tick(cachePruneInterval) {
+		cache.Prune()
+		nsStats.Prune()
 	}
 }
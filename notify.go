@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+const (
+	// notifyTimeout is how long we wait for a secondary to acknowledge a
+	// NOTIFY message before sending it again.
+	notifyTimeout = 2 * time.Second
+
+	// notifyAttempts bounds how many times a NOTIFY message is sent to a
+	// secondary that doesn't answer (RFC 1996 section 3.6).
+	notifyAttempts = 5
+)
+
+// notifyTargets are the secondaries told about every change of the zones
+// we serve.
+var notifyTargets []net.UDPAddr
+
+// notifyACL lists the addresses, besides the primary of each secondary
+// zone, allowed to send us NOTIFY messages.
+var notifyACL addressList
+
+// parseNotifyTargets parses a comma separated list of addresses, with the
+// port defaulting to 53.
+func parseNotifyTargets(spec string) ([]net.UDPAddr, error) {
+	var targets []net.UDPAddr
+	for _, address := range strings.Split(spec, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		if net.ParseIP(address) != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+		target, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, *target)
+	}
+	return targets, nil
+}
+
+// answerNotify handles a NOTIFY message for one of our secondary zones
+// (RFC 1996 section 3). NOTIFY messages coming from the primary of the
+// zone, or from an address allowed to send them, make the zone check its
+// primary right away.
+func answerNotify(ctx context.Context, request *dns.DnsPacket) dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.Id = request.Header.Id
+	packet.Header.Opcode = dns.OpcodeNotify
+	packet.Header.Response = true
+	packet.Questions = append(packet.Questions, request.Questions...)
+
+	if len(request.Questions) != 1 || request.Questions[0].Qtype != dns.SOA.ToNum() {
+		packet.Header.Rescode = dns.FORMERR
+		return packet
+	}
+
+	origin := strings.ToLower(strings.TrimSuffix(request.Questions[0].Name, "."))
+	client := clientAddr(ctx)
+	sz, found := secondaries[origin]
+	if !found {
+		fmt.Printf("Refused NOTIFY for %s from %s, not a secondary zone\n", origin, client)
+		packet.Header.Rescode = dns.REFUSED
+		return packet
+	}
+	if !client.Equal(sz.Primary.IP) && !notifyACL.Contains(client) {
+		fmt.Printf("Refused NOTIFY for %s from %s\n", origin, client)
+		packet.Header.Rescode = dns.REFUSED
+		return packet
+	}
+
+	fmt.Printf("Received NOTIFY for %s from %s\n", origin, client)
+	packet.Header.AuthoritativeAnswer = true
+	sz.Notify()
+	return packet
+}
+
+// notifySecondaries tells the secondaries that a zone changed, each of them
+// on its own goroutine.
+func notifySecondaries(z *zone) {
+	for _, target := range notifyTargets {
+		target := target
+		go func() {
+			err := sendNotify(z, target)
+			if err != nil {
+				fmt.Printf("Failed to notify %s of the change of %s: %+v\n", target.String(), z.Origin, err)
+			}
+		}()
+	}
+}
+
+// sendNotify sends a NOTIFY message carrying the SOA record of the zone to
+// a secondary, until it is acknowledged or we give up.
+func sendNotify(z *zone, target net.UDPAddr) error {
+	packet := dns.NewDnsPacket()
+	packet.Header.Id = randomUint16()
+	packet.Header.Opcode = dns.OpcodeNotify
+	packet.Header.AuthoritativeAnswer = true
+	packet.Questions = append(packet.Questions, dns.NewDnsQuestion(z.Origin, dns.SOA.ToNum()))
+	packet.Answers = append(packet.Answers, z.SOA())
+
+	reqBuffer := dns.NewBytePacketBuffer()
+	err := packet.Write(reqBuffer)
+	if err != nil {
+		return err
+	}
+
+	socket, err := listenRandomUDP(target.IP)
+	if err != nil {
+		return fmt.Errorf("binding UDP socket: %w", err)
+	}
+	defer socket.Close()
+
+	var lastErr error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		_, err = socket.WriteTo(reqBuffer.Buf[:reqBuffer.Pos], &target)
+		if err != nil {
+			return err
+		}
+
+		err = socket.SetReadDeadline(time.Now().Add(notifyTimeout << attempt))
+		if err != nil {
+			return err
+		}
+
+		response, err := awaitNotifyResponse(socket, &packet, target)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if response.Header.Rescode != dns.NOERROR {
+			return fmt.Errorf("%s answered with %v", target.String(), response.Header.Rescode)
+		}
+		fmt.Printf("Notified %s of serial %d of %s\n", target.String(), z.SOA().Serial, z.Origin)
+		return nil
+	}
+	return lastErr
+}
+
+// awaitNotifyResponse waits for the response of the secondary to the
+// NOTIFY message, ignoring stray packets.
+func awaitNotifyResponse(socket *net.UDPConn, request *dns.DnsPacket, target net.UDPAddr) (*dns.DnsPacket, error) {
+	for {
+		resBuffer := dns.NewBytePacketBufferWithSize(ednsUDPSize)
+		n, src, err := socket.ReadFromUDP(resBuffer.Buf)
+		if err != nil {
+			return nil, err
+		}
+		resBuffer.Buf = resBuffer.Buf[:n]
+
+		if !src.IP.Equal(target.IP) || src.Port != target.Port {
+			continue
+		}
+
+		response, err := dns.DnsPacketFromBuffer(resBuffer)
+		if err != nil || response.Header.Opcode != dns.OpcodeNotify || !matchesQuery(request, &response) {
+			continue
+		}
+		return &response, nil
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// useSecondaryZone serves origin as a secondary zone of primary for the
+// duration of the test, with nobody else allowed to send NOTIFY messages
+// unless the test says otherwise.
+func useSecondaryZone(t *testing.T, origin string, primary string) *secondaryZone {
+	oldSecondaries, oldACL := secondaries, notifyACL
+	t.Cleanup(func() {
+		secondaries, notifyACL = oldSecondaries, oldACL
+	})
+
+	sz := &secondaryZone{
+		Origin:   origin,
+		Primary:  net.TCPAddr{IP: net.ParseIP(primary), Port: 53},
+		notified: make(chan struct{}, 1),
+	}
+	secondaries = map[string]*secondaryZone{origin: sz}
+	notifyACL = nil
+	return sz
+}
+
+func notifyRequest(name string, qtype dns.QueryType) *dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.Id = 4242
+	packet.Header.Opcode = dns.OpcodeNotify
+	packet.Header.AuthoritativeAnswer = true
+	packet.Questions = append(packet.Questions, dns.NewDnsQuestion(name, qtype.ToNum()))
+	packet.Answers = append(packet.Answers, transferTestSOA(2))
+	return &packet
+}
+
+// wasNotified reports whether the zone was told to check its primary.
+func wasNotified(sz *secondaryZone) bool {
+	select {
+	case <-sz.notified:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAnswerNotify(t *testing.T) {
+	tests := []struct {
+		name         string
+		client       string
+		qname        string
+		qtype        dns.QueryType
+		allow        string
+		wantRescode  dns.ResultCode
+		wantNotified bool
+	}{
+		{"from the primary", "192.0.2.53", "example.com", dns.SOA, "", dns.NOERROR, true},
+		{"name in another case", "192.0.2.53", "Example.COM.", dns.SOA, "", dns.NOERROR, true},
+		{"from an allowed network", "198.51.100.7", "example.com", dns.SOA, "198.51.100.0/24", dns.NOERROR, true},
+		{"from another address", "198.51.100.7", "example.com", dns.SOA, "", dns.REFUSED, false},
+		{"from outside the allowed network", "203.0.113.7", "example.com", dns.SOA, "198.51.100.0/24", dns.REFUSED, false},
+		{"from an unknown client", "", "example.com", dns.SOA, "", dns.REFUSED, false},
+		{"for a zone we are not a secondary of", "192.0.2.53", "example.org", dns.SOA, "", dns.REFUSED, false},
+		{"for a type other than SOA", "192.0.2.53", "example.com", dns.A, "", dns.FORMERR, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sz := useSecondaryZone(t, "example.com", "192.0.2.53")
+			acl, err := parseAddressList(test.allow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			notifyACL = acl
+
+			ctx := context.Background()
+			if test.client != "" {
+				ctx = withClientAddr(ctx, net.ParseIP(test.client))
+			}
+			request := notifyRequest(test.qname, test.qtype)
+			response := buildResponse(ctx, request)
+
+			if response.Header.Rescode != test.wantRescode {
+				t.Errorf("rescode = %v, want %v", response.Header.Rescode, test.wantRescode)
+			}
+			if response.Header.Id != request.Header.Id || response.Header.Opcode != dns.OpcodeNotify || !response.Header.Response {
+				t.Errorf("header = %+v, want a NOTIFY response to %d", response.Header, request.Header.Id)
+			}
+			if response.Header.AuthoritativeAnswer != (test.wantRescode == dns.NOERROR) {
+				t.Errorf("AA = %v for rescode %v", response.Header.AuthoritativeAnswer, response.Header.Rescode)
+			}
+			if !reflect.DeepEqual(response.Questions, request.Questions) {
+				t.Errorf("questions = %+v, want %+v", response.Questions, request.Questions)
+			}
+			if len(response.Answers) != 0 {
+				t.Errorf("answers = %+v, want none", response.Answers)
+			}
+			if notified := wasNotified(sz); notified != test.wantNotified {
+				t.Errorf("notified = %v, want %v", notified, test.wantNotified)
+			}
+		})
+	}
+}
+
+func TestNotifyWhilePending(t *testing.T) {
+	sz := useSecondaryZone(t, "example.com", "192.0.2.53")
+	ctx := withClientAddr(context.Background(), net.ParseIP("192.0.2.53"))
+
+	// NOTIFY messages arriving before the zone got to check its primary
+	// are answered without waiting, and make it check only once.
+	for i := 0; i < 3; i++ {
+		response := answerNotify(ctx, notifyRequest("example.com", dns.SOA))
+		if response.Header.Rescode != dns.NOERROR {
+			t.Fatalf("rescode = %v for NOTIFY %d", response.Header.Rescode, i)
+		}
+	}
+	if !wasNotified(sz) {
+		t.Error("zone was not notified")
+	}
+	if wasNotified(sz) {
+		t.Error("zone was notified more than once")
+	}
+}
+
+// fakeSecondary answers NOTIFY messages over UDP the way we do, reporting
+// every request it gets on the returned channel.
+func fakeSecondary(t *testing.T) (net.UDPAddr, <-chan *dns.DnsPacket) {
+	t.Helper()
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socket.Close() })
+
+	requests := make(chan *dns.DnsPacket, 10)
+	go func() {
+		for {
+			reqBuffer := dns.NewBytePacketBufferWithSize(ednsUDPSize)
+			n, src, err := socket.ReadFromUDP(reqBuffer.Buf)
+			if err != nil {
+				return
+			}
+			reqBuffer.Buf = reqBuffer.Buf[:n]
+
+			request, err := dns.DnsPacketFromBuffer(reqBuffer)
+			if err != nil {
+				continue
+			}
+			requests <- &request
+
+			response := answerNotify(withClientAddr(context.Background(), src.IP), &request)
+			resBuffer := dns.NewBytePacketBuffer()
+			err = response.Write(resBuffer)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, err = socket.WriteToUDP(resBuffer.Buf[:resBuffer.Pos], src)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return *socket.LocalAddr().(*net.UDPAddr), requests
+}
+
+func TestSendNotify(t *testing.T) {
+	z := transferTestZones(t)[2]
+	sz := useSecondaryZone(t, "example.com", "127.0.0.1")
+	target, requests := fakeSecondary(t)
+
+	err := sendNotify(z, target)
+	if err != nil {
+		t.Fatalf("sendNotify: %v", err)
+	}
+
+	request := <-requests
+	if request.Header.Opcode != dns.OpcodeNotify || !request.Header.AuthoritativeAnswer {
+		t.Errorf("header = %+v, want an authoritative NOTIFY", request.Header)
+	}
+	if len(request.Questions) != 1 || request.Questions[0].Name != "example.com" || request.Questions[0].Qtype != dns.SOA.ToNum() {
+		t.Errorf("questions = %+v, want the SOA of example.com", request.Questions)
+	}
+	if len(request.Answers) != 1 {
+		t.Fatalf("answers = %+v, want the SOA record alone", request.Answers)
+	}
+	if soa, ok := request.Answers[0].(dns.SOARecord); !ok || soa.Serial != z.SOA().Serial {
+		t.Errorf("answer = %+v, want the SOA record with serial %d", request.Answers[0], z.SOA().Serial)
+	}
+
+	select {
+	case <-sz.notified:
+	case <-time.After(time.Second):
+		t.Error("secondary zone was not notified")
+	}
+}
+
+func TestSendNotifyRefused(t *testing.T) {
+	z := transferTestZones(t)[2]
+	useSecondaryZone(t, "example.com", "192.0.2.53")
+	target, _ := fakeSecondary(t)
+
+	err := sendNotify(z, target)
+	if err == nil {
+		t.Error("sendNotify succeeded while the secondary refused the NOTIFY")
+	}
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// tcpIdleTimeout bounds how long an idle client TCP connection is kept open
+// and how long we wait on an upstream TCP exchange.
+const tcpIdleTimeout = 10 * time.Second
+
+// ednsUDPSize is the UDP payload size advertised in our OPT records, both to
+// clients and to upstream servers. 1232 bytes avoids IP fragmentation on
+// virtually every path.
+const ednsUDPSize = 1232
+
+// cache holds the records learned while resolving, shared by all queries.
+var cache = newRecordCache()
+
+// cachePruneInterval is how often expired entries are evicted from the cache.
+const cachePruneInterval = time.Minute
+
+// attemptTimeout is how long we wait for a single nameserver to answer
+// before moving on to the next one.
+const attemptTimeout = 2 * time.Second
+
+// attemptsPerServer and maxLookupAttempts make up the retry budget of a
+// single step of the resolution: every nameserver is tried up to
+// attemptsPerServer times, but never more than maxLookupAttempts in total.
+const (
+	attemptsPerServer = 2
+	maxLookupAttempts = 8
+)
+
+// portAttempts is how many random source ports are tried before leaving the
+// choice to the OS.
+const portAttempts = 10
+
+// randomUint16 returns a cryptographically random 16-bit number, so that
+// query IDs and source ports can't be predicted by an attacker trying to
+// spoof responses.
+func randomUint16() uint16 {
+	var b [2]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// listenRandomUDP binds a UDP socket on a random unprivileged port, for
+// talking to a server of the same address family as ip.
+func listenRandomUDP(ip net.IP) (*net.UDPConn, error) {
+	network, local := "udp4", net.IPv4zero
+	if ip.To4() == nil {
+		network, local = "udp6", net.IPv6unspecified
+	}
+
+	for i := 0; i < portAttempts; i++ {
+		port := 1024 + int(randomUint16())%(65536-1024)
+		socket, err := net.ListenUDP(network, &net.UDPAddr{IP: local, Port: port})
+		if err == nil {
+			return socket, nil
+		}
+	}
+
+	return net.ListenUDP(network, &net.UDPAddr{IP: local, Port: 0})
+}
+
+// matchesQuery reports whether the response answers the query we sent, by
+// comparing the ID and the question section.
+func matchesQuery(query *dns.DnsPacket, response *dns.DnsPacket) bool {
+	if response.Header.Id != query.Header.Id || !response.Header.Response {
+		return false
+	}
+
+	if len(response.Questions) != len(query.Questions) {
+		return false
+	}
+
+	for i, question := range query.Questions {
+		if !strings.EqualFold(question.Name, response.Questions[i].Name) ||
+			question.Qtype != response.Questions[i].Qtype {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newQueryPacket builds a request packet for a single question, optionally
+// advertising our EDNS buffer size.
+func newQueryPacket(qname string, qtype dns.QueryType, edns bool) dns.DnsPacket {
+	packet := dns.DnsPacket{
+		Header: dns.DnsHeader{
+			Id:               randomUint16(),
+			Questions:        1,
+			RecursionDesired: true,
+		},
+		Questions: []dns.DnsQuestion{
+			{
+				Name:  qname,
+				Qtype: qtype.ToNum(),
+			},
+		},
+	}
+
+	// Signatures are only sent to us when we set the DO bit.
+	if edns {
+		opt := dns.NewOPTRecord(ednsUDPSize)
+		opt.DnssecOK = *dnssecValidation
+		packet.Resources = append(packet.Resources, opt)
+	}
+
+	return packet
+}
+
+// exchange sends a query to a server and returns its response. Tests answer
+// in place of real servers by replacing it.
+var exchange = lookup
+
+func lookup(ctx context.Context, qname string, qtype dns.QueryType, server net.UDPAddr) (dns.DnsPacket, error) {
+	response, err := lookupUDP(ctx, qname, qtype, server, true)
+
+	// Servers that predate EDNS reject the OPT record with FORMERR and
+	// don't include one of their own.
+	if err == nil && response.Header.Rescode == dns.FORMERR && response.GetOPT() == nil {
+		fmt.Printf("%s does not support EDNS, retrying without it\n", server.IP.String())
+		return lookupUDP(ctx, qname, qtype, server, false)
+	}
+
+	return response, err
+}
+
+func lookupUDP(ctx context.Context, qname string, qtype dns.QueryType, server net.UDPAddr, edns bool) (dns.DnsPacket, error) {
+	socket, err := listenRandomUDP(server.IP)
+	if err != nil {
+		return dns.DnsPacket{}, fmt.Errorf("binding UDP socket: %w", err)
+	}
+	defer socket.Close()
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		err = socket.SetDeadline(deadline)
+		if err != nil {
+			return dns.DnsPacket{}, err
+		}
+	}
+
+	packet := newQueryPacket(qname, qtype, edns)
+
+	reqBuffer := dns.NewBytePacketBuffer()
+	err = packet.Write(reqBuffer)
+	if err != nil {
+		return dns.DnsPacket{}, err
+	}
+
+	_, err = socket.WriteTo(reqBuffer.Buf[:reqBuffer.Pos], &server)
+	if err != nil {
+		return dns.DnsPacket{}, fmt.Errorf("sending packet to %s: %w", server.IP.String(), err)
+	}
+
+	// Anything that doesn't come from the server we asked, or doesn't answer
+	// the question we sent, is a stray or spoofed packet and is ignored while
+	// we keep waiting for the real response.
+	for {
+		resBuffer := dns.NewBytePacketBufferWithSize(ednsUDPSize)
+		n, src, err := socket.ReadFromUDP(resBuffer.Buf)
+		if err != nil {
+			return dns.DnsPacket{}, fmt.Errorf("receiving response from %s: %w", server.IP.String(), err)
+		}
+		resBuffer.Buf = resBuffer.Buf[:n]
+
+		if !src.IP.Equal(server.IP) || src.Port != server.Port {
+			fmt.Printf("ignoring response from unexpected address %s\n", src.String())
+			continue
+		}
+
+		// A truncated answer may not even parse, so the header is checked
+		// before the error.
+		response, err := dns.DnsPacketFromBuffer(resBuffer)
+		if response.Header.Id != packet.Header.Id {
+			fmt.Printf("ignoring response with unexpected id %d from %s\n", response.Header.Id, src.String())
+			continue
+		}
+
+		if response.Header.TruncatedMessage {
+			fmt.Printf("truncated response from %s, retrying over TCP\n", server.IP.String())
+			return lookupTCP(ctx, qname, qtype, net.TCPAddr{IP: server.IP, Port: server.Port}, edns)
+		}
+
+		if err != nil {
+			return response, err
+		}
+
+		if !matchesQuery(&packet, &response) {
+			fmt.Printf("ignoring response with mismatched question from %s\n", src.String())
+			continue
+		}
+
+		return response, nil
+	}
+}
+
+// lookupTCP sends a query to the server over TCP, which is used when a UDP
+// response came back truncated.
+func lookupTCP(ctx context.Context, qname string, qtype dns.QueryType, server net.TCPAddr, edns bool) (dns.DnsPacket, error) {
+	ctx, cancel := context.WithTimeout(ctx, tcpIdleTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", server.String())
+	if err != nil {
+		return dns.DnsPacket{}, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return dns.DnsPacket{}, err
+	}
+
+	packet := newQueryPacket(qname, qtype, edns)
+
+	reqBuffer := dns.NewBytePacketBufferWithSize(dns.MaxPacketSize)
+	err = packet.Write(reqBuffer)
+	if err != nil {
+		return dns.DnsPacket{}, err
+	}
+
+	err = dns.WriteTCPMessage(conn, reqBuffer)
+	if err != nil {
+		return dns.DnsPacket{}, err
+	}
+
+	resBuffer, err := dns.ReadTCPMessage(conn)
+	if err != nil {
+		return dns.DnsPacket{}, err
+	}
+
+	response, err := dns.DnsPacketFromBuffer(resBuffer)
+	if err != nil {
+		return response, err
+	}
+
+	if !matchesQuery(&packet, &response) {
+		return response, fmt.Errorf("response from %s does not match the query", server.IP.String())
+	}
+
+	return response, nil
+}
+
+// maxCNAMEChain bounds how many aliases are followed while answering a
+// single query.
+const maxCNAMEChain = 8
+
+// resolve answers the query, following the CNAME records found on the way
+// by restarting resolution at their target until the chain ends. The answer
+// section of the returned packet holds the whole chain, followed by the
+// records found at its end. The whole answer is only secure if every step
+// of the chain was.
+func resolve(ctx context.Context, qname string, qtype dns.QueryType) (*dns.DnsPacket, error) {
+	var chain []dns.DnsRecord
+	seen := map[string]bool{strings.ToLower(qname): true}
+	secure := true
+
+	name := qname
+	for {
+		response, err := resolveName(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		secure = secure && response.Header.AuthedData
+
+		// The response may already hold part of the chain, or all of it.
+		followed := false
+		answers := recordsAt(response.Answers, name, qtype)
+		for len(answers) == 0 && qtype != dns.CNAME {
+			cname, found := cnameAt(response.Answers, name)
+			if !found {
+				break
+			}
+
+			name = cname.Host
+			if seen[strings.ToLower(name)] {
+				return nil, fmt.Errorf("CNAME loop at %s while resolving %s", name, qname)
+			}
+			if len(seen) > maxCNAMEChain {
+				return nil, fmt.Errorf("CNAME chain too long while resolving %s", qname)
+			}
+			seen[strings.ToLower(name)] = true
+
+			chain = append(chain, recordsAt(response.Answers, cname.Domain, dns.CNAME)...)
+			followed = true
+			answers = recordsAt(response.Answers, name, qtype)
+		}
+
+		if len(answers) == 0 && followed {
+			continue
+		}
+
+		// The outcome at the end of the chain, be it records, NXDOMAIN or
+		// NODATA, is the outcome of the whole query.
+		response.Answers = append(chain, answers...)
+		response.Header.AuthedData = secure
+		return response, nil
+	}
+}
+
+// resolveName answers a single step of the resolution from the cache when it
+// can, and only falls back to a recursive lookup on a miss. A cached CNAME
+// at the name is returned in place of the records asked for.
+func resolveName(ctx context.Context, qname string, qtype dns.QueryType) (*dns.DnsPacket, error) {
+	packet, found := cache.Lookup(qname, qtype.ToNum())
+	if !found && qtype != dns.CNAME {
+		packet, found = cache.Lookup(qname, dns.CNAME.ToNum())
+	}
+	if found {
+		fmt.Printf("cache hit for %v %s\n", qtype, qname)
+		return packet, nil
+	}
+
+	packet, found = cache.LookupNegative(qname, qtype.ToNum())
+	if found {
+		fmt.Printf("negative cache hit for %v %s\n", qtype, qname)
+		return packet, nil
+	}
+
+	if *dnssecValidation && *aggressiveNSEC {
+		packet, found = cache.SynthesizeDenial(qname, qtype)
+		if found {
+			fmt.Printf("denial synthesized from cache for %v %s\n", qtype, qname)
+			return packet, nil
+		}
+	}
+
+	return recursiveLookup(ctx, qname, qtype)
+}
+
+// recordsAt returns the records of the given type owned by name, along with
+// the signatures covering them.
+func recordsAt(records []dns.DnsRecord, name string, qtype dns.QueryType) []dns.DnsRecord {
+	var found []dns.DnsRecord
+	for _, record := range records {
+		recordType := dns.RecordType(record)
+		if sig, ok := record.(dns.RRSIGRecord); ok && qtype != dns.RRSIG {
+			recordType = sig.TypeCovered
+		}
+
+		if recordType == qtype.ToNum() && strings.EqualFold(dns.RecordDomain(record), name) {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+// cnameAt returns the CNAME record owned by name, if there is one.
+func cnameAt(records []dns.DnsRecord, name string) (dns.CNAMERecord, bool) {
+	for _, record := range records {
+		cname, ok := record.(dns.CNAMERecord)
+		if ok && strings.EqualFold(cname.Domain, name) {
+			return cname, true
+		}
+	}
+	return dns.CNAMERecord{}, false
+}
+
+// maxMinimiseCount bounds how many minimised queries are sent while
+// resolving a single name, after which the full name is sent, as RFC 9156
+// suggests.
+const maxMinimiseCount = 10
+
+func recursiveLookup(ctx context.Context, qname string, qtype dns.QueryType) (*dns.DnsPacket, error) {
+	// Start from the closest delegation we know of, which is the primed
+	// root NS set at worst, or otherwise with the root hints.
+	// DS records live on the parent side of a zone cut, so they are asked
+	// for from the servers of the parent zone.
+	lookupName := qname
+	if qtype == dns.DS && qname != "" {
+		lookupName = parentDomain(qname)
+	}
+
+	zone, servers := cache.LookupNameservers(lookupName)
+	if len(servers) == 0 {
+		zone, servers = "", rootHintAddrs(rootHints)
+	}
+
+	// With QNAME minimisation, the servers only get to see the name one
+	// label below base, which is the deepest name we know to be served by
+	// them (RFC 9156).
+	minimise := *qnameMinimisation
+	minimised := 0
+	base := zone
+
+	// The nameservers of a delegation without glue are resolved one at a
+	// time, and only when the ones before them didn't answer.
+	var pendingNS []string
+
+	for {
+		name, nameType := qname, qtype
+		if minimise && minimised < maxMinimiseCount {
+			name = childName(qname, base)
+			if name != qname {
+				nameType = dns.A
+				minimised++
+			}
+		}
+
+		response, err := queryServers(ctx, name, nameType, servers)
+		if err != nil {
+			if len(pendingNS) > 0 {
+				servers, pendingNS = resolveNextNameserver(ctx, pendingNS)
+				if len(servers) > 0 {
+					fmt.Printf("trying the next nameserver of %s: %+v\n", zone, err)
+					continue
+				}
+			}
+			if name != qname {
+				fmt.Printf("minimised query for %s failed, sending the full name: %+v\n", name, err)
+				minimise = false
+				continue
+			}
+			return nil, err
+		}
+
+		// Only what the servers of the zone are authoritative for is kept,
+		// and only our own validation may mark it as secure.
+		response.Sanitize(zone, name)
+		response.Header.AuthedData = false
+
+		cache.StoreReferral(&response)
+
+		if name != qname {
+			// Some servers wrongly deny the existence of empty non-terminals,
+			// so the full name is asked for before believing them.
+			if response.Header.Rescode == dns.NXDOMAIN {
+				fmt.Printf("NXDOMAIN for minimised query %s, sending the full name\n", name)
+				minimise = false
+				continue
+			}
+
+			// Without a zone cut at the name, the same servers are asked
+			// about the next label.
+			referral, found := response.GetReferralZone(name)
+			if !found || dns.IsSubdomain(zone, referral) {
+				base = name
+				continue
+			}
+		}
+
+		// An empty answer with an SOA in the authority section is a NODATA
+		// response rather than a referral.
+		answered := len(response.Answers) > 0 && response.Header.Rescode == dns.NOERROR
+		denied := response.Header.Rescode == dns.NXDOMAIN ||
+			(response.Header.Rescode == dns.NOERROR && len(response.Answers) == 0 && response.GetSOA() != nil)
+
+		if answered || denied {
+			err := validateResponse(ctx, zone, qname, qtype, &response)
+			if err != nil {
+				// Clients that disabled checking get bogus answers as they
+				// are, but those never make it into the cache.
+				if errors.Is(err, errBogus) && checkingDisabled(ctx) {
+					fmt.Printf("returning bogus answer for %s: %+v\n", qname, err)
+					return &response, nil
+				}
+				return nil, err
+			}
+
+			if len(response.Answers) > 0 {
+				cache.StoreAnswers(response.Answers, response.Header.AuthedData)
+			} else {
+				cache.StoreNegative(qname, qtype.ToNum(), &response)
+			}
+			return &response, nil
+		}
+
+		referral, found := response.GetReferralZone(name)
+		if !found {
+			return &response, nil
+		}
+
+		// A referral has to lead further down the tree, or we would keep
+		// going around in circles. DS records can't be asked for from the
+		// zone they are about.
+		if dns.IsSubdomain(zone, referral) || (qtype == dns.DS && dns.IsSubdomain(referral, qname)) {
+			return nil, fmt.Errorf("lame referral to %q while resolving %s", referral, qname)
+		}
+		zone = referral
+		base = zone
+
+		newServers := response.GetResolvedNs(name)
+		if len(newServers) > 0 {
+			servers = newServers
+			pendingNS = nil
+			continue
+		}
+
+		// Without glue, the nameserver names have to be resolved first.
+		newNSNames := response.GetUnresolvedNS(name)
+		if len(newNSNames) == 0 {
+			return &response, nil
+		}
+
+		servers, pendingNS = resolveNextNameserver(ctx, newNSNames)
+		if len(servers) == 0 {
+			return &response, nil
+		}
+	}
+}
+
+// resolveNextNameserver resolves the nameserver names in turn until one of
+// them has an address. It returns the addresses along with the names that
+// are left to try.
+func resolveNextNameserver(ctx context.Context, hosts []string) ([]net.IP, []string) {
+	for i, host := range hosts {
+		servers := resolveNameserver(ctx, host)
+		if len(servers) > 0 {
+			return servers, hosts[i+1:]
+		}
+	}
+	return nil, nil
+}
+
+// childName returns the name one label below base on the way down to qname,
+// which is qname itself when base is its parent. A base that qname doesn't
+// lie below gives no way down, so qname is returned whole.
+func childName(qname string, base string) string {
+	if !dns.IsSubdomain(qname, base) {
+		return qname
+	}
+
+	labels := strings.Split(qname, ".")
+
+	depth := 0
+	if base != "" {
+		depth = len(strings.Split(base, "."))
+	}
+
+	if depth+1 >= len(labels) {
+		return qname
+	}
+	return strings.Join(labels[len(labels)-depth-1:], ".")
+}
+
+// resolveNameserver looks up the IPv4 and, when IPv6 transport is enabled,
+// the IPv6 addresses of a nameserver.
+func resolveNameserver(ctx context.Context, host string) []net.IP {
+	qtypes := []dns.QueryType{dns.A}
+	if *ipv6Upstream {
+		qtypes = append(qtypes, dns.AAAA)
+	}
+
+	var addrs []net.IP
+	for _, qtype := range qtypes {
+		response, err := resolve(ctx, host, qtype)
+		if err != nil {
+			fmt.Printf("failed to resolve nameserver %s: %+v\n", host, err)
+			continue
+		}
+		addrs = append(addrs, recordAddrs(response.Answers)...)
+	}
+	return addrs
+}
+
+// usableServers drops the IPv6 addresses when IPv6 transport is disabled.
+func usableServers(servers []net.IP) []net.IP {
+	if *ipv6Upstream {
+		return servers
+	}
+
+	var usable []net.IP
+	for _, server := range servers {
+		if server.To4() != nil {
+			usable = append(usable, server)
+		}
+	}
+	return usable
+}
+
+// queryServers sends the query to each of the servers in turn, fastest
+// first, giving each attempt its own timeout, until one of them answers or
+// the attempt budget is spent. Servers answering SERVFAIL or REFUSED are
+// skipped like those that don't answer at all.
+func queryServers(ctx context.Context, qname string, qtype dns.QueryType, servers []net.IP) (dns.DnsPacket, error) {
+	servers = nsStats.Order(usableServers(servers))
+	if len(servers) == 0 {
+		return dns.DnsPacket{}, fmt.Errorf("no usable nameserver address for %s", qname)
+	}
+
+	attempts := len(servers) * attemptsPerServer
+	if attempts > maxLookupAttempts {
+		attempts = maxLookupAttempts
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		err := ctx.Err()
+		if err != nil {
+			if lastErr != nil {
+				return dns.DnsPacket{}, fmt.Errorf("%w (last error: %v)", err, lastErr)
+			}
+			return dns.DnsPacket{}, err
+		}
+
+		ns := servers[attempt%len(servers)]
+		fmt.Printf("attempting lookup of %v %s with ns %s\n", qtype, qname, ns.String())
+
+		start := time.Now()
+		attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+		response, err := exchange(attemptCtx, qname, qtype, net.UDPAddr{IP: ns, Port: 53})
+		cancel()
+
+		if err == nil && (response.Header.Rescode == dns.SERVFAIL || response.Header.Rescode == dns.REFUSED) {
+			err = fmt.Errorf("%s answered with rcode %d", ns.String(), response.Header.Rescode)
+		}
+
+		if err != nil {
+			// Running out of time for the whole query isn't the server's fault.
+			if ctx.Err() == nil {
+				nsStats.RecordFailure(ns, attemptTimeout)
+			}
+			lastErr = err
+			continue
+		}
+
+		nsStats.RecordSuccess(ns, time.Since(start))
+		return response, nil
+	}
+
+	return dns.DnsPacket{}, fmt.Errorf("no nameserver answered for %s: %w", qname, lastErr)
+}
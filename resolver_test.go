@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// fakeServer answers a question the way a nameserver would.
+type fakeServer func(question dns.DnsQuestion) (dns.DnsPacket, error)
+
+// fakeNetwork stands in for the nameservers the resolver talks to. Servers
+// are looked up by address, and any other address is taken for a root
+// server.
+type fakeNetwork struct {
+	servers map[string]fakeServer
+	root    fakeServer
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// useFakeNetwork sends the queries of the resolver to the fake network,
+// with an empty cache, for the duration of the test.
+func useFakeNetwork(t *testing.T, network *fakeNetwork) {
+	oldExchange, oldCache := exchange, cache
+	t.Cleanup(func() {
+		exchange, cache = oldExchange, oldCache
+	})
+
+	cache = newRecordCache()
+	exchange = func(ctx context.Context, qname string, qtype dns.QueryType, server net.UDPAddr) (dns.DnsPacket, error) {
+		network.mu.Lock()
+		network.queries = append(network.queries, fmt.Sprintf("%s %s %d", server.IP, qname, qtype.ToNum()))
+		network.mu.Unlock()
+
+		answer, found := network.servers[server.IP.String()]
+		if !found {
+			answer = network.root
+		}
+		question := dns.NewDnsQuestion(qname, qtype.ToNum())
+		response, err := answer(question)
+		if err != nil {
+			return dns.DnsPacket{}, err
+		}
+		response.Header.Response = true
+		response.Questions = []dns.DnsQuestion{question}
+		return response, nil
+	}
+}
+
+// queried reports whether the server was asked the question, written as
+// "<name> <type>".
+func (n *fakeNetwork) queried(server string, question string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, query := range n.queries {
+		if query == server+" "+question {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeAnswer builds an authoritative response holding the records.
+func fakeAnswer(records ...dns.DnsRecord) dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.AuthoritativeAnswer = true
+	packet.Answers = records
+	return packet
+}
+
+// fakeNoData builds a NODATA response from zone.
+func fakeNoData(zone string) dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.AuthoritativeAnswer = true
+	packet.Authorities = append(packet.Authorities, dns.SOARecord{Domain: zone, MName: "ns." + zone, RName: "hostmaster." + zone, Serial: 1, Minimum: 60, TTL: 60})
+	return packet
+}
+
+// fakeReferral builds a referral to the zone served by the hosts, without
+// glue.
+func fakeReferral(zone string, hosts ...string) dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	for _, host := range hosts {
+		packet.Authorities = append(packet.Authorities, dns.NSRecord{Domain: zone, Host: host, TTL: 3600})
+	}
+	return packet
+}
+
+func addressRecord(name string, addr string) dns.ARecord {
+	return dns.ARecord{Domain: name, Addr: net.ParseIP(addr).To4(), TTL: 300}
+}
+
+var errFakeTimeout = fmt.Errorf("reading from server: %w", os.ErrDeadlineExceeded)
+
+// gluelessNetwork delegates example.com to two nameservers without glue.
+// The root servers answer for the nameserver names too.
+func gluelessNetwork(first fakeServer) *fakeNetwork {
+	return &fakeNetwork{
+		servers: map[string]fakeServer{
+			"192.0.2.1": first,
+			"192.0.2.2": func(question dns.DnsQuestion) (dns.DnsPacket, error) {
+				return fakeAnswer(addressRecord(question.Name, "198.51.100.2")), nil
+			},
+		},
+		root: func(question dns.DnsQuestion) (dns.DnsPacket, error) {
+			switch {
+			case question.Qtype != dns.A.ToNum():
+				return fakeNoData("hosting.net"), nil
+			case question.Name == "ns1.hosting.net":
+				return fakeAnswer(addressRecord(question.Name, "192.0.2.1")), nil
+			case question.Name == "ns2.hosting.net":
+				return fakeAnswer(addressRecord(question.Name, "192.0.2.2")), nil
+			}
+			return fakeReferral("example.com", "ns1.hosting.net", "ns2.hosting.net"), nil
+		},
+	}
+}
+
+func TestGluelessDelegationFailover(t *testing.T) {
+	network := gluelessNetwork(func(question dns.DnsQuestion) (dns.DnsPacket, error) {
+		return dns.DnsPacket{}, errFakeTimeout
+	})
+	useFakeNetwork(t, network)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	response, err := resolve(ctx, "www.example.com", dns.A)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	if len(response.Answers) != 1 || !response.Answers[0].(dns.ARecord).Addr.Equal(net.ParseIP("198.51.100.2")) {
+		t.Errorf("answers = %v, want the address from the second nameserver", response.Answers)
+	}
+	if !network.queried("192.0.2.1", "www.example.com 1") {
+		t.Error("the first nameserver was never asked")
+	}
+}
+
+func TestGluelessDelegationResolvesLazily(t *testing.T) {
+	network := gluelessNetwork(func(question dns.DnsQuestion) (dns.DnsPacket, error) {
+		return fakeAnswer(addressRecord(question.Name, "198.51.100.1")), nil
+	})
+	useFakeNetwork(t, network)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	response, err := resolve(ctx, "www.example.com", dns.A)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	if len(response.Answers) != 1 || !response.Answers[0].(dns.ARecord).Addr.Equal(net.ParseIP("198.51.100.1")) {
+		t.Errorf("answers = %v, want the address from the first nameserver", response.Answers)
+	}
+	for _, query := range network.queries {
+		if strings.Contains(query, "ns2.hosting.net") {
+			t.Errorf("resolved the second nameserver while the first one answered: %s", query)
+		}
+	}
+}
+
+func TestGluelessDelegationAllFail(t *testing.T) {
+	network := gluelessNetwork(func(question dns.DnsQuestion) (dns.DnsPacket, error) {
+		return dns.DnsPacket{}, errFakeTimeout
+	})
+	network.servers["192.0.2.2"] = func(question dns.DnsQuestion) (dns.DnsPacket, error) {
+		response := dns.NewDnsPacket()
+		response.Header.Rescode = dns.SERVFAIL
+		return response, nil
+	}
+	useFakeNetwork(t, network)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := resolve(ctx, "www.example.com", dns.A)
+	if err == nil {
+		t.Fatal("resolve succeeded without a working nameserver")
+	}
+	if !network.queried("192.0.2.2", "www.example.com 1") {
+		t.Error("the second nameserver was never asked")
+	}
+}
+
+func TestChildName(t *testing.T) {
+	tests := []struct {
+		qname string
+		base  string
+		want  string
+	}{
+		{"www.example.com", "", "com"},
+		{"com", "", "com"},
+		{"", "", ""},
+		{"a.b.c.example.com", "example.com", "c.example.com"},
+		{"c.example.com", "example.com", "c.example.com"},
+		{"example.com", "example.com", "example.com"},
+		{"WWW.Sub.Example.COM", "example.com", "Sub.Example.COM"},
+		{"www.sub.example.com", "Example.COM", "sub.example.com"},
+		{"www.example.com", "other.org", "www.example.com"},
+		{"www.example.com", "ample.com", "www.example.com"},
+		{"example.com", "www.example.com", "example.com"},
+	}
+
+	for _, test := range tests {
+		got := childName(test.qname, test.base)
+		if got != test.want {
+			t.Errorf("childName(%q, %q) = %q, want %q", test.qname, test.base, got, test.want)
+		}
+	}
+}
+
+func cnameRecord(name string, target string) dns.CNAMERecord {
+	return dns.CNAMERecord{Domain: name, Host: target, TTL: 300}
+}
+
+// aliasNetwork has the root servers answer every question themselves, with
+// the records listed for the name, or NXDOMAIN for names without any.
+func aliasNetwork(records map[string][]dns.DnsRecord) *fakeNetwork {
+	return &fakeNetwork{
+		root: func(question dns.DnsQuestion) (dns.DnsPacket, error) {
+			answers, found := records[question.Name]
+			if !found {
+				response := fakeNoData("")
+				response.Header.Rescode = dns.NXDOMAIN
+				return response, nil
+			}
+			return fakeAnswer(answers...), nil
+		},
+	}
+}
+
+// chainTo returns the records of a chain of count CNAMEs from a0.example.com
+// to an address, each of them served on its own.
+func chainTo(count int) map[string][]dns.DnsRecord {
+	records := make(map[string][]dns.DnsRecord)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("a%d.example.com", i)
+		records[name] = []dns.DnsRecord{cnameRecord(name, fmt.Sprintf("a%d.example.com", i+1))}
+	}
+	last := fmt.Sprintf("a%d.example.com", count)
+	records[last] = []dns.DnsRecord{addressRecord(last, "192.0.2.80")}
+	return records
+}
+
+func TestResolveCNAMEChain(t *testing.T) {
+	dname := dns.UnknownRecord{Domain: "example.com", QType: 39, Data: []byte("\x07example\x03net\x00"), TTL: 300}
+
+	tests := []struct {
+		name    string
+		records map[string][]dns.DnsRecord
+		cached  []dns.DnsRecord
+		want    []string
+		queries []string
+	}{
+		{
+			"chain within one response",
+			map[string][]dns.DnsRecord{"www.example.com": {
+				cnameRecord("www.example.com", "web.example.com"),
+				cnameRecord("web.example.com", "host.example.org"),
+				addressRecord("host.example.org", "192.0.2.80"),
+			}},
+			nil,
+			[]string{"www.example.com CNAME web.example.com", "web.example.com CNAME host.example.org", "host.example.org A 192.0.2.80"},
+			[]string{"www.example.com 1"},
+		},
+		{
+			"chain across responses",
+			map[string][]dns.DnsRecord{
+				"www.example.com":  {cnameRecord("www.example.com", "host.example.org")},
+				"host.example.org": {addressRecord("host.example.org", "192.0.2.80")},
+			},
+			nil,
+			[]string{"www.example.com CNAME host.example.org", "host.example.org A 192.0.2.80"},
+			[]string{"www.example.com 1", "host.example.org 1"},
+		},
+		{
+			"DNAME with its CNAME and target",
+			map[string][]dns.DnsRecord{"www.example.com": {
+				dname,
+				cnameRecord("www.example.com", "www.example.net"),
+				addressRecord("www.example.net", "192.0.2.80"),
+			}},
+			nil,
+			[]string{"www.example.com CNAME www.example.net", "www.example.net A 192.0.2.80"},
+			[]string{"www.example.com 1"},
+		},
+		{
+			"cached CNAME to a name on the network",
+			map[string][]dns.DnsRecord{"host.example.org": {addressRecord("host.example.org", "192.0.2.80")}},
+			[]dns.DnsRecord{cnameRecord("www.example.com", "host.example.org")},
+			[]string{"www.example.com CNAME host.example.org", "host.example.org A 192.0.2.80"},
+			[]string{"host.example.org 1"},
+		},
+		{
+			"CNAME on the network to a cached name",
+			map[string][]dns.DnsRecord{"www.example.com": {cnameRecord("www.example.com", "host.example.org")}},
+			[]dns.DnsRecord{addressRecord("host.example.org", "192.0.2.80")},
+			[]string{"www.example.com CNAME host.example.org", "host.example.org A 192.0.2.80"},
+			[]string{"www.example.com 1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := aliasNetwork(test.records)
+			useFakeNetwork(t, network)
+			if len(test.cached) > 0 {
+				cache.StoreAnswers(test.cached, false)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			response, err := resolve(ctx, "www.example.com", dns.A)
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+
+			got := answerSummary(response.Answers)
+			if !sameSummary(got, test.want) {
+				t.Errorf("answers = %v, want %v", got, test.want)
+			}
+
+			var queries []string
+			for _, query := range network.queries {
+				_, question, _ := strings.Cut(query, " ")
+				queries = append(queries, question)
+			}
+			if !sameSummary(queries, test.queries) {
+				t.Errorf("queries = %v, want %v", queries, test.queries)
+			}
+		})
+	}
+}
+
+func TestResolveLongestCNAMEChain(t *testing.T) {
+	useFakeNetwork(t, aliasNetwork(chainTo(maxCNAMEChain)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	response, err := resolve(ctx, "a0.example.com", dns.A)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	got := answerSummary(response.Answers)
+	last := fmt.Sprintf("a%d.example.com A 192.0.2.80", maxCNAMEChain)
+	if len(got) != maxCNAMEChain+1 || got[len(got)-1] != last {
+		t.Errorf("answers = %v, want %d CNAMEs followed by %s", got, maxCNAMEChain, last)
+	}
+}
+
+func TestResolveCNAMEFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		records map[string][]dns.DnsRecord
+		want    string
+	}{
+		{
+			"CNAME to itself",
+			"www.example.com",
+			map[string][]dns.DnsRecord{"www.example.com": {cnameRecord("www.example.com", "WWW.example.com")}},
+			"loop",
+		},
+		{
+			"loop within one response",
+			"www.example.com",
+			map[string][]dns.DnsRecord{"www.example.com": {
+				cnameRecord("www.example.com", "web.example.com"),
+				cnameRecord("web.example.com", "www.example.com"),
+			}},
+			"loop",
+		},
+		{
+			"loop across responses",
+			"www.example.com",
+			map[string][]dns.DnsRecord{
+				"www.example.com":  {cnameRecord("www.example.com", "web.example.com")},
+				"web.example.com":  {cnameRecord("web.example.com", "host.example.com")},
+				"host.example.com": {cnameRecord("host.example.com", "web.example.com")},
+			},
+			"loop",
+		},
+		{
+			"chain one CNAME too long",
+			"a0.example.com",
+			chainTo(maxCNAMEChain + 1),
+			"too long",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useFakeNetwork(t, aliasNetwork(test.records))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			response, err := resolve(ctx, test.qname, dns.A)
+			if err == nil {
+				t.Fatalf("resolve succeeded with %v", answerSummary(response.Answers))
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want it to mention %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchesQuery(t *testing.T) {
+	query := newQueryPacket("www.example.com", dns.A, true)
+	query.Header.Id = 1
+
+	tests := []struct {
+		name   string
+		change func(response *dns.DnsPacket)
+		want   bool
+	}{
+		{"same question", func(response *dns.DnsPacket) {}, true},
+		{"name in another case", func(response *dns.DnsPacket) { response.Questions[0].Name = "WWW.Example.com" }, true},
+		{"not a response", func(response *dns.DnsPacket) { response.Header.Response = false }, false},
+		{"another ID", func(response *dns.DnsPacket) { response.Header.Id = 2 }, false},
+		{"another name", func(response *dns.DnsPacket) { response.Questions[0].Name = "mail.example.com" }, false},
+		{"another type", func(response *dns.DnsPacket) { response.Questions[0].Qtype = dns.AAAA.ToNum() }, false},
+		{"no question", func(response *dns.DnsPacket) { response.Questions = nil }, false},
+		{"extra question", func(response *dns.DnsPacket) {
+			response.Questions = append(response.Questions, dns.NewDnsQuestion("www.example.com", dns.A.ToNum()))
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := dns.NewDnsPacket()
+			response.Header.Id = 1
+			response.Header.Response = true
+			response.Questions = []dns.DnsQuestion{dns.NewDnsQuestion("www.example.com", dns.A.ToNum())}
+			test.change(&response)
+
+			if got := matchesQuery(&query, &response); got != test.want {
+				t.Errorf("matchesQuery = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// udpReply is a response sent by udpTestServer, from the port queries are
+// sent to or from another one.
+type udpReply struct {
+	packet    dns.DnsPacket
+	elsewhere bool
+}
+
+// udpTestServer answers queries over UDP on the loopback address with the
+// replies built for each of them.
+func udpTestServer(t *testing.T, replies func(request *dns.DnsPacket) []udpReply) net.UDPAddr {
+	t.Helper()
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		socket.Close()
+		other.Close()
+	})
+
+	go func() {
+		for {
+			reqBuffer := dns.NewBytePacketBufferWithSize(ednsUDPSize)
+			n, src, err := socket.ReadFromUDP(reqBuffer.Buf)
+			if err != nil {
+				return
+			}
+			reqBuffer.Buf = reqBuffer.Buf[:n]
+
+			request, err := dns.DnsPacketFromBuffer(reqBuffer)
+			if err != nil {
+				continue
+			}
+
+			for _, reply := range replies(&request) {
+				resBuffer := dns.NewBytePacketBuffer()
+				err := reply.packet.Write(resBuffer)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				from := socket
+				if reply.elsewhere {
+					from = other
+				}
+				_, err = from.WriteToUDP(resBuffer.Buf[:resBuffer.Pos], src)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return *socket.LocalAddr().(*net.UDPAddr)
+}
+
+func TestLookupUDPIgnoresStrayResponses(t *testing.T) {
+	// Each kind of stray response is built from the real one.
+	strays := map[string]func(real dns.DnsPacket) udpReply{
+		"from another port": func(real dns.DnsPacket) udpReply {
+			real.Answers = []dns.DnsRecord{addressRecord("www.example.com", "203.0.113.1")}
+			return udpReply{packet: real, elsewhere: true}
+		},
+		"with another ID": func(real dns.DnsPacket) udpReply {
+			real.Header.Id++
+			real.Answers = []dns.DnsRecord{addressRecord("www.example.com", "203.0.113.2")}
+			return udpReply{packet: real}
+		},
+		"truncated with another ID": func(real dns.DnsPacket) udpReply {
+			real.Header.Id++
+			real.Header.TruncatedMessage = true
+			real.Answers = nil
+			return udpReply{packet: real}
+		},
+		"for another name": func(real dns.DnsPacket) udpReply {
+			real.Questions = []dns.DnsQuestion{dns.NewDnsQuestion("evil.example.com", dns.A.ToNum())}
+			real.Answers = []dns.DnsRecord{addressRecord("evil.example.com", "203.0.113.3")}
+			return udpReply{packet: real}
+		},
+		"for another type": func(real dns.DnsPacket) udpReply {
+			real.Questions = []dns.DnsQuestion{dns.NewDnsQuestion("www.example.com", dns.MX.ToNum())}
+			real.Answers = nil
+			return udpReply{packet: real}
+		},
+		"without the response flag": func(real dns.DnsPacket) udpReply {
+			real.Header.Response = false
+			real.Answers = []dns.DnsRecord{addressRecord("www.example.com", "203.0.113.4")}
+			return udpReply{packet: real}
+		},
+	}
+
+	realResponse := func(request *dns.DnsPacket) dns.DnsPacket {
+		response := fakeAnswer(addressRecord("www.example.com", "192.0.2.1"))
+		response.Header.Id = request.Header.Id
+		response.Header.Response = true
+		response.Questions = request.Questions
+		return response
+	}
+
+	for name, stray := range strays {
+		stray := stray
+		t.Run(name, func(t *testing.T) {
+			server := udpTestServer(t, func(request *dns.DnsPacket) []udpReply {
+				real := realResponse(request)
+				return []udpReply{stray(real), {packet: real}}
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			response, err := lookupUDP(ctx, "www.example.com", dns.A, server, true)
+			if err != nil {
+				t.Fatalf("lookupUDP: %v", err)
+			}
+
+			want := []string{"www.example.com A 192.0.2.1"}
+			if got := answerSummary(response.Answers); !sameSummary(got, want) {
+				t.Errorf("answers = %v, want %v", got, want)
+			}
+		})
+	}
+
+	t.Run("only stray responses", func(t *testing.T) {
+		server := udpTestServer(t, func(request *dns.DnsPacket) []udpReply {
+			real := realResponse(request)
+			var replies []udpReply
+			for _, stray := range strays {
+				replies = append(replies, stray(real))
+			}
+			return replies
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		response, err := lookupUDP(ctx, "www.example.com", dns.A, server, true)
+		if err == nil {
+			t.Fatalf("lookupUDP returned %v from stray responses", answerSummary(response.Answers))
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("err = %v, want a timeout", err)
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+const (
+	// rootHintsTTL is the TTL used in root hints files.
+	rootHintsTTL = 3600000
+
+	// primingTimeout bounds a single priming query.
+	primingTimeout = 10 * time.Second
+
+	// primingRetryInterval is how long we wait before priming again after a
+	// failure.
+	primingRetryInterval = time.Minute
+)
+
+// builtinRootServers lists the 13 root servers along with their IPv4 and
+// IPv6 addresses, as published by IANA.
+var builtinRootServers = []struct {
+	Host string
+	IPv4 string
+	IPv6 string
+}{
+	{"a.root-servers.net", "198.41.0.4", "2001:503:ba3e::2:30"},
+	{"b.root-servers.net", "170.247.170.2", "2801:1b8:10::b"},
+	{"c.root-servers.net", "192.33.4.12", "2001:500:2::c"},
+	{"d.root-servers.net", "199.7.91.13", "2001:500:2d::d"},
+	{"e.root-servers.net", "192.203.230.10", "2001:500:a8::e"},
+	{"f.root-servers.net", "192.5.5.241", "2001:500:2f::f"},
+	{"g.root-servers.net", "192.112.36.4", "2001:500:12::d0d"},
+	{"h.root-servers.net", "198.97.190.53", "2001:500:1::53"},
+	{"i.root-servers.net", "192.36.148.17", "2001:7fe::53"},
+	{"j.root-servers.net", "192.58.128.30", "2001:503:c27::2:30"},
+	{"k.root-servers.net", "193.0.14.129", "2001:7fd::1"},
+	{"l.root-servers.net", "199.7.83.42", "2001:500:9f::42"},
+	{"m.root-servers.net", "202.12.27.33", "2001:dc3::35"},
+}
+
+// rootHints holds the NS records of the root zone and the addresses of
+// those servers, used to find the root servers before priming succeeds.
+var rootHints = builtinRootHints()
+
+// builtinRootHints turns the built-in root server list into records.
+func builtinRootHints() []dns.DnsRecord {
+	var records []dns.DnsRecord
+	for _, server := range builtinRootServers {
+		records = append(records,
+			dns.NSRecord{Domain: "", Host: server.Host, TTL: rootHintsTTL},
+			dns.ARecord{Domain: server.Host, Addr: net.ParseIP(server.IPv4).To4(), TTL: rootHintsTTL},
+			dns.AAAARecord{Domain: server.Host, Addr: net.ParseIP(server.IPv6), TTL: rootHintsTTL},
+		)
+	}
+	return records
+}
+
+// loadRootHints reads a root hints file in the named.root format. Only NS
+// records of the root zone and A and AAAA records are accepted.
+func loadRootHints(path string) ([]dns.DnsRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []dns.DnsRecord
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		rest := fields[1:]
+
+		var ttl uint32 = rootHintsTTL
+		if len(rest) > 0 {
+			value, err := strconv.ParseUint(rest[0], 10, 32)
+			if err == nil {
+				ttl = uint32(value)
+				rest = rest[1:]
+			}
+		}
+		if len(rest) > 0 && strings.EqualFold(rest[0], "IN") {
+			rest = rest[1:]
+		}
+		if len(rest) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed record", path, lineNum)
+		}
+
+		switch strings.ToUpper(rest[0]) {
+		case "NS":
+			if name != "" {
+				return nil, fmt.Errorf("%s:%d: NS record for %s instead of the root", path, lineNum, name)
+			}
+			host := strings.ToLower(strings.TrimSuffix(rest[1], "."))
+			records = append(records, dns.NSRecord{Domain: name, Host: host, TTL: ttl})
+		case "A":
+			addr := net.ParseIP(rest[1]).To4()
+			if addr == nil {
+				return nil, fmt.Errorf("%s:%d: invalid IPv4 address %s", path, lineNum, rest[1])
+			}
+			records = append(records, dns.ARecord{Domain: name, Addr: addr, TTL: ttl})
+		case "AAAA":
+			addr := net.ParseIP(rest[1])
+			if addr == nil || addr.To4() != nil {
+				return nil, fmt.Errorf("%s:%d: invalid IPv6 address %s", path, lineNum, rest[1])
+			}
+			records = append(records, dns.AAAARecord{Domain: name, Addr: addr, TTL: ttl})
+		default:
+			return nil, fmt.Errorf("%s:%d: unsupported record type %s", path, lineNum, rest[0])
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rootHintAddrs(records)) == 0 {
+		return nil, fmt.Errorf("%s: no root server addresses found", path)
+	}
+
+	return records, nil
+}
+
+// rootHintAddrs returns the addresses of the root servers named in the
+// hints.
+func rootHintAddrs(hints []dns.DnsRecord) []net.IP {
+	hosts := make(map[string]bool)
+	for _, record := range hints {
+		nsRecord, ok := record.(dns.NSRecord)
+		if ok {
+			hosts[nsRecord.Host] = true
+		}
+	}
+
+	var glue []dns.DnsRecord
+	for _, record := range hints {
+		if hosts[dns.RecordDomain(record)] {
+			glue = append(glue, record)
+		}
+	}
+	return recordAddrs(glue)
+}
+
+// primeRootServers sends a priming query for the root NS set to the hinted
+// servers (RFC 8109) and caches the answer as the delegation of the root
+// zone. It returns how long the answer remains valid.
+func primeRootServers(ctx context.Context) (time.Duration, error) {
+	response, err := queryServers(ctx, "", dns.NS, rootHintAddrs(rootHints))
+	if err != nil {
+		return 0, err
+	}
+
+	var nsRecords []dns.DnsRecord
+	ttl := uint32(rootHintsTTL)
+	for _, record := range response.Answers {
+		nsRecord, ok := record.(dns.NSRecord)
+		if ok && nsRecord.Domain == "" {
+			nsRecords = append(nsRecords, nsRecord)
+			if nsRecord.TTL < ttl {
+				ttl = nsRecord.TTL
+			}
+		}
+	}
+
+	if len(nsRecords) == 0 {
+		return 0, fmt.Errorf("priming response has no root NS records")
+	}
+
+	cache.StoreDelegation(nsRecords, response.Resources)
+
+	refresh := time.Duration(ttl) * time.Second
+	if refresh > maxCacheTTL {
+		refresh = maxCacheTTL
+	}
+	return refresh, nil
+}
+
+// maintainRootServers primes the root NS set and keeps priming it again
+// whenever it expires.
+func maintainRootServers() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), primingTimeout)
+		refresh, err := primeRootServers(ctx)
+		cancel()
+
+		if err != nil {
+			fmt.Printf("Failed to prime root servers: %+v\n", err)
+			refresh = primingRetryInterval
+		} else {
+			fmt.Printf("Primed root servers, refreshing in %v\n", refresh)
+		}
+
+		time.Sleep(refresh)
+	}
+}
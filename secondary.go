@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+const (
+	// transferTimeout bounds an SOA check and the transfer that may follow.
+	transferTimeout = 5 * time.Minute
+
+	// initialRetryInterval is how long we wait before trying again to load
+	// a secondary zone that was never transferred, since there is no SOA
+	// record to take the retry interval from yet.
+	initialRetryInterval = time.Minute
+
+	// minRefreshInterval keeps zones with tiny SOA timers from hammering
+	// their primary.
+	minRefreshInterval = 5 * time.Second
+)
+
+// secondaryZone is a zone we serve as a secondary, kept up to date with
+// the copy of its primary through zone transfers.
+type secondaryZone struct {
+	Origin  string
+	Primary net.TCPAddr
+
+	// notified wakes up the goroutine maintaining the zone when the
+	// primary sends a NOTIFY message.
+	notified chan struct{}
+
+	// zone is the last version transferred, which may have expired.
+	zone *zone
+	// refreshed is when the primary last confirmed that zone is current.
+	refreshed time.Time
+}
+
+// secondaries are the zones we serve as a secondary, by origin. The map is
+// filled at startup and only read afterwards.
+var secondaries = make(map[string]*secondaryZone)
+
+// loadSecondaryZones parses the zones listed as comma separated
+// "origin=address" pairs, with the port of the primary defaulting to 53.
+// The zones are answered with SERVFAIL until first transferred.
+func loadSecondaryZones(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		origin, address, found := strings.Cut(item, "=")
+		if !found {
+			return fmt.Errorf("malformed secondary zone %q, expected origin=address", item)
+		}
+
+		if net.ParseIP(address) != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+		primary, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return err
+		}
+
+		origin = strings.ToLower(strings.TrimSuffix(origin, "."))
+		secondaries[origin] = &secondaryZone{
+			Origin:   origin,
+			Primary:  *primary,
+			notified: make(chan struct{}, 1),
+		}
+		authZones.Store(&zone{Origin: origin})
+	}
+	return nil
+}
+
+// maintain keeps the zone up to date for as long as we run, checking the
+// serial of the primary as often as the SOA record of the zone says
+// (RFC 1034 section 4.3.5), or right away when notified.
+func (sz *secondaryZone) maintain() {
+	for {
+		wait := sz.refresh()
+
+		select {
+		case <-time.After(wait):
+		case <-sz.notified:
+		}
+	}
+}
+
+// Notify makes the zone check the serial of its primary without waiting
+// for the refresh timer. Notifications arriving while one is pending are
+// merged into it.
+func (sz *secondaryZone) Notify() {
+	select {
+	case sz.notified <- struct{}{}:
+	default:
+	}
+}
+
+// refresh checks the primary for a newer version of the zone and transfers
+// it when there is one. It returns how long to wait before the next check,
+// and stops serving the zone once it expired.
+func (sz *secondaryZone) refresh() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+
+	err := sz.update(ctx)
+	if err == nil {
+		return boundRefreshInterval(time.Duration(sz.zone.SOA().Refresh) * time.Second)
+	}
+	fmt.Printf("Failed to refresh zone %s from %s: %+v\n", sz.Origin, sz.Primary.String(), err)
+
+	if sz.zone == nil {
+		return initialRetryInterval
+	}
+
+	soa := sz.zone.SOA()
+	expires := sz.refreshed.Add(time.Duration(soa.Expire) * time.Second)
+	remaining := time.Until(expires)
+	if remaining <= 0 {
+		current, _ := authZones.Get(sz.Origin)
+		if current.Loaded() {
+			fmt.Printf("Zone %s expired, answering SERVFAIL until the primary is reachable again\n", sz.Origin)
+			authZones.Store(&zone{Origin: sz.Origin})
+		}
+		return boundRefreshInterval(time.Duration(soa.Retry) * time.Second)
+	}
+
+	wait := time.Duration(soa.Retry) * time.Second
+	if remaining < wait {
+		wait = remaining
+	}
+	return boundRefreshInterval(wait)
+}
+
+// boundRefreshInterval keeps the time between two checks above
+// minRefreshInterval.
+func boundRefreshInterval(wait time.Duration) time.Duration {
+	if wait < minRefreshInterval {
+		return minRefreshInterval
+	}
+	return wait
+}
+
+// update asks the primary for the serial of the zone and transfers the
+// zone if it changed, incrementally when possible.
+func (sz *secondaryZone) update(ctx context.Context) error {
+	response, err := lookupTCP(ctx, sz.Origin, dns.SOA, sz.Primary, false)
+	if err != nil {
+		return err
+	}
+	if response.Header.Rescode != dns.NOERROR {
+		return fmt.Errorf("primary answered the SOA query with %v", response.Header.Rescode)
+	}
+
+	var serial uint32
+	found := false
+	for _, record := range response.Answers {
+		soa, ok := record.(dns.SOARecord)
+		if ok && soa.Domain == sz.Origin {
+			serial = soa.Serial
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("primary has no SOA record for the zone")
+	}
+
+	if sz.zone != nil && !serialLess(sz.zone.SOA().Serial, serial) {
+		sz.refreshed = time.Now()
+
+		// A zone that expired is served again once the primary confirms it.
+		current, _ := authZones.Get(sz.Origin)
+		if !current.Loaded() {
+			authZones.Store(sz.zone)
+		}
+		return nil
+	}
+
+	var z *zone
+	if sz.zone != nil {
+		z, err = sz.transfer(ctx, dns.IXFR)
+		if err != nil {
+			fmt.Printf("IXFR of %s from %s failed, falling back to AXFR: %+v\n", sz.Origin, sz.Primary.String(), err)
+		}
+	}
+	if z == nil {
+		z, err = sz.transfer(ctx, dns.AXFR)
+		if err != nil {
+			return err
+		}
+	}
+
+	sz.zone = z
+	sz.refreshed = time.Now()
+	authZones.Store(z)
+	fmt.Printf("Transferred zone %s with serial %d from %s\n", sz.Origin, z.SOA().Serial, sz.Primary.String())
+	return nil
+}
+
+// transfer fetches the zone from the primary with an AXFR or IXFR query
+// and builds the new version of the zone from it.
+func (sz *secondaryZone) transfer(ctx context.Context, qtype dns.QueryType) (*zone, error) {
+	records, err := requestTransfer(ctx, sz.Primary, sz.Origin, qtype, sz.zone)
+	if err != nil {
+		return nil, err
+	}
+
+	// An IXFR answer with the SOA record alone says we are up to date, and
+	// one whose second record is not an SOA record holds the whole zone.
+	serial := records[0].(dns.SOARecord).Serial
+	if len(records) == 1 {
+		if sz.zone != nil && !serialLess(sz.zone.SOA().Serial, serial) {
+			return sz.zone, nil
+		}
+		return nil, errors.New("transfer holds a single SOA record")
+	}
+
+	second, incremental := records[1].(dns.SOARecord)
+	if !incremental || second.Serial == serial {
+		return newZone(sz.Origin, records[:len(records)-1])
+	}
+
+	diffs, err := parseIncremental(records)
+	if err != nil {
+		return nil, err
+	}
+
+	zoneRecords := sz.zone.Records()
+	for _, diff := range diffs {
+		current := zoneRecords[0].(dns.SOARecord).Serial
+		if diff.From.Serial != current {
+			return nil, fmt.Errorf("change from serial %d doesn't apply to serial %d", diff.From.Serial, current)
+		}
+		zoneRecords = applyDiff(zoneRecords, diff)
+	}
+	if zoneRecords[0].(dns.SOARecord).Serial != serial {
+		return nil, fmt.Errorf("changes end at serial %d instead of %d", zoneRecords[0].(dns.SOARecord).Serial, serial)
+	}
+
+	return newZone(sz.Origin, zoneRecords)
+}
+
+// parseIncremental splits the records of an incremental transfer into the
+// changes it is made of (RFC 1995 section 4).
+func parseIncremental(records []dns.DnsRecord) ([]zoneDiff, error) {
+	var diffs []zoneDiff
+	adding := false
+	for _, record := range records[1 : len(records)-1] {
+		soa, isSOA := record.(dns.SOARecord)
+		switch {
+		case isSOA && (len(diffs) == 0 || adding):
+			diffs = append(diffs, zoneDiff{From: soa})
+			adding = false
+		case isSOA:
+			diffs[len(diffs)-1].To = soa
+			adding = true
+		case len(diffs) == 0:
+			return nil, errors.New("incremental transfer doesn't start with an SOA record")
+		case adding:
+			diffs[len(diffs)-1].Added = append(diffs[len(diffs)-1].Added, record)
+		default:
+			diffs[len(diffs)-1].Deleted = append(diffs[len(diffs)-1].Deleted, record)
+		}
+	}
+
+	if len(diffs) == 0 || !adding {
+		return nil, errors.New("incremental transfer ends in the middle of a change")
+	}
+	return diffs, nil
+}
+
+// requestTransfer sends an AXFR or IXFR query to the server over TCP and
+// returns the records of every message of the answer. IXFR queries carry
+// the SOA record of the version we have.
+func requestTransfer(ctx context.Context, server net.TCPAddr, origin string, qtype dns.QueryType, current *zone) ([]dns.DnsRecord, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := newQueryPacket(origin, qtype, false)
+	packet.Header.RecursionDesired = false
+	if qtype == dns.IXFR {
+		packet.Authorities = append(packet.Authorities, current.SOA())
+	}
+
+	reqBuffer := dns.NewBytePacketBufferWithSize(dns.MaxPacketSize)
+	err = packet.Write(reqBuffer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = dns.WriteTCPMessage(conn, reqBuffer)
+	if err != nil {
+		return nil, err
+	}
+
+	// The transfer ends with the SOA record of the new version, which also
+	// starts it and, in incremental transfers, ends the last change.
+	var records []dns.DnsRecord
+	var serial uint32
+	serialCount := 0
+	incremental := false
+	for {
+		resBuffer, err := dns.ReadTCPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := dns.DnsPacketFromBuffer(resBuffer)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the first message has to repeat the question.
+		if response.Header.Id != packet.Header.Id || (len(response.Questions) > 0 && !matchesQuery(&packet, &response)) {
+			return nil, fmt.Errorf("response from %s does not match the query", server.IP.String())
+		}
+		if response.Header.Rescode != dns.NOERROR {
+			return nil, fmt.Errorf("%s refused the transfer with %v", server.IP.String(), response.Header.Rescode)
+		}
+
+		for _, record := range response.Answers {
+			soa, isSOA := record.(dns.SOARecord)
+			if len(records) == 0 {
+				if !isSOA {
+					return nil, errors.New("transfer doesn't start with an SOA record")
+				}
+				serial = soa.Serial
+			}
+			if len(records) == 1 {
+				incremental = isSOA && soa.Serial != serial
+			}
+
+			records = append(records, record)
+			if isSOA && soa.Serial == serial {
+				serialCount++
+			}
+		}
+
+		if len(records) == 0 {
+			return nil, errors.New("empty transfer")
+		}
+		// The SOA record alone only says that we are up to date when it
+		// has our serial. Otherwise the changes follow in other messages.
+		if len(records) == 1 && qtype == dns.IXFR && !serialLess(current.SOA().Serial, serial) {
+			return records, nil
+		}
+		if serialCount == 2 && !incremental || serialCount == 3 {
+			return records, nil
+		}
+	}
+}
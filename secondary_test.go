@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// fakePrimary serves zone transfers on a local TCP port, answering each
+// query with the messages returned by answer. The connection is left open
+// afterwards, so that clients have to tell on their own where a transfer
+// ends.
+func fakePrimary(t *testing.T, answer func(request *dns.DnsPacket) [][]dns.DnsRecord) net.TCPAddr {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					reqBuffer, err := dns.ReadTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					request, err := dns.DnsPacketFromBuffer(reqBuffer)
+					if err != nil {
+						return
+					}
+
+					for _, records := range answer(&request) {
+						packet := transferResponse(&request)
+						packet.Answers = records
+						buffer := dns.NewBytePacketBufferWithSize(dns.MaxPacketSize)
+						err := packet.Write(buffer)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						err = dns.WriteTCPMessage(conn, buffer)
+						if err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+
+	return *listener.Addr().(*net.TCPAddr)
+}
+
+// inMessages splits records into messages of at most size records.
+func inMessages(records []dns.DnsRecord, size int) [][]dns.DnsRecord {
+	var messages [][]dns.DnsRecord
+	for len(records) > size {
+		messages = append(messages, records[:size])
+		records = records[size:]
+	}
+	return append(messages, records)
+}
+
+// sameZone reports whether two zones hold the same records.
+func sameZone(a *zone, b *zone) bool {
+	return strings.Join(sortedKeys(a.Records()), "") == strings.Join(sortedKeys(b.Records()), "")
+}
+
+func TestIncrementalRoundTrip(t *testing.T) {
+	zones := transferTestZones(t)
+
+	for _, serial := range []uint32{1, 2} {
+		records := transferRecords(zones[2], transferRequest(dns.IXFR, &serial))
+		diffs, err := parseIncremental(records)
+		if err != nil {
+			t.Fatalf("parseIncremental from %d: %v", serial, err)
+		}
+		if len(diffs) != int(3-serial) {
+			t.Errorf("parsed %d diffs from serial %d", len(diffs), serial)
+		}
+
+		zoneRecords := zones[serial-1].Records()
+		for _, diff := range diffs {
+			zoneRecords = applyDiff(zoneRecords, diff)
+		}
+		z, err := newZone("example.com", zoneRecords)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameZone(z, zones[2]) || z.SOA() != zones[2].SOA() {
+			t.Errorf("changes from serial %d don't reproduce the zone of the primary", serial)
+		}
+	}
+}
+
+func TestParseIncrementalMalformed(t *testing.T) {
+	soa := transferTestSOA
+	www := addressRecord("www.example.com", "192.0.2.1")
+
+	tests := []struct {
+		name    string
+		records []dns.DnsRecord
+	}{
+		{"no changes", []dns.DnsRecord{soa(3), soa(3)}},
+		{"record before the first SOA", []dns.DnsRecord{soa(3), www, soa(2), soa(3), soa(3)}},
+		{"change without the new SOA", []dns.DnsRecord{soa(3), soa(2), www, soa(3)}},
+		{"old SOA alone", []dns.DnsRecord{soa(3), soa(2), soa(3)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseIncremental(test.records)
+			if err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestSecondaryTransfer(t *testing.T) {
+	zones := transferTestZones(t)
+
+	tests := []struct {
+		name    string
+		current int
+		qtype   dns.QueryType
+		answer  func(request *dns.DnsPacket) [][]dns.DnsRecord
+		want    int
+		wantErr bool
+	}{
+		{"AXFR", -1, dns.AXFR, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+			return inMessages(transferRecords(zones[2], request), 2)
+		}, 2, false},
+		{"IXFR", 0, dns.IXFR, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+			return inMessages(transferRecords(zones[2], request), 3)
+		}, 2, false},
+		{"IXFR record by record", 1, dns.IXFR, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+			return inMessages(transferRecords(zones[2], request), 1)
+		}, 2, false},
+		{"IXFR answered with the whole zone", 0, dns.IXFR, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+			return inMessages(transferRecords(zones[2], transferRequest(dns.AXFR, nil)), 2)
+		}, 2, false},
+		{"IXFR when up to date", 2, dns.IXFR, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+			return [][]dns.DnsRecord{{zones[2].SOA()}}
+		}, 2, false},
+		{"IXFR answered with the SOA of a newer version alone", 0, dns.IXFR, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+			return [][]dns.DnsRecord{{zones[2].SOA()}}
+		}, 0, true},
+		{"IXFR with changes from another version", 0, dns.IXFR, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+			serial := uint32(2)
+			return [][]dns.DnsRecord{transferRecords(zones[2], transferRequest(dns.IXFR, &serial))}
+		}, 0, true},
+		{"transfer not starting with an SOA record", -1, dns.AXFR, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+			return [][]dns.DnsRecord{zones[2].Records()[1:]}
+		}, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			primary := fakePrimary(t, test.answer)
+			sz := &secondaryZone{Origin: "example.com", Primary: primary}
+			if test.current >= 0 {
+				sz.zone = zones[test.current]
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			z, err := sz.transfer(ctx, test.qtype)
+			if test.wantErr {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("transfer: %v", err)
+			}
+			if !sameZone(z, zones[test.want]) {
+				t.Errorf("transferred zone with serial %d, want the records of serial %d", z.SOA().Serial, zones[test.want].SOA().Serial)
+			}
+		})
+	}
+}
+
+func TestRequestTransferEnds(t *testing.T) {
+	zones := transferTestZones(t)
+	serial := zones[0].SOA().Serial
+
+	tests := []struct {
+		name    string
+		qtype   dns.QueryType
+		records func(request *dns.DnsPacket) []dns.DnsRecord
+		want    int
+	}{
+		{"AXFR ends at the second SOA", dns.AXFR, func(request *dns.DnsPacket) []dns.DnsRecord {
+			return transferRecords(zones[2], request)
+		}, len(zones[2].Records()) + 1},
+		{"IXFR ends at the third SOA of the new serial", dns.IXFR, func(request *dns.DnsPacket) []dns.DnsRecord {
+			return transferRecords(zones[2], request)
+		}, len(transferRecords(zones[2], transferRequest(dns.IXFR, &serial)))},
+		{"IXFR answered like AXFR ends at the second SOA", dns.IXFR, func(request *dns.DnsPacket) []dns.DnsRecord {
+			return transferRecords(zones[2], transferRequest(dns.AXFR, nil))
+		}, len(zones[2].Records()) + 1},
+		{"IXFR with the SOA alone", dns.IXFR, func(request *dns.DnsPacket) []dns.DnsRecord {
+			return []dns.DnsRecord{zones[0].SOA()}
+		}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Trailing records after the end of the transfer would only be
+			// read by a client that doesn't see where the transfer ends.
+			primary := fakePrimary(t, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+				records := test.records(request)
+				trailing := addressRecord("trailing.example.com", "192.0.2.99")
+				return append(inMessages(records, 2), []dns.DnsRecord{trailing})
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			records, err := requestTransfer(ctx, primary, "example.com", test.qtype, zones[0])
+			if err != nil {
+				t.Fatalf("requestTransfer: %v", err)
+			}
+			if len(records) != test.want {
+				t.Errorf("read %d records, want %d", len(records), test.want)
+			}
+		})
+	}
+}
+
+func TestRequestTransferIncomplete(t *testing.T) {
+	zones := transferTestZones(t)
+
+	// A lone SOA record is no complete AXFR, so the client keeps reading
+	// until the transfer times out.
+	primary := fakePrimary(t, func(request *dns.DnsPacket) [][]dns.DnsRecord {
+		return [][]dns.DnsRecord{{zones[2].SOA()}}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := requestTransfer(ctx, primary, "example.com", dns.AXFR, nil)
+	if err == nil {
+		t.Error("AXFR of a lone SOA record succeeded")
+	}
+}
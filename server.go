@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// queryJob is a single request waiting for a worker, along with the way to
+// send the response back to the client that asked.
+type queryJob struct {
+	reqBuffer *dns.BytePacketBuffer
+	client    net.IP
+	respond   func(request *dns.DnsPacket, response *dns.DnsPacket) error
+}
+
+// udpWriter is the write path to the UDP socket shared by all workers.
+type udpWriter struct {
+	mu     sync.Mutex
+	socket *net.UDPConn
+}
+
+// WriteResponse sends a response to a UDP client, truncating it to the size
+// the client can accept.
+func (w *udpWriter) WriteResponse(request *dns.DnsPacket, response *dns.DnsPacket, dst *net.UDPAddr) error {
+	resBuffer := dns.NewBytePacketBufferWithSize(udpResponseSize(request))
+	err := writeResponse(response, resBuffer)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err = w.socket.WriteToUDP(resBuffer.Buf[:resBuffer.Pos], dst)
+	return err
+}
+
+// tcpWriter is the write path to a client TCP connection, shared by the
+// workers answering the queries pipelined on it.
+type tcpWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// WriteResponse sends a length-prefixed response on the connection.
+func (w *tcpWriter) WriteResponse(response *dns.DnsPacket) error {
+	resBuffer := dns.NewBytePacketBufferWithSize(dns.MaxPacketSize)
+	err := writeResponse(response, resBuffer)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err = w.conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+	if err != nil {
+		return err
+	}
+
+	return dns.WriteTCPMessage(w.conn, resBuffer)
+}
+
+// startWorkers starts count workers answering the queries sent on jobs,
+// each of them within the given deadline.
+func startWorkers(count int, timeout time.Duration, jobs <-chan queryJob) {
+	for i := 0; i < count; i++ {
+		go func() {
+			for job := range jobs {
+				err := handleJob(job, timeout)
+				if err != nil {
+					fmt.Printf("An error occurred: %+v\n", err)
+				}
+			}
+		}()
+	}
+}
+
+// handleJob parses and answers a single query. Every job gets a response,
+// messages that can't be parsed a FORMERR one, so that TCP connections
+// waiting on their pending queries are released.
+func handleJob(job queryJob, timeout time.Duration) error {
+	request, err := dns.DnsPacketFromBuffer(job.reqBuffer)
+	if err != nil {
+		packet := malformedResponse(job.reqBuffer)
+		respondErr := job.respond(&packet, &packet)
+		if respondErr != nil {
+			return respondErr
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx = withClientAddr(ctx, job.client)
+
+	packet := buildResponse(ctx, &request)
+	return job.respond(&request, &packet)
+}
+
+// malformedResponse returns the FORMERR response to a message that couldn't
+// be parsed, carrying its ID when the message is long enough to have one.
+func malformedResponse(reqBuffer *dns.BytePacketBuffer) dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.Response = true
+	packet.Header.Rescode = dns.FORMERR
+
+	err := reqBuffer.Seek(0)
+	if err == nil {
+		id, err := reqBuffer.ReadU16()
+		if err == nil {
+			packet.Header.Id = id
+		}
+	}
+	return packet
+}
+
+// listenOn binds a UDP socket and a TCP listener on the address and starts
+// serving both. IPv4 and IPv6 addresses are bound to their own family only,
+// so that the same port can be used on an IPv4 and an IPv6 address at once.
+func listenOn(address string, jobs chan<- queryJob) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	family := ""
+	if udpAddr.IP != nil {
+		family = "4"
+		if udpAddr.IP.To4() == nil {
+			family = "6"
+		}
+	}
+
+	socket, err := net.ListenUDP("udp"+family, udpAddr)
+	if err != nil {
+		return err
+	}
+
+	// The TCP listener serves clients retrying truncated answers.
+	listener, err := net.Listen("tcp"+family, address)
+	if err != nil {
+		socket.Close()
+		return err
+	}
+
+	go serveUDP(socket, jobs)
+	go serveTCP(listener, jobs)
+	return nil
+}
+
+// serveUDP reads queries from the socket until it is closed.
+func serveUDP(socket *net.UDPConn, jobs chan<- queryJob) {
+	writer := &udpWriter{socket: socket}
+	for {
+		err := handleQuery(writer, jobs)
+		if err != nil {
+			fmt.Printf("An error occurred: %+v\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	}
+}
+
+// Handle a single incoming UDP packet by handing it to the worker pool.
+// This blocks while every worker is busy and the queue is full.
+func handleQuery(writer *udpWriter, jobs chan<- queryJob) error {
+	reqBuffer := dns.NewBytePacketBufferWithSize(ednsUDPSize)
+
+	n, src, err := writer.socket.ReadFromUDP(reqBuffer.Buf)
+	if err != nil {
+		return err
+	}
+	reqBuffer.Buf = reqBuffer.Buf[:n]
+
+	jobs <- queryJob{
+		reqBuffer: reqBuffer,
+		client:    src.IP,
+		respond: func(request *dns.DnsPacket, response *dns.DnsPacket) error {
+			return writer.WriteResponse(request, response, src)
+		},
+	}
+	return nil
+}
+
+// serveTCP accepts client connections and reads each of them on its own
+// goroutine.
+func serveTCP(listener net.Listener, jobs chan<- queryJob) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("Failed to accept TCP connection: %+v\n", err)
+			return
+		}
+
+		go func() {
+			err := handleTCPConn(conn, jobs)
+			if err != nil {
+				fmt.Printf("An error occurred: %+v\n", err)
+			}
+		}()
+	}
+}
+
+// Handle the queries sent over a single TCP connection until the client
+// closes it or stays idle for too long. Queries are answered by the worker
+// pool, so responses may come back in a different order than the requests.
+func handleTCPConn(conn net.Conn, jobs chan<- queryJob) error {
+	writer := &tcpWriter{conn: conn}
+
+	// The connection stays open until every pending query was answered.
+	var pending sync.WaitGroup
+	defer func() {
+		pending.Wait()
+		conn.Close()
+	}()
+
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if err != nil {
+			return err
+		}
+
+		reqBuffer, err := dns.ReadTCPMessage(conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		// Zone transfers are streamed from here rather than answered by a
+		// worker, as they may take many messages.
+		request, err := dns.DnsPacketFromBuffer(reqBuffer)
+		if err == nil && len(request.Questions) > 0 && isTransfer(request.Questions[0].Qtype) {
+			err := serveTransfer(writer, &request, addrIP(conn.RemoteAddr()))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = reqBuffer.Seek(0)
+		if err != nil {
+			return err
+		}
+
+		pending.Add(1)
+		jobs <- queryJob{
+			reqBuffer: reqBuffer,
+			client:    addrIP(conn.RemoteAddr()),
+			respond: func(request *dns.DnsPacket, response *dns.DnsPacket) error {
+				defer pending.Done()
+				return writer.WriteResponse(response)
+			},
+		}
+	}
+}
+
+// writeResponse writes the packet to the buffer. When the packet does not
+// fit, only the header and questions are written and the truncation flag is
+// set so that the client retries over TCP.
+func writeResponse(packet *dns.DnsPacket, buffer *dns.BytePacketBuffer) error {
+	err := packet.Write(buffer)
+	if !errors.Is(err, dns.ErrEndOfBuffer) {
+		return err
+	}
+
+	truncated := dns.NewDnsPacket()
+	truncated.Header = packet.Header
+	truncated.Header.TruncatedMessage = true
+	truncated.Questions = packet.Questions
+	if opt := packet.GetOPT(); opt != nil {
+		truncated.Resources = append(truncated.Resources, *opt)
+	}
+
+	err = buffer.Seek(0)
+	if err != nil {
+		return err
+	}
+
+	return truncated.Write(buffer)
+}
+
+// udpResponseSize returns the largest UDP response we may send for the
+// request, honoring the payload size the client advertised over EDNS.
+func udpResponseSize(request *dns.DnsPacket) int {
+	opt := request.GetOPT()
+	if opt == nil {
+		return dns.UDPPacketSize
+	}
+
+	size := int(opt.UDPPayloadSize)
+	if size < dns.UDPPacketSize {
+		size = dns.UDPPacketSize
+	}
+	if size > ednsUDPSize {
+		size = ednsUDPSize
+	}
+
+	return size
+}
+
+// buildResponse resolves the questions in the request and builds the
+// response packet. Requests other than queries are handed to their own
+// handlers, or refused with NOTIMP.
+func buildResponse(ctx context.Context, request *dns.DnsPacket) dns.DnsPacket {
+	switch request.Header.Opcode {
+	case dns.OpcodeQuery:
+	case dns.OpcodeNotify:
+		return answerNotify(ctx, request)
+	case dns.OpcodeUpdate:
+		return answerUpdate(ctx, request)
+	default:
+		packet := dns.NewDnsPacket()
+		packet.Header.Id = request.Header.Id
+		packet.Header.Opcode = request.Header.Opcode
+		packet.Header.Response = true
+		packet.Header.Rescode = dns.NOTIMP
+		return packet
+	}
+
+	packet := dns.NewDnsPacket()
+	packet.Header.Id = request.Header.Id
+	packet.Header.RecursionDesired = true
+	packet.Header.RecursionAvailable = true
+	packet.Header.Response = true
+	packet.Header.CheckingDisabled = request.Header.CheckingDisabled
+
+	reqOpt := request.GetOPT()
+	if reqOpt != nil && reqOpt.Version > dns.EDNS0Version {
+		opt := dns.NewOPTRecord(ednsUDPSize)
+		packet.Header.Rescode = dns.BADVERS
+		packet.Questions = append(packet.Questions, request.Questions...)
+		packet.Resources = append(packet.Resources, opt)
+		return packet
+	}
+
+	// DNSSEC records are only sent to clients that set the DO bit, and only
+	// those clients or the ones that set the AD bit learn which answers are
+	// secure (RFC 6840 section 5.8).
+	dnssecOK := reqOpt != nil && reqOpt.DnssecOK
+	if request.Header.CheckingDisabled {
+		ctx = withCheckingDisabled(ctx)
+	}
+
+	if len(request.Questions) > 0 {
+		question := request.Questions[0]
+		fmt.Printf("Received query: %+v\n", question)
+
+		// Names of the zones we serve are answered from them, all others
+		// are resolved recursively.
+		var result *dns.DnsPacket
+		var err error
+		if isTransfer(question.Qtype) {
+			answer := transferOverUDP(ctx, request)
+			result = &answer
+			packet.Header.AuthoritativeAnswer = answer.Header.AuthoritativeAnswer
+		} else if z := authZones.Find(question.Name, question.Qtype); z != nil {
+			answer := answerFromZone(z, question.Name, question.Qtype)
+			result = &answer
+			packet.Header.AuthoritativeAnswer = answer.Header.AuthoritativeAnswer
+		} else {
+			result, err = resolve(ctx, question.Name, dns.QueryTypeFromNum(question.Qtype))
+		}
+
+		if err == nil {
+			packet.Questions = append(packet.Questions, question)
+			packet.Header.Rescode = result.Header.Rescode
+
+			// The upper bits of an extended result code only fit in an OPT
+			// record, which clients without EDNS don't get (RFC 6891
+			// section 6.1.3).
+			if reqOpt == nil && packet.Header.Rescode > 0x0F {
+				packet.Header.Rescode = dns.SERVFAIL
+			}
+			packet.Header.AuthedData = result.Header.AuthedData && (dnssecOK || request.Header.AuthedData)
+
+			for _, rec := range result.Answers {
+				if !dnssecOK && isDNSSECRecord(rec, question.Qtype) {
+					continue
+				}
+				fmt.Printf("Answer: %+v\n", rec)
+				packet.Answers = append(packet.Answers, rec)
+			}
+			for _, rec := range result.Authorities {
+				if !dnssecOK && isDNSSECRecord(rec, question.Qtype) {
+					continue
+				}
+				fmt.Printf("Authority: %+v\n", rec)
+				packet.Authorities = append(packet.Authorities, rec)
+			}
+			for _, rec := range result.Resources {
+				// The upstream OPT record only describes that hop.
+				if _, ok := rec.(dns.OPTRecord); ok {
+					continue
+				}
+				if !dnssecOK && isDNSSECRecord(rec, question.Qtype) {
+					continue
+				}
+				fmt.Printf("Resource: %+v\n", rec)
+				packet.Resources = append(packet.Resources, rec)
+			}
+		} else {
+			fmt.Printf("Failed to resolve %s: %+v\n", question.Name, err)
+			packet.Header.Rescode = dns.SERVFAIL
+		}
+	} else {
+		packet.Header.Rescode = dns.SERVFAIL
+	}
+
+	// Clients that use EDNS get an OPT record back advertising our own
+	// buffer size.
+	if reqOpt != nil {
+		opt := dns.NewOPTRecord(ednsUDPSize)
+		opt.DnssecOK = dnssecOK
+		packet.Resources = append(packet.Resources, opt)
+	}
+
+	return packet
+}
+
+// isDNSSECRecord reports whether the record only exists to support DNSSEC
+// and wasn't explicitly asked for with qtype.
+func isDNSSECRecord(record dns.DnsRecord, qtype uint16) bool {
+	switch record.(type) {
+	case dns.RRSIGRecord, dns.NSECRecord, dns.NSEC3Record:
+		return dns.RecordType(record) != qtype
+	default:
+		return false
+	}
+}
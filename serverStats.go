@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// srttWeight is the weight given to the previous smoothed RTT when a new
+	// sample comes in, as in BIND.
+	srttWeight = 0.7
+
+	// unknownServerRTT bounds the random RTT assigned to servers we never
+	// talked to, so that they get tried early and measured.
+	unknownServerRTT = 32 * time.Millisecond
+
+	// maxServerRTT caps the penalty a failing server can accumulate, so that
+	// it eventually gets another chance.
+	maxServerRTT = 10 * time.Second
+
+	// exploreProbability is how often a server other than the best one is
+	// tried first, to refresh what we know about the others.
+	exploreProbability = 0.05
+
+	// serverStatsMaxAge is how long statistics are kept for a server that
+	// we stopped talking to.
+	serverStatsMaxAge = time.Hour
+)
+
+// serverStat is what we know about the responsiveness of one nameserver.
+type serverStat struct {
+	SRTT     time.Duration
+	Failures int
+	LastUsed time.Time
+}
+
+// serverStats tracks the smoothed RTT and failure count of every nameserver
+// we send queries to, and is safe for concurrent use.
+type serverStats struct {
+	mu      sync.Mutex
+	servers map[string]*serverStat
+
+	// preferIPv6 makes unknown IPv6 servers look faster than unknown IPv4
+	// ones, so that IPv6 is tried first until measurements say otherwise.
+	preferIPv6 bool
+}
+
+// nsStats is shared by all lookups.
+var nsStats = newServerStats()
+
+func newServerStats() *serverStats {
+	return &serverStats{
+		servers: make(map[string]*serverStat),
+	}
+}
+
+// get returns the statistics of a server, creating them if needed. New
+// entries count as used now, so that servers ranked but not queried yet
+// keep their random RTT until Prune finds them idle for long. The caller
+// must hold the lock.
+func (s *serverStats) get(ip net.IP) *serverStat {
+	stat, found := s.servers[ip.String()]
+	if !found {
+		stat = &serverStat{
+			SRTT:     time.Duration(rand.Int63n(int64(unknownServerRTT))),
+			LastUsed: time.Now(),
+		}
+		if (ip.To4() == nil) != s.preferIPv6 {
+			stat.SRTT += unknownServerRTT
+		}
+		s.servers[ip.String()] = stat
+	}
+	return stat
+}
+
+// RecordSuccess folds a new RTT sample into the smoothed RTT of the server
+// and clears its failures.
+func (s *serverStats) RecordSuccess(ip net.IP, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat := s.get(ip)
+	stat.SRTT = time.Duration(srttWeight*float64(stat.SRTT) + (1-srttWeight)*float64(rtt))
+	stat.Failures = 0
+	stat.LastUsed = time.Now()
+}
+
+// RecordFailure backs off from a server that didn't answer usefully by
+// doubling its smoothed RTT.
+func (s *serverStats) RecordFailure(ip net.IP, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat := s.get(ip)
+	stat.SRTT *= 2
+	if stat.SRTT < timeout {
+		stat.SRTT = timeout
+	}
+	if stat.SRTT > maxServerRTT {
+		stat.SRTT = maxServerRTT
+	}
+	stat.Failures++
+	stat.LastUsed = time.Now()
+}
+
+// Order returns the servers sorted from the most to the least responsive,
+// alternating between address families after the best one in the spirit of
+// Happy Eyeballs (RFC 8305), so that a broken IPv4 or IPv6 path costs at
+// most one attempt before the other family is tried. Once in a while
+// another server is moved to the front instead, so that we notice when a
+// server we've been avoiding gets better.
+func (s *serverStats) Order(servers []net.IP) []net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ordered := make([]net.IP, len(servers))
+	copy(ordered, servers)
+
+	score := func(ip net.IP) time.Duration {
+		stat := s.get(ip)
+		return stat.SRTT * time.Duration(1+stat.Failures)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return score(ordered[i]) < score(ordered[j])
+	})
+
+	if len(ordered) > 1 && rand.Float64() < exploreProbability {
+		i := 1 + rand.Intn(len(ordered)-1)
+		ordered[0], ordered[i] = ordered[i], ordered[0]
+	}
+
+	return interleaveFamilies(ordered)
+}
+
+// interleaveFamilies alternates IPv4 and IPv6 addresses, starting with the
+// family of the first one and keeping the order within each family.
+func interleaveFamilies(addrs []net.IP) []net.IP {
+	if len(addrs) == 0 {
+		return addrs
+	}
+
+	var first, second []net.IP
+	firstIsIPv4 := addrs[0].To4() != nil
+	for _, addr := range addrs {
+		if (addr.To4() != nil) == firstIsIPv4 {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+
+	interleaved := make([]net.IP, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
+
+// Prune forgets about servers that haven't been used in a while.
+func (s *serverStats) Prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ip, stat := range s.servers {
+		if time.Since(stat.LastUsed) > serverStatsMaxAge {
+			delete(s.servers, ip)
+		}
+	}
+}
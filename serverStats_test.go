@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerStatsPruneKeepsUnqueriedServers(t *testing.T) {
+	s := newServerStats()
+	servers := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	s.Order(servers)
+
+	before := make(map[string]time.Duration)
+	for ip, stat := range s.servers {
+		before[ip] = stat.SRTT
+	}
+
+	s.Prune()
+	s.Order(servers)
+	for ip, srtt := range before {
+		stat, found := s.servers[ip]
+		if !found {
+			t.Fatalf("%s was pruned right after being ranked", ip)
+		}
+		if stat.SRTT != srtt {
+			t.Errorf("SRTT of %s changed from %v to %v without being queried", ip, srtt, stat.SRTT)
+		}
+	}
+}
+
+func TestServerStatsPruneForgetsIdleServers(t *testing.T) {
+	s := newServerStats()
+	ip := net.ParseIP("192.0.2.1")
+	s.RecordSuccess(ip, 10*time.Millisecond)
+	s.servers[ip.String()].LastUsed = time.Now().Add(-2 * serverStatsMaxAge)
+
+	s.Prune()
+	if _, found := s.servers[ip.String()]; found {
+		t.Error("idle server was not pruned")
+	}
+}
+
+func TestServerStatsOrder(t *testing.T) {
+	s := newServerStats()
+	fast := net.ParseIP("192.0.2.1")
+	slow := net.ParseIP("192.0.2.2")
+	failing := net.ParseIP("192.0.2.3")
+	s.RecordSuccess(fast, 5*time.Millisecond)
+	s.RecordSuccess(slow, 500*time.Millisecond)
+	s.RecordFailure(failing, time.Second)
+
+	// The best server comes first except when another one is explored.
+	firsts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		firsts[s.Order([]net.IP{failing, slow, fast})[0].String()]++
+	}
+	if firsts[fast.String()] < 800 {
+		t.Errorf("fastest server came first %d times out of 1000", firsts[fast.String()])
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("192.0.2.3"),
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+
+	got := interleaveFamilies(addrs)
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("interleaveFamilies = %v, want %v", got, want)
+		}
+	}
+}
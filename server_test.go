@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// fakeWorker answers the jobs in place of the worker pool, with as many
+// addresses as count for the name asked about, and reports the requests it
+// answered on seen.
+func fakeWorker(jobs <-chan queryJob, count int, seen chan<- *dns.DnsPacket) {
+	for job := range jobs {
+		request, err := dns.DnsPacketFromBuffer(job.reqBuffer)
+		if err != nil {
+			continue
+		}
+
+		response := addressResponse(&request, count)
+		err = job.respond(&request, &response)
+		if err != nil {
+			fmt.Printf("fake worker: %+v\n", err)
+		}
+		if seen != nil {
+			seen <- &request
+		}
+	}
+}
+
+// addressResponse answers the request with count addresses.
+func addressResponse(request *dns.DnsPacket, count int) dns.DnsPacket {
+	response := dns.NewDnsPacket()
+	response.Header.Id = request.Header.Id
+	response.Header.Response = true
+	response.Questions = request.Questions
+	for i := 0; i < count; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		response.Answers = append(response.Answers, addressRecord(request.Questions[0].Name, addr))
+	}
+	if opt := request.GetOPT(); opt != nil {
+		response.Resources = append(response.Resources, dns.NewOPTRecord(ednsUDPSize))
+	}
+	return response
+}
+
+// tcpTestConn connects to a TCP connection handled by handleTCPConn, whose
+// result is sent on done once it returns.
+func tcpTestConn(t *testing.T, jobs chan<- queryJob) (*net.TCPConn, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- handleTCPConn(conn, jobs)
+	}()
+	return client.(*net.TCPConn), done
+}
+
+// tcpFrame returns a query for name as sent over TCP, preceded by its
+// length.
+func tcpFrame(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	packet := dns.NewDnsPacket()
+	packet.Header.Id = id
+	packet.Questions = append(packet.Questions, dns.NewDnsQuestion(name, dns.A.ToNum()))
+
+	buffer := dns.NewBytePacketBuffer()
+	err := packet.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := binary.BigEndian.AppendUint16(nil, uint16(buffer.Pos))
+	return append(frame, buffer.Buf[:buffer.Pos]...)
+}
+
+// readTCPResponse reads a response from the connection, checking that its
+// length prefix covers the whole message.
+func readTCPResponse(t *testing.T, conn net.Conn) dns.DnsPacket {
+	t.Helper()
+	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prefix [2]byte
+	_, err = io.ReadFull(conn, prefix[:])
+	if err != nil {
+		t.Fatalf("reading the length prefix: %v", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		t.Fatalf("reading a message of %d bytes: %v", len(data), err)
+	}
+
+	response, err := dns.DnsPacketFromBuffer(dns.NewBytePacketBufferFromBytes(data))
+	if err != nil {
+		t.Fatalf("parsing a message of %d bytes: %v", len(data), err)
+	}
+	return response
+}
+
+// awaitDone waits for handleTCPConn to return.
+func awaitDone(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still handled after the client closed it")
+		return nil
+	}
+}
+
+func TestTCPFraming(t *testing.T) {
+	jobs := make(chan queryJob)
+	go fakeWorker(jobs, 2, nil)
+	defer close(jobs)
+	client, done := tcpTestConn(t, jobs)
+
+	_, err := client.Write(tcpFrame(t, 1, "www.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := readTCPResponse(t, client)
+	if response.Header.Id != 1 || len(response.Answers) != 2 {
+		t.Errorf("response = %+v, want two answers to query 1", response)
+	}
+
+	// The client is done once it closed its side between messages.
+	err = client.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := awaitDone(t, done); err != nil {
+		t.Errorf("handleTCPConn = %v, want nil", err)
+	}
+}
+
+func TestTCPPipelinedQueries(t *testing.T) {
+	jobs := make(chan queryJob)
+	go fakeWorker(jobs, 1, nil)
+	go fakeWorker(jobs, 1, nil)
+	defer close(jobs)
+	client, done := tcpTestConn(t, jobs)
+
+	// The queries are all sent at once, and closing our side right away
+	// must not lose the responses still pending.
+	var frames []byte
+	for id := uint16(1); id <= 5; id++ {
+		frames = append(frames, tcpFrame(t, id, fmt.Sprintf("host%d.example.com", id))...)
+	}
+	_, err := client.Write(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int
+	for i := 0; i < 5; i++ {
+		response := readTCPResponse(t, client)
+		want := fmt.Sprintf("host%d.example.com", response.Header.Id)
+		if len(response.Questions) != 1 || response.Questions[0].Name != want {
+			t.Errorf("response %d answers %+v, want %s", response.Header.Id, response.Questions, want)
+		}
+		ids = append(ids, int(response.Header.Id))
+	}
+	sort.Ints(ids)
+	if fmt.Sprint(ids) != "[1 2 3 4 5]" {
+		t.Errorf("response ids = %v, want one for each query", ids)
+	}
+
+	if err := awaitDone(t, done); err != nil {
+		t.Errorf("handleTCPConn = %v, want nil", err)
+	}
+}
+
+func TestTCPShortReads(t *testing.T) {
+	jobs := make(chan queryJob)
+	go fakeWorker(jobs, 1, nil)
+	defer close(jobs)
+	client, _ := tcpTestConn(t, jobs)
+
+	// The message arrives in pieces, splitting both the length prefix and
+	// the message itself.
+	frame := tcpFrame(t, 7, "www.example.com")
+	for _, piece := range [][]byte{frame[:1], frame[1:5], frame[5:9], frame[9:]} {
+		_, err := client.Write(piece)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	response := readTCPResponse(t, client)
+	if response.Header.Id != 7 || len(response.Answers) != 1 {
+		t.Errorf("response = %+v, want an answer to query 7", response)
+	}
+}
+
+func TestTCPEOFWithinMessage(t *testing.T) {
+	frame := tcpFrame(t, 7, "www.example.com")
+
+	tests := []struct {
+		name string
+		sent []byte
+	}{
+		{"within the length prefix", frame[:1]},
+		{"after the length prefix", frame[:2]},
+		{"within the message", frame[:len(frame)-1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jobs := make(chan queryJob, 1)
+			client, done := tcpTestConn(t, jobs)
+
+			_, err := client.Write(test.sent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.CloseWrite()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = awaitDone(t, done)
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("handleTCPConn = %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+			if len(jobs) != 0 {
+				t.Error("the partial message was handed to a worker")
+			}
+		})
+	}
+}
+
+func TestWriteResponseTruncation(t *testing.T) {
+	request := dns.NewDnsPacket()
+	request.Header.Id = 99
+	request.Questions = append(request.Questions, dns.NewDnsQuestion("www.example.com", dns.A.ToNum()))
+
+	tests := []struct {
+		name          string
+		count         int
+		opt           bool
+		wantTruncated bool
+	}{
+		{"response that fits", 10, false, false},
+		{"response too large", 100, false, true},
+		{"response too large with OPT", 100, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := request
+			request.Resources = nil
+			if test.opt {
+				request.Resources = append(request.Resources, dns.NewOPTRecord(dns.UDPPacketSize))
+			}
+			response := addressResponse(&request, test.count)
+
+			buffer := dns.NewBytePacketBufferWithSize(udpResponseSize(&request))
+			err := writeResponse(&response, buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			read, err := dns.DnsPacketFromBuffer(dns.NewBytePacketBufferFromBytes(buffer.Buf[:buffer.Pos]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.Header.TruncatedMessage != test.wantTruncated {
+				t.Errorf("TC = %v, want %v", read.Header.TruncatedMessage, test.wantTruncated)
+			}
+			if read.Header.Id != 99 || len(read.Questions) != 1 {
+				t.Errorf("response = %+v, want one answering the question of query 99", read)
+			}
+
+			wantAnswers := test.count
+			if test.wantTruncated {
+				wantAnswers = 0
+			}
+			if len(read.Answers) != wantAnswers {
+				t.Errorf("%d answers, want %d", len(read.Answers), wantAnswers)
+			}
+			if (read.GetOPT() != nil) != test.opt {
+				t.Errorf("OPT = %+v, want one only when the client sent one", read.GetOPT())
+			}
+		})
+	}
+}
+
+// listenTestServer binds a UDP socket and a TCP listener on the same port
+// of the loopback address and serves both.
+func listenTestServer(t *testing.T, jobs chan<- queryJob) net.UDPAddr {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := *socket.LocalAddr().(*net.UDPAddr)
+
+		listener, err := net.Listen("tcp4", addr.String())
+		if err != nil {
+			socket.Close()
+			continue
+		}
+		t.Cleanup(func() {
+			socket.Close()
+			listener.Close()
+		})
+
+		go serveUDP(socket, jobs)
+		go serveTCP(listener, jobs)
+		return addr
+	}
+
+	t.Fatal("no port free for both UDP and TCP")
+	return net.UDPAddr{}
+}
+
+func TestTruncatedUDPFallsBackToTCP(t *testing.T) {
+	jobs := make(chan queryJob)
+	seen := make(chan *dns.DnsPacket, 10)
+	go fakeWorker(jobs, 200, seen)
+	server := listenTestServer(t, jobs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	response, err := lookup(ctx, "www.example.com", dns.A, server)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+
+	if response.Header.TruncatedMessage || len(response.Answers) != 200 {
+		t.Errorf("TC = %v with %d answers, want the whole answer", response.Header.TruncatedMessage, len(response.Answers))
+	}
+
+	// The worker reports a query once it was answered, which may be after
+	// the client got the answer.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-seen:
+		case <-time.After(time.Second):
+			t.Fatalf("server got %d queries, want one over UDP and one over TCP", i)
+		}
+	}
+}
+
+func TestBuildResponseExtendedRcode(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream dns.ResultCode
+		opt      bool
+		want     dns.ResultCode
+	}{
+		{"NXDOMAIN without OPT", dns.NXDOMAIN, false, dns.NXDOMAIN},
+		{"NXDOMAIN with OPT", dns.NXDOMAIN, true, dns.NXDOMAIN},
+		{"extended rcode with OPT", dns.BADVERS, true, dns.BADVERS},
+		{"extended rcode without OPT", dns.BADVERS, false, dns.SERVFAIL},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useFakeNetwork(t, &fakeNetwork{
+				root: func(question dns.DnsQuestion) (dns.DnsPacket, error) {
+					response := fakeNoData("")
+					response.Header.Rescode = test.upstream
+					return response, nil
+				},
+			})
+
+			request := dns.NewDnsPacket()
+			request.Header.Id = 5
+			request.Questions = append(request.Questions, dns.NewDnsQuestion("www.example.com", dns.A.ToNum()))
+			if test.opt {
+				request.Resources = append(request.Resources, dns.NewOPTRecord(dns.UDPPacketSize))
+			}
+
+			response := buildResponse(context.Background(), &request)
+			if response.Header.Rescode != test.want {
+				t.Fatalf("rescode = %v, want %v", response.Header.Rescode, test.want)
+			}
+
+			// What the client reads back off the wire is what we meant.
+			buffer := dns.NewBytePacketBuffer()
+			err := writeResponse(&response, buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := dns.DnsPacketFromBuffer(dns.NewBytePacketBufferFromBytes(buffer.Buf[:buffer.Pos]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.Header.Rescode != test.want {
+				t.Errorf("rescode on the wire = %v, want %v", read.Header.Rescode, test.want)
+			}
+		})
+	}
+}
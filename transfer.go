@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/guoard/godns/dns"
+)
+
+// transferMessageSize is the size at which the records of a zone transfer
+// are split into another message, well below the 64KiB limit of a TCP
+// message.
+const transferMessageSize = 16 * 1024
+
+// transferACL lists the clients allowed to transfer the zones we serve.
+var transferACL addressList
+
+// isTransfer reports whether a query type asks for a zone transfer.
+func isTransfer(qtype uint16) bool {
+	return qtype == dns.AXFR.ToNum() || qtype == dns.IXFR.ToNum()
+}
+
+// transferZone returns the zone a transfer query asks for, or the result
+// code to refuse it with.
+func transferZone(question dns.DnsQuestion, client net.IP) (*zone, dns.ResultCode) {
+	if !transferACL.Contains(client) {
+		return nil, dns.REFUSED
+	}
+
+	z, found := authZones.Get(strings.ToLower(strings.TrimSuffix(question.Name, ".")))
+	if !found {
+		return nil, dns.REFUSED
+	}
+	if !z.Loaded() {
+		return nil, dns.SERVFAIL
+	}
+	return z, dns.NOERROR
+}
+
+// transferResponse returns an empty response to a transfer query, which
+// each message of the transfer starts from.
+func transferResponse(request *dns.DnsPacket) dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.Id = request.Header.Id
+	packet.Header.Response = true
+	packet.Header.AuthoritativeAnswer = true
+	packet.Questions = append(packet.Questions, request.Questions[0])
+	return packet
+}
+
+// serveTransfer answers an AXFR or IXFR query received over TCP, sending
+// the records in as many messages as needed (RFC 5936 section 2.2).
+func serveTransfer(writer *tcpWriter, request *dns.DnsPacket, client net.IP) error {
+	question := request.Questions[0]
+	z, rescode := transferZone(question, client)
+	if rescode != dns.NOERROR {
+		fmt.Printf("Refused transfer of %s to %s\n", question.Name, client)
+		packet := transferResponse(request)
+		packet.Header.AuthoritativeAnswer = false
+		packet.Header.Rescode = rescode
+		return writer.WriteResponse(&packet)
+	}
+
+	records := transferRecords(z, request)
+	fmt.Printf("Transferring zone %s to %s in %d records\n", z.Origin, client, len(records))
+
+	packet := transferResponse(request)
+	size := 0
+	buffer := dns.NewBytePacketBufferWithSize(dns.MaxPacketSize)
+	for _, record := range records {
+		buffer.Pos = 0
+		n, err := dns.WriteDnsRecord(record, buffer)
+		if err != nil {
+			return err
+		}
+
+		if size+n > transferMessageSize && len(packet.Answers) > 0 {
+			err := writer.WriteResponse(&packet)
+			if err != nil {
+				return err
+			}
+			packet = transferResponse(request)
+			size = 0
+		}
+
+		packet.Answers = append(packet.Answers, record)
+		size += n
+	}
+
+	return writer.WriteResponse(&packet)
+}
+
+// transferRecords returns the records sent in answer to a transfer query.
+// AXFR gets the whole zone bracketed by its SOA record. IXFR gets the
+// changes since the serial of the SOA record the client sent along, each of
+// them as the old SOA record and the deleted records followed by the new
+// SOA record and the added records, or the whole zone when the journal
+// doesn't go back that far (RFC 1995 section 4).
+func transferRecords(z *zone, request *dns.DnsPacket) []dns.DnsRecord {
+	soa := z.SOA()
+
+	if request.Questions[0].Qtype == dns.IXFR.ToNum() {
+		clientSOA := request.GetSOA()
+		if clientSOA != nil {
+			if !serialLess(clientSOA.Serial, soa.Serial) {
+				return []dns.DnsRecord{soa}
+			}
+
+			diffs, found := z.journalSince(clientSOA.Serial)
+			if found {
+				records := []dns.DnsRecord{soa}
+				for _, diff := range diffs {
+					records = append(records, diff.From)
+					records = append(records, diff.Deleted...)
+					records = append(records, diff.To)
+					records = append(records, diff.Added...)
+				}
+				return append(records, soa)
+			}
+		}
+	}
+
+	records := append([]dns.DnsRecord(nil), z.Records()...)
+	return append(records, soa)
+}
+
+// transferOverUDP answers a transfer query received over UDP. AXFR is only
+// defined over TCP, and IXFR is answered with the current SOA record only,
+// which tells the client whether to retry over TCP (RFC 1995 section 2).
+func transferOverUDP(ctx context.Context, request *dns.DnsPacket) dns.DnsPacket {
+	packet := transferResponse(request)
+
+	question := request.Questions[0]
+	z, rescode := transferZone(question, clientAddr(ctx))
+	if rescode != dns.NOERROR {
+		fmt.Printf("Refused transfer of %s to %s\n", question.Name, clientAddr(ctx))
+		packet.Header.AuthoritativeAnswer = false
+		packet.Header.Rescode = rescode
+		return packet
+	}
+
+	if question.Qtype == dns.AXFR.ToNum() {
+		packet.Header.Rescode = dns.FORMERR
+		return packet
+	}
+
+	packet.Answers = append(packet.Answers, z.SOA())
+	return packet
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/guoard/godns/dns"
+)
+
+func transferTestSOA(serial uint32) dns.SOARecord {
+	return dns.SOARecord{Domain: "example.com", MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: serial, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300, TTL: 3600}
+}
+
+// transferTestZones returns three versions of a zone, each with the changes
+// since the one before in its journal.
+func transferTestZones(t *testing.T) []*zone {
+	t.Helper()
+	base := []dns.DnsRecord{
+		dns.NSRecord{Domain: "example.com", Host: "ns1.example.com", TTL: 3600},
+		addressRecord("ns1.example.com", "192.0.2.1"),
+	}
+	versions := [][]dns.DnsRecord{
+		{transferTestSOA(1), addressRecord("www.example.com", "192.0.2.10"), addressRecord("old.example.com", "192.0.2.11")},
+		{transferTestSOA(2), addressRecord("www.example.com", "192.0.2.20"), addressRecord("old.example.com", "192.0.2.11"), addressRecord("mail.example.com", "192.0.2.25")},
+		{transferTestSOA(3), addressRecord("www.example.com", "192.0.2.20"), addressRecord("mail.example.com", "192.0.2.25")},
+	}
+
+	var zones []*zone
+	for _, records := range versions {
+		z, err := newZone("example.com", append(records, base...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zones) > 0 {
+			z.withJournal(zones[len(zones)-1])
+		}
+		zones = append(zones, z)
+	}
+	return zones
+}
+
+// transferRequest builds an AXFR query, or an IXFR query carrying the SOA
+// record of the client when serial isn't nil.
+func transferRequest(qtype dns.QueryType, serial *uint32) *dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Questions = append(packet.Questions, dns.NewDnsQuestion("example.com", qtype.ToNum()))
+	if serial != nil {
+		packet.Authorities = append(packet.Authorities, transferTestSOA(*serial))
+	}
+	return &packet
+}
+
+// transferSummary writes SOA records as their serial and other records as
+// their owner and address, which shows the layout of a transfer.
+func transferSummary(records []dns.DnsRecord) string {
+	var summary []string
+	for _, record := range records {
+		switch r := record.(type) {
+		case dns.SOARecord:
+			summary = append(summary, fmt.Sprint(r.Serial))
+		case dns.ARecord:
+			summary = append(summary, strings.TrimSuffix(r.Domain, ".example.com")+"="+r.Addr.String())
+		case dns.NSRecord:
+			summary = append(summary, "NS")
+		}
+	}
+	return strings.Join(summary, " ")
+}
+
+// sortedKeys returns the wire form of the records in a fixed order, for
+// comparing sets of records.
+func sortedKeys(records []dns.DnsRecord) []string {
+	keys := recordKeys(records)
+	sort.Strings(keys)
+	return keys
+}
+
+func TestTransferRecords(t *testing.T) {
+	zones := transferTestZones(t)
+	current := zones[2]
+	serial := func(serial uint32) *uint32 { return &serial }
+	axfr := "3 NS mail=192.0.2.25 ns1=192.0.2.1 www=192.0.2.20 3"
+
+	tests := []struct {
+		name    string
+		request *dns.DnsPacket
+		want    string
+	}{
+		{"AXFR", transferRequest(dns.AXFR, nil), axfr},
+		{"IXFR from the previous version", transferRequest(dns.IXFR, serial(2)),
+			"3 2 old=192.0.2.11 3 3"},
+		{"IXFR from two versions back", transferRequest(dns.IXFR, serial(1)),
+			"3 1 www=192.0.2.10 2 mail=192.0.2.25 www=192.0.2.20 2 old=192.0.2.11 3 3"},
+		{"IXFR from the current version", transferRequest(dns.IXFR, serial(3)), "3"},
+		{"IXFR from a newer version", transferRequest(dns.IXFR, serial(4)), "3"},
+		{"IXFR from a version missing from the journal", transferRequest(dns.IXFR, serial(0)), axfr},
+		{"IXFR without the SOA of the client", transferRequest(dns.IXFR, nil), axfr},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records := transferRecords(current, test.request)
+			if got := transferSummary(records); got != test.want {
+				t.Errorf("transfer = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAXFRHoldsTheZone(t *testing.T) {
+	z := transferTestZones(t)[2]
+	records := transferRecords(z, transferRequest(dns.AXFR, nil))
+
+	first, firstOK := records[0].(dns.SOARecord)
+	last, lastOK := records[len(records)-1].(dns.SOARecord)
+	if !firstOK || !lastOK || first != z.SOA() || last != z.SOA() {
+		t.Fatalf("transfer starts with %+v and ends with %+v, want the SOA record", records[0], records[len(records)-1])
+	}
+	for _, record := range records[1 : len(records)-1] {
+		if _, ok := record.(dns.SOARecord); ok {
+			t.Errorf("SOA record in the middle of the transfer")
+		}
+	}
+	if got, want := sortedKeys(records[:len(records)-1]), sortedKeys(z.Records()); strings.Join(got, "") != strings.Join(want, "") {
+		t.Error("transfer doesn't hold the records of the zone")
+	}
+}
+
+func TestJournalLimit(t *testing.T) {
+	var previous *zone
+	for serial := uint32(1); serial <= maxJournalDiffs+2; serial++ {
+		z, err := newZone("example.com", []dns.DnsRecord{
+			transferTestSOA(serial),
+			dns.NSRecord{Domain: "example.com", Host: "ns1.example.com", TTL: 3600},
+			dns.ARecord{Domain: "www.example.com", Addr: net.IPv4(192, 0, 2, byte(serial)).To4(), TTL: 300},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.withJournal(previous)
+		previous = z
+	}
+
+	if len(previous.journal) != maxJournalDiffs {
+		t.Errorf("journal holds %d diffs, want %d", len(previous.journal), maxJournalDiffs)
+	}
+	if _, found := previous.journalSince(1); found {
+		t.Error("journal still goes back to the first version")
+	}
+	diffs, found := previous.journalSince(2)
+	if !found || len(diffs) != maxJournalDiffs {
+		t.Errorf("journalSince(2) = %d diffs, %v", len(diffs), found)
+	}
+
+	// A secondary lagging too far behind gets the whole zone.
+	serial := uint32(1)
+	records := transferRecords(previous, transferRequest(dns.IXFR, &serial))
+	if len(records) != len(previous.Records())+1 {
+		t.Errorf("IXFR from a forgotten version sent %d records, want the whole zone", len(records))
+	}
+}
+
+func TestJournalIgnoresOlderVersions(t *testing.T) {
+	zones := transferTestZones(t)
+	older, err := newZone("example.com", zones[0].Records())
+	if err != nil {
+		t.Fatal(err)
+	}
+	older.withJournal(zones[2])
+	if len(older.journal) != 0 {
+		t.Errorf("journal of an older version holds %d diffs", len(older.journal))
+	}
+}
+
+func TestDiffZonesRoundTrip(t *testing.T) {
+	zones := transferTestZones(t)
+
+	tests := []struct {
+		name string
+		from *zone
+		to   *zone
+	}{
+		{"forward", zones[0], zones[1]},
+		{"two versions at once", zones[0], zones[2]},
+		{"backward", zones[2], zones[0]},
+		{"no change", zones[1], zones[1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := diffZones(test.from, test.to)
+			for _, record := range append(append([]dns.DnsRecord(nil), diff.Deleted...), diff.Added...) {
+				if _, ok := record.(dns.SOARecord); ok {
+					t.Error("diff holds an SOA record")
+				}
+			}
+
+			applied := applyDiff(test.from.Records(), diff)
+			if applied[0] != dns.DnsRecord(test.to.SOA()) {
+				t.Errorf("first record = %+v, want the new SOA record", applied[0])
+			}
+			if got, want := sortedKeys(applied), sortedKeys(test.to.Records()); strings.Join(got, "") != strings.Join(want, "") {
+				t.Errorf("applying the diff gave %q, want %q", transferSummary(applied), transferSummary(test.to.Records()))
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+const (
+	// addHoldDown is how long a new root key has to be seen before it is
+	// trusted (RFC 5011 section 2.4.1).
+	addHoldDown = 30 * 24 * time.Hour
+
+	// removeHoldDown is how long a revoked root key is remembered before it
+	// is forgotten (RFC 5011 section 2.4.2).
+	removeHoldDown = 30 * 24 * time.Hour
+
+	// anchorRefreshInterval is how often the root DNSKEY set is fetched to
+	// follow key rollovers.
+	anchorRefreshInterval = 12 * time.Hour
+)
+
+// anchorState is where a root key is in the life cycle of RFC 5011 section
+// 4.
+type anchorState int
+
+const (
+	anchorAddPend anchorState = iota
+	anchorValid
+	anchorMissing
+	anchorRevoked
+)
+
+// anchorStateNames are the names of the states in the state file.
+var anchorStateNames = map[anchorState]string{
+	anchorAddPend: "ADDPEND",
+	anchorValid:   "VALID",
+	anchorMissing: "MISSING",
+	anchorRevoked: "REVOKED",
+}
+
+// trustAnchor is a root key we trust or may come to trust. Anchors given as
+// DS records only learn their key once it shows up in the root DNSKEY set.
+type trustAnchor struct {
+	DS      dns.DSRecord
+	Key     *dns.DNSKEYRecord
+	State   anchorState
+	Changed time.Time
+}
+
+// matches reports whether the key is the one of the anchor, whether it is
+// revoked or not.
+func (a *trustAnchor) matches(key dns.DNSKEYRecord) bool {
+	if a.Key == nil {
+		key.Flags &^= dns.DNSKEYFlagRevoke
+		return dns.MatchesDS(a.DS, key)
+	}
+
+	return a.Key.Algorithm == key.Algorithm && a.Key.Protocol == key.Protocol &&
+		a.Key.Flags&^dns.DNSKEYFlagRevoke == key.Flags&^dns.DNSKEYFlagRevoke &&
+		bytes.Equal(a.Key.PublicKey, key.PublicKey)
+}
+
+// trustAnchorStore holds the root trust anchors and follows them through
+// key rollovers, saving their states to a file when one is configured so
+// that hold-down timers survive restarts. It is safe for concurrent use.
+type trustAnchorStore struct {
+	mu        sync.Mutex
+	anchors   []*trustAnchor
+	statePath string
+}
+
+// rootAnchors holds the trust anchors the root DNSKEY set is checked against.
+var rootAnchors = &trustAnchorStore{}
+
+// loadTrustAnchorStore builds the trust anchor store from the state file if
+// there is one already, or else from the trust anchor file or the DS records
+// given on the command line.
+func loadTrustAnchorStore(anchorPath string, statePath string, value string) (*trustAnchorStore, error) {
+	store := &trustAnchorStore{statePath: statePath}
+
+	if statePath != "" {
+		anchors, err := readTrustAnchorFile(statePath)
+		if err == nil {
+			store.anchors = anchors
+			return store, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	if anchorPath != "" {
+		anchors, err := readTrustAnchorFile(anchorPath)
+		if err != nil {
+			return nil, err
+		}
+		store.anchors = anchors
+	} else {
+		dsRecords, err := parseTrustAnchors(value)
+		if err != nil {
+			return nil, err
+		}
+		for _, ds := range dsRecords {
+			store.anchors = append(store.anchors, &trustAnchor{DS: ds, State: anchorValid, Changed: time.Now()})
+		}
+	}
+
+	if statePath != "" {
+		err := store.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// DSRecords returns the DS records of the anchors currently trusted. Keys
+// that went missing from the root DNSKEY set stay trusted until they are
+// revoked.
+func (s *trustAnchorStore) DSRecords() []dns.DSRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dsRecords []dns.DSRecord
+	for _, anchor := range s.anchors {
+		if anchor.State == anchorValid || anchor.State == anchorMissing {
+			dsRecords = append(dsRecords, anchor.DS)
+		}
+	}
+	return dsRecords
+}
+
+// Observe moves the anchors through their RFC 5011 states according to a
+// root DNSKEY set, given with its signatures, that was just validated with
+// the anchors currently trusted.
+func (s *trustAnchorStore) Observe(records []dns.DnsRecord, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keySet []dns.DnsRecord
+	var keys []dns.DNSKEYRecord
+	for _, record := range records {
+		key, ok := record.(dns.DNSKEYRecord)
+		if !ok || key.Domain != "" {
+			continue
+		}
+
+		keySet = append(keySet, key)
+		if key.Flags&dns.DNSKEYFlagSEP != 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	changed := false
+	seen := make(map[*trustAnchor]bool)
+	for _, key := range keys {
+		var anchor *trustAnchor
+		for _, candidate := range s.anchors {
+			if candidate.matches(key) {
+				anchor = candidate
+				break
+			}
+		}
+
+		// A revocation only counts when the revoked key signed it itself.
+		if key.Flags&dns.DNSKEYFlagRevoke != 0 {
+			if anchor != nil {
+				seen[anchor] = true
+				if anchor.State != anchorRevoked && signedBy(key, keySet, records, now) {
+					fmt.Printf("Root key %d was revoked\n", anchor.DS.KeyTag)
+					anchor.State, anchor.Changed = anchorRevoked, now
+					changed = true
+				}
+			}
+			continue
+		}
+
+		if anchor == nil {
+			digest, err := dns.DSDigest(key, dns.DigestSHA256)
+			if err != nil {
+				continue
+			}
+
+			ds := dns.DSRecord{Domain: "", KeyTag: dns.KeyTag(key), Algorithm: key.Algorithm, DigestType: dns.DigestSHA256, Digest: digest}
+			anchor = &trustAnchor{DS: ds, State: anchorAddPend, Changed: now}
+			s.anchors = append(s.anchors, anchor)
+			fmt.Printf("New root key %d, trusting it after %v\n", ds.KeyTag, addHoldDown)
+			changed = true
+		}
+		if anchor.Key == nil {
+			learned := key
+			anchor.Key = &learned
+			changed = true
+		}
+		seen[anchor] = true
+
+		switch {
+		case anchor.State == anchorAddPend && now.Sub(anchor.Changed) >= addHoldDown:
+			fmt.Printf("Root key %d is now trusted\n", anchor.DS.KeyTag)
+			anchor.State, anchor.Changed = anchorValid, now
+			changed = true
+		case anchor.State == anchorMissing:
+			anchor.State, anchor.Changed = anchorValid, now
+			changed = true
+		}
+	}
+
+	var kept []*trustAnchor
+	for _, anchor := range s.anchors {
+		if !seen[anchor] {
+			switch {
+			case anchor.State == anchorAddPend:
+				changed = true
+				continue
+			case anchor.State == anchorValid:
+				anchor.State, anchor.Changed = anchorMissing, now
+				changed = true
+			case anchor.State == anchorRevoked && now.Sub(anchor.Changed) >= removeHoldDown:
+				changed = true
+				continue
+			}
+		}
+		kept = append(kept, anchor)
+	}
+	s.anchors = kept
+
+	if changed && s.statePath != "" {
+		err := s.save()
+		if err != nil {
+			fmt.Printf("Failed to save trust anchor state: %+v\n", err)
+		}
+	}
+}
+
+// save writes the anchors and their states to the state file, replacing it
+// at once so that a crash never leaves it half written. The caller must
+// hold the lock.
+func (s *trustAnchorStore) save() error {
+	var buffer bytes.Buffer
+	buffer.WriteString("; Root trust anchors and their RFC 5011 states\n")
+	for _, anchor := range s.anchors {
+		if anchor.Key != nil {
+			fmt.Fprintf(&buffer, ". DNSKEY %d %d %d %s", anchor.Key.Flags, anchor.Key.Protocol, anchor.Key.Algorithm, base64.StdEncoding.EncodeToString(anchor.Key.PublicKey))
+		} else {
+			fmt.Fprintf(&buffer, ". DS %d %d %d %s", anchor.DS.KeyTag, anchor.DS.Algorithm, anchor.DS.DigestType, strings.ToUpper(hex.EncodeToString(anchor.DS.Digest)))
+		}
+		fmt.Fprintf(&buffer, " ; state=%s changed=%d\n", anchorStateNames[anchor.State], anchor.Changed.Unix())
+	}
+
+	tmpPath := s.statePath + ".tmp"
+	err := os.WriteFile(tmpPath, buffer.Bytes(), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.statePath)
+}
+
+// readTrustAnchorFile reads root DS or DNSKEY records in presentation
+// format, one per line. A state written by save in the comment after a
+// record is restored, and records without one are trusted.
+func readTrustAnchorFile(path string) ([]*trustAnchor, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var anchors []*trustAnchor
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, comment, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		anchor, err := parseTrustAnchorRecord(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		anchor.Changed = time.Now()
+
+		for _, field := range strings.Fields(comment) {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "state":
+				found := false
+				for state, name := range anchorStateNames {
+					if name == value {
+						anchor.State, found = state, true
+					}
+				}
+				if !found {
+					return nil, fmt.Errorf("%s:%d: unknown state %q", path, lineNum, value)
+				}
+			case "changed":
+				seconds, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: malformed time %q", path, lineNum, value)
+				}
+				anchor.Changed = time.Unix(seconds, 0)
+			}
+		}
+
+		anchors = append(anchors, anchor)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("%s: no trust anchors found", path)
+	}
+	return anchors, nil
+}
+
+// parseTrustAnchorRecord parses the fields of a root DS or DNSKEY record in
+// presentation format, where the TTL and class are optional.
+func parseTrustAnchorRecord(fields []string) (*trustAnchor, error) {
+	if fields[0] != "." {
+		return nil, fmt.Errorf("trust anchor for %s instead of the root", fields[0])
+	}
+
+	rest := fields[1:]
+	if len(rest) > 0 {
+		_, err := strconv.ParseUint(rest[0], 10, 32)
+		if err == nil {
+			rest = rest[1:]
+		}
+	}
+	if len(rest) > 0 && strings.EqualFold(rest[0], "IN") {
+		rest = rest[1:]
+	}
+	if len(rest) < 5 {
+		return nil, errors.New("malformed record")
+	}
+
+	// The key tag of a DS record and the flags of a DNSKEY record take 16
+	// bits, the fields after them 8 bits each.
+	var numbers [3]uint64
+	for i, bits := range []int{16, 8, 8} {
+		number, err := strconv.ParseUint(rest[i+1], 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("malformed record: %w", err)
+		}
+		numbers[i] = number
+	}
+	data := strings.Join(rest[4:], "")
+
+	switch strings.ToUpper(rest[0]) {
+	case "DS":
+		digest, err := hex.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("malformed DS digest: %w", err)
+		}
+		if !dns.SupportedDigest(uint8(numbers[2])) {
+			return nil, fmt.Errorf("unsupported DS digest type %d", numbers[2])
+		}
+
+		ds := dns.DSRecord{Domain: "", KeyTag: uint16(numbers[0]), Algorithm: uint8(numbers[1]), DigestType: uint8(numbers[2]), Digest: digest}
+		return &trustAnchor{DS: ds, State: anchorValid}, nil
+
+	case "DNSKEY":
+		publicKey, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("malformed DNSKEY public key: %w", err)
+		}
+
+		key := dns.DNSKEYRecord{Domain: "", Flags: uint16(numbers[0]), Protocol: uint8(numbers[1]), Algorithm: uint8(numbers[2]), PublicKey: publicKey}
+		if key.Flags&dns.DNSKEYFlagZone == 0 || key.Protocol != 3 {
+			return nil, errors.New("DNSKEY is not a zone key")
+		}
+
+		digest, err := dns.DSDigest(key, dns.DigestSHA256)
+		if err != nil {
+			return nil, err
+		}
+		ds := dns.DSRecord{Domain: "", KeyTag: dns.KeyTag(key), Algorithm: key.Algorithm, DigestType: dns.DigestSHA256, Digest: digest}
+		return &trustAnchor{DS: ds, Key: &key, State: anchorValid}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported trust anchor type %s", rest[0])
+	}
+}
+
+// signedBy reports whether one of the signatures among records over the
+// DNSKEY set was made by the key.
+func signedBy(key dns.DNSKEYRecord, keySet []dns.DnsRecord, records []dns.DnsRecord, now time.Time) bool {
+	for _, record := range records {
+		sig, ok := record.(dns.RRSIGRecord)
+		if !ok || sig.TypeCovered != dns.DNSKEY.ToNum() || !dns.SignatureValidAt(sig, now) {
+			continue
+		}
+
+		err := dns.VerifyRRSIG(sig, key, keySet)
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// maintainTrustAnchors fetches the root DNSKEY set at regular intervals, so
+// that its validation keeps the trust anchors in step with key rollovers.
+func maintainTrustAnchors() {
+	for {
+		time.Sleep(anchorRefreshInterval)
+
+		ctx, cancel := context.WithTimeout(context.Background(), primingTimeout)
+		_, err := recursiveLookup(ctx, "", dns.DNSKEY)
+		cancel()
+
+		if err != nil {
+			fmt.Printf("Failed to refresh the root DNSKEY set: %+v\n", err)
+		}
+	}
+}
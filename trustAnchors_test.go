@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// rootKey is a root key signing key the tests sign the DNSKEY set with.
+type rootKey struct {
+	record  dns.DNSKEYRecord
+	private ed25519.PrivateKey
+}
+
+func newRootKey(t *testing.T) rootKey {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := dns.DNSKEYRecord{
+		Domain:    "",
+		Flags:     dns.DNSKEYFlagZone | dns.DNSKEYFlagSEP,
+		Protocol:  3,
+		Algorithm: dns.AlgorithmED25519,
+		PublicKey: public,
+		TTL:       172800,
+	}
+	return rootKey{record: record, private: private}
+}
+
+// revoked returns the key with its REVOKE bit set.
+func (k rootKey) revoked() rootKey {
+	k.record.Flags |= dns.DNSKEYFlagRevoke
+	return k
+}
+
+// anchor returns a trusted anchor for the key given as a DS record, the way
+// anchors from the command line start out.
+func (k rootKey) anchor(t *testing.T, changed time.Time) *trustAnchor {
+	t.Helper()
+
+	digest, err := dns.DSDigest(k.record, dns.DigestSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := dns.DSRecord{Domain: "", KeyTag: dns.KeyTag(k.record), Algorithm: k.record.Algorithm, DigestType: dns.DigestSHA256, Digest: digest}
+	return &trustAnchor{DS: ds, State: anchorValid, Changed: changed}
+}
+
+// keySetResponse returns the DNSKEY set made of keys along with a signature
+// over it by each of signers, valid at now.
+func keySetResponse(t *testing.T, now time.Time, keys []rootKey, signers ...rootKey) []dns.DnsRecord {
+	t.Helper()
+
+	var records []dns.DnsRecord
+	for _, key := range keys {
+		records = append(records, key.record)
+	}
+
+	var sigs []dns.DnsRecord
+	for _, signer := range signers {
+		sig := dns.RRSIGRecord{
+			Domain:      "",
+			TypeCovered: dns.DNSKEY.ToNum(),
+			Algorithm:   signer.record.Algorithm,
+			Labels:      0,
+			OriginalTTL: 172800,
+			Expiration:  uint32(now.Add(time.Hour).Unix()),
+			Inception:   uint32(now.Add(-time.Hour).Unix()),
+			KeyTag:      dns.KeyTag(signer.record),
+			SignerName:  "",
+			TTL:         172800,
+		}
+		sig.Signature = ed25519.Sign(signer.private, keySetSignedData(t, sig, records))
+		sigs = append(sigs, sig)
+	}
+	return append(records, sigs...)
+}
+
+// keySetSignedData builds the data an RRSIG over the root DNSKEY set covers
+// (RFC 4034 section 3.1.8.1).
+func keySetSignedData(t *testing.T, sig dns.RRSIGRecord, keySet []dns.DnsRecord) []byte {
+	t.Helper()
+
+	// The root name takes one byte, and the RRSIG RDATA without the
+	// signature follows the ten bytes of type, class, TTL and length.
+	var data []byte
+	buffer := dns.NewBytePacketBufferWithSize(dns.MaxPacketSize)
+	_, err := dns.WriteDnsRecord(sig, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, buffer.Buf[11:buffer.Pos]...)
+
+	var rdatas [][]byte
+	for _, record := range keySet {
+		buffer := dns.NewBytePacketBufferWithSize(dns.MaxPacketSize)
+		_, err := dns.WriteDnsRecord(dns.WithTTL(record, sig.OriginalTTL), buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdatas = append(rdatas, buffer.Buf[:buffer.Pos])
+	}
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i][11:], rdatas[j][11:]) < 0
+	})
+
+	for _, rdata := range rdatas {
+		data = append(data, rdata...)
+	}
+	return data
+}
+
+// anchorStates returns the state of each anchor by the key tag of its DS
+// record.
+func anchorStates(store *trustAnchorStore) map[uint16]string {
+	states := make(map[uint16]string)
+	for _, anchor := range store.anchors {
+		states[anchor.DS.KeyTag] = anchorStateNames[anchor.State]
+	}
+	return states
+}
+
+func trustedKeyTags(store *trustAnchorStore) []uint16 {
+	var tags []uint16
+	for _, ds := range store.DSRecords() {
+		tags = append(tags, ds.KeyTag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+func sortedTags(tags ...uint16) []uint16 {
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+func TestTrustAnchorAddHoldDown(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	oldKey, newKey := newRootKey(t), newRootKey(t)
+	oldTag, newTag := dns.KeyTag(oldKey.record), dns.KeyTag(newKey.record)
+	store := &trustAnchorStore{anchors: []*trustAnchor{oldKey.anchor(t, start)}}
+
+	keys := []rootKey{oldKey, newKey}
+	steps := []struct {
+		after time.Duration
+		want  string
+	}{
+		{0, "ADDPEND"},
+		{addHoldDown / 2, "ADDPEND"},
+		{addHoldDown - time.Second, "ADDPEND"},
+		{addHoldDown, "VALID"},
+		{addHoldDown + anchorRefreshInterval, "VALID"},
+	}
+
+	for _, step := range steps {
+		now := start.Add(step.after)
+		store.Observe(keySetResponse(t, now, keys, oldKey, newKey), now)
+
+		states := anchorStates(store)
+		if states[newTag] != step.want {
+			t.Errorf("after %v: new key is %s, want %s", step.after, states[newTag], step.want)
+		}
+		if states[oldTag] != "VALID" {
+			t.Errorf("after %v: old key is %s, want VALID", step.after, states[oldTag])
+		}
+
+		want := sortedTags(oldTag)
+		if step.want == "VALID" {
+			want = sortedTags(oldTag, newTag)
+		}
+		if got := trustedKeyTags(store); !reflect.DeepEqual(got, want) {
+			t.Errorf("after %v: trusted keys = %v, want %v", step.after, got, want)
+		}
+	}
+}
+
+func TestTrustAnchorAddPendDropped(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	oldKey, newKey := newRootKey(t), newRootKey(t)
+	oldTag, newTag := dns.KeyTag(oldKey.record), dns.KeyTag(newKey.record)
+	store := &trustAnchorStore{anchors: []*trustAnchor{oldKey.anchor(t, start)}}
+
+	store.Observe(keySetResponse(t, start, []rootKey{oldKey, newKey}, oldKey), start)
+	if states := anchorStates(store); states[newTag] != "ADDPEND" {
+		t.Fatalf("new key is %q, want ADDPEND", states[newTag])
+	}
+
+	now := start.Add(anchorRefreshInterval)
+	store.Observe(keySetResponse(t, now, []rootKey{oldKey}, oldKey), now)
+	want := map[uint16]string{oldTag: "VALID"}
+	if states := anchorStates(store); !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+
+	// Coming back restarts the hold-down timer.
+	now = start.Add(addHoldDown)
+	store.Observe(keySetResponse(t, now, []rootKey{oldKey, newKey}, oldKey), now)
+	if states := anchorStates(store); states[newTag] != "ADDPEND" {
+		t.Errorf("new key is %q after coming back, want ADDPEND", states[newTag])
+	}
+}
+
+func TestTrustAnchorMissing(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	key, otherKey := newRootKey(t), newRootKey(t)
+	tag := dns.KeyTag(key.record)
+	store := &trustAnchorStore{anchors: []*trustAnchor{key.anchor(t, start), otherKey.anchor(t, start)}}
+
+	store.Observe(keySetResponse(t, start, []rootKey{key, otherKey}, key), start)
+
+	now := start.Add(anchorRefreshInterval)
+	store.Observe(keySetResponse(t, now, []rootKey{otherKey}, otherKey), now)
+	if states := anchorStates(store); states[tag] != "MISSING" {
+		t.Fatalf("key is %q after leaving the key set, want MISSING", states[tag])
+	}
+	if got, want := trustedKeyTags(store), sortedTags(tag, dns.KeyTag(otherKey.record)); !reflect.DeepEqual(got, want) {
+		t.Errorf("trusted keys = %v, want %v while missing", got, want)
+	}
+
+	now = now.Add(anchorRefreshInterval)
+	store.Observe(keySetResponse(t, now, []rootKey{key, otherKey}, otherKey), now)
+	if states := anchorStates(store); states[tag] != "VALID" {
+		t.Errorf("key is %q after coming back, want VALID", states[tag])
+	}
+}
+
+func TestTrustAnchorRevoke(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	key, otherKey := newRootKey(t), newRootKey(t)
+	tag, otherTag := dns.KeyTag(key.record), dns.KeyTag(otherKey.record)
+	revoked := key.revoked()
+	store := &trustAnchorStore{anchors: []*trustAnchor{key.anchor(t, start), otherKey.anchor(t, start)}}
+
+	store.Observe(keySetResponse(t, start, []rootKey{revoked, otherKey}, revoked, otherKey), start)
+	if states := anchorStates(store); states[tag] != "REVOKED" {
+		t.Fatalf("key is %q after a self-signed revocation, want REVOKED", states[tag])
+	}
+	if got, want := trustedKeyTags(store), sortedTags(otherTag); !reflect.DeepEqual(got, want) {
+		t.Errorf("trusted keys = %v, want %v", got, want)
+	}
+
+	steps := []struct {
+		after time.Duration
+		want  map[uint16]string
+	}{
+		{anchorRefreshInterval, map[uint16]string{tag: "REVOKED", otherTag: "VALID"}},
+		{removeHoldDown - time.Second, map[uint16]string{tag: "REVOKED", otherTag: "VALID"}},
+		{removeHoldDown, map[uint16]string{otherTag: "VALID"}},
+	}
+	for _, step := range steps {
+		now := start.Add(step.after)
+		store.Observe(keySetResponse(t, now, []rootKey{otherKey}, otherKey), now)
+		if states := anchorStates(store); !reflect.DeepEqual(states, step.want) {
+			t.Errorf("after %v: states = %v, want %v", step.after, states, step.want)
+		}
+	}
+}
+
+func TestTrustAnchorRevokeNotSelfSigned(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	key, otherKey := newRootKey(t), newRootKey(t)
+	tag := dns.KeyTag(key.record)
+	revoked := key.revoked()
+
+	tests := []struct {
+		name    string
+		records func(now time.Time) []dns.DnsRecord
+	}{
+		{"signed by another key", func(now time.Time) []dns.DnsRecord {
+			return keySetResponse(t, now, []rootKey{revoked, otherKey}, otherKey)
+		}},
+		{"signed with the key before it was revoked", func(now time.Time) []dns.DnsRecord {
+			return keySetResponse(t, now, []rootKey{revoked, otherKey}, key, otherKey)
+		}},
+		{"signature expired", func(now time.Time) []dns.DnsRecord {
+			return keySetResponse(t, now.Add(-24*time.Hour), []rootKey{revoked, otherKey}, revoked, otherKey)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &trustAnchorStore{anchors: []*trustAnchor{key.anchor(t, start), otherKey.anchor(t, start)}}
+			store.Observe(test.records(start), start)
+
+			if states := anchorStates(store); states[tag] != "VALID" {
+				t.Errorf("key is %q, want VALID", states[tag])
+			}
+		})
+	}
+}
+
+func TestTrustAnchorStateFile(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	key, newKey, revokedKey, absentKey := newRootKey(t), newRootKey(t), newRootKey(t), newRootKey(t)
+	statePath := filepath.Join(t.TempDir(), "root.state")
+	store := &trustAnchorStore{
+		anchors:   []*trustAnchor{key.anchor(t, start), revokedKey.anchor(t, start), absentKey.anchor(t, start)},
+		statePath: statePath,
+	}
+
+	// The absent key was never seen, so it is only known by its DS record.
+	absent := store.anchors[2]
+	absent.State = anchorMissing
+
+	now := start.Add(time.Hour)
+	revoked := revokedKey.revoked()
+	store.Observe(keySetResponse(t, now, []rootKey{key, newKey, revoked}, key, revoked), now)
+
+	want := map[uint16]string{
+		dns.KeyTag(key.record):        "VALID",
+		dns.KeyTag(newKey.record):     "ADDPEND",
+		dns.KeyTag(revokedKey.record): "REVOKED",
+		dns.KeyTag(absentKey.record):  "MISSING",
+	}
+	if states := anchorStates(store); !reflect.DeepEqual(states, want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+
+	anchors, err := readTrustAnchorFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anchors) != len(store.anchors) {
+		t.Fatalf("read %d anchors, want %d", len(anchors), len(store.anchors))
+	}
+
+	for i, got := range anchors {
+		saved := store.anchors[i]
+		if got.State != saved.State || !got.Changed.Equal(saved.Changed) {
+			t.Errorf("anchor %d: read %s changed %v, want %s changed %v", saved.DS.KeyTag, anchorStateNames[got.State], got.Changed, anchorStateNames[saved.State], saved.Changed)
+		}
+		if !reflect.DeepEqual(got.DS, saved.DS) {
+			t.Errorf("anchor %d: read DS %+v, want %+v", saved.DS.KeyTag, got.DS, saved.DS)
+		}
+
+		switch {
+		case saved.Key == nil && got.Key != nil:
+			t.Errorf("anchor %d: read a key that was never learned", saved.DS.KeyTag)
+		case saved.Key != nil && (got.Key == nil || !got.matches(*saved.Key)):
+			t.Errorf("anchor %d: read key %+v, want %+v", saved.DS.KeyTag, got.Key, saved.Key)
+		}
+	}
+
+	// A store loaded from the state file carries on from where it was.
+	loaded, err := loadTrustAnchorStore("", statePath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(addHoldDown)
+	loaded.Observe(keySetResponse(t, now, []rootKey{key, newKey}, key), now)
+	if states := anchorStates(loaded); states[dns.KeyTag(newKey.record)] != "VALID" {
+		t.Errorf("new key is %q after the hold-down across a restart, want VALID", states[dns.KeyTag(newKey.record)])
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/guoard/godns/dns"
+)
+
+// updateACL lists the clients allowed to change the zones we serve with
+// UPDATE messages.
+var updateACL addressList
+
+// updateMu serializes UPDATE messages, each of them building the next
+// version of a zone from the current one.
+var updateMu sync.Mutex
+
+// rrsetKey identifies an RRset by owner name and type.
+type rrsetKey struct {
+	Name string
+	Type uint16
+}
+
+// answerUpdate handles an UPDATE message for one of the zones we serve as a
+// primary (RFC 2136 section 3). The zone, prerequisite and update sections
+// of the message are read from its question, answer and authority sections.
+func answerUpdate(ctx context.Context, request *dns.DnsPacket) dns.DnsPacket {
+	packet := dns.NewDnsPacket()
+	packet.Header.Id = request.Header.Id
+	packet.Header.Opcode = dns.OpcodeUpdate
+	packet.Header.Response = true
+	packet.Questions = append(packet.Questions, request.Questions...)
+
+	packet.Header.Rescode = applyUpdate(ctx, request)
+	return packet
+}
+
+// applyUpdate checks the prerequisites of an UPDATE message and, when they
+// hold, stores the version of the zone with its updates applied and the
+// serial increased. Secondaries then get the changes with IXFR.
+func applyUpdate(ctx context.Context, request *dns.DnsPacket) dns.ResultCode {
+	if len(request.Questions) != 1 || request.Questions[0].Qtype != dns.SOA.ToNum() {
+		return dns.FORMERR
+	}
+
+	origin := strings.ToLower(strings.TrimSuffix(request.Questions[0].Name, "."))
+	client := clientAddr(ctx)
+	if !updateACL.Contains(client) {
+		fmt.Printf("Refused UPDATE of %s from %s\n", origin, client)
+		return dns.REFUSED
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	// Secondary zones are changed on their primary, which we don't forward
+	// UPDATE messages to.
+	z, found := authZones.Get(origin)
+	if _, secondary := secondaries[origin]; !found || secondary {
+		fmt.Printf("Refused UPDATE of %s from %s, not a zone we are the primary of\n", origin, client)
+		return dns.NOTAUTH
+	}
+	if !z.Loaded() {
+		return dns.SERVFAIL
+	}
+
+	rescode := checkPrerequisites(z, request.Answers)
+	if rescode != dns.NOERROR {
+		return rescode
+	}
+
+	rescode = checkUpdates(z, request.Authorities)
+	if rescode != dns.NOERROR {
+		return rescode
+	}
+
+	update := newZoneUpdate(z)
+	for _, record := range request.Authorities {
+		update.Apply(record)
+	}
+	if !update.changed {
+		return dns.NOERROR
+	}
+
+	updated, err := newZone(origin, update.Records(z.SOA().Serial))
+	if err != nil {
+		fmt.Printf("Failed to update zone %s: %+v\n", origin, err)
+		return dns.SERVFAIL
+	}
+
+	authZones.Store(updated)
+	fmt.Printf("Updated zone %s to serial %d for %s\n", origin, updated.SOA().Serial, client)
+	return dns.NOERROR
+}
+
+// checkPrerequisites tests the prerequisites of an UPDATE message against
+// the zone (RFC 2136 section 3.2). Records of class ANY and NONE ask for a
+// name or RRset to exist or not, and records of class IN for an RRset to
+// hold exactly these records.
+func checkPrerequisites(z *zone, prereqs []dns.DnsRecord) dns.ResultCode {
+	expected := make(map[rrsetKey][]dns.DnsRecord)
+	for _, record := range prereqs {
+		name := dns.RecordDomain(record)
+		qtype := dns.RecordType(record)
+		if !dns.IsSubdomain(name, z.Origin) {
+			return dns.NOTZONE
+		}
+		if dns.RecordTTL(record) != 0 {
+			return dns.FORMERR
+		}
+
+		node := z.Node(name)
+		inUse := node != nil && len(node.RRsets) > 0
+		exists := node != nil && len(node.RRsets[qtype]) > 0
+
+		prereq, ok := record.(dns.UpdateRecord)
+		if !ok {
+			if isMetaType(qtype) {
+				return dns.FORMERR
+			}
+			key := rrsetKey{Name: name, Type: qtype}
+			expected[key] = append(expected[key], record)
+			continue
+		}
+		if prereq.Record != nil {
+			return dns.FORMERR
+		}
+
+		switch {
+		case prereq.Class == dns.ClassANY && qtype == dns.TypeANY:
+			if !inUse {
+				return dns.NXDOMAIN
+			}
+		case prereq.Class == dns.ClassANY:
+			if !exists {
+				return dns.NXRRSET
+			}
+		case prereq.Class == dns.ClassNONE && qtype == dns.TypeANY:
+			if inUse {
+				return dns.YXDOMAIN
+			}
+		case prereq.Class == dns.ClassNONE:
+			if exists {
+				return dns.YXRRSET
+			}
+		default:
+			return dns.FORMERR
+		}
+	}
+
+	for key, records := range expected {
+		var rrset []dns.DnsRecord
+		node := z.Node(key.Name)
+		if node != nil {
+			rrset = node.RRsets[key.Type]
+		}
+		if !sameRecords(rrset, records) {
+			return dns.NXRRSET
+		}
+	}
+	return dns.NOERROR
+}
+
+// checkUpdates looks for malformed records in the update section of an
+// UPDATE message before any of them is applied (RFC 2136 section 3.4.1).
+func checkUpdates(z *zone, updates []dns.DnsRecord) dns.ResultCode {
+	for _, record := range updates {
+		qtype := dns.RecordType(record)
+		if !dns.IsSubdomain(dns.RecordDomain(record), z.Origin) {
+			return dns.NOTZONE
+		}
+
+		update, ok := record.(dns.UpdateRecord)
+		switch {
+		case !ok:
+			if isMetaType(qtype) {
+				return dns.FORMERR
+			}
+		case update.Class == dns.ClassANY:
+			if update.TTL != 0 || update.Record != nil || isMetaType(qtype) && qtype != dns.TypeANY {
+				return dns.FORMERR
+			}
+		case update.Class == dns.ClassNONE:
+			if update.TTL != 0 || update.Record == nil || isMetaType(qtype) {
+				return dns.FORMERR
+			}
+		default:
+			return dns.FORMERR
+		}
+	}
+	return dns.NOERROR
+}
+
+// isMetaType reports whether a type only has a meaning in queries or
+// messages and can't be stored in a zone.
+func isMetaType(qtype uint16) bool {
+	return qtype == dns.OPT.ToNum() || qtype >= 128 && qtype <= 255
+}
+
+// sameRecords reports whether two lists hold the same records, ignoring
+// their TTL and order.
+func sameRecords(a []dns.DnsRecord, b []dns.DnsRecord) bool {
+	var records []dns.DnsRecord
+	for _, record := range append(append([]dns.DnsRecord(nil), a...), b...) {
+		records = append(records, dns.WithTTL(record, 0))
+	}
+	keys := recordKeys(records)
+
+	inA := make(map[string]bool, len(a))
+	for _, key := range keys[:len(a)] {
+		inA[key] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, key := range keys[len(a):] {
+		if !inA[key] {
+			return false
+		}
+		inB[key] = true
+	}
+	return len(inA) == len(inB)
+}
+
+// findRecord returns the index of the record in rrset, ignoring TTLs, or -1
+// when it isn't there.
+func findRecord(rrset []dns.DnsRecord, record dns.DnsRecord) int {
+	var records []dns.DnsRecord
+	for _, r := range append(append([]dns.DnsRecord(nil), rrset...), record) {
+		records = append(records, dns.WithTTL(r, 0))
+	}
+	keys := recordKeys(records)
+
+	for i, key := range keys[:len(rrset)] {
+		if key == keys[len(rrset)] {
+			return i
+		}
+	}
+	return -1
+}
+
+// zoneUpdate is the next version of a zone, built from the current one by
+// the update section of an UPDATE message.
+type zoneUpdate struct {
+	origin  string
+	rrsets  map[rrsetKey][]dns.DnsRecord
+	changed bool
+}
+
+func newZoneUpdate(z *zone) *zoneUpdate {
+	update := &zoneUpdate{
+		origin: z.Origin,
+		rrsets: make(map[rrsetKey][]dns.DnsRecord),
+	}
+	for _, record := range z.Records() {
+		key := rrsetKey{Name: dns.RecordDomain(record), Type: dns.RecordType(record)}
+		update.rrsets[key] = append(update.rrsets[key], record)
+	}
+	return update
+}
+
+// Apply applies a record of the update section (RFC 2136 section 3.4.2).
+// Records of class IN are added, records of class ANY delete a name or an
+// RRset and records of class NONE delete a single record. The SOA and NS
+// records of the apex are kept, and updates that would put a CNAME record
+// next to other data are ignored.
+func (u *zoneUpdate) Apply(record dns.DnsRecord) {
+	name := dns.RecordDomain(record)
+	qtype := dns.RecordType(record)
+	atApex := name == u.origin
+
+	update, ok := record.(dns.UpdateRecord)
+	switch {
+	case !ok:
+		u.add(record)
+
+	case update.Class == dns.ClassANY && qtype == dns.TypeANY:
+		for key := range u.rrsets {
+			if key.Name != name || atApex && (key.Type == dns.SOA.ToNum() || key.Type == dns.NS.ToNum()) {
+				continue
+			}
+			delete(u.rrsets, key)
+			u.changed = true
+		}
+
+	case update.Class == dns.ClassANY:
+		if atApex && (qtype == dns.SOA.ToNum() || qtype == dns.NS.ToNum()) {
+			return
+		}
+		key := rrsetKey{Name: name, Type: qtype}
+		if len(u.rrsets[key]) > 0 {
+			delete(u.rrsets, key)
+			u.changed = true
+		}
+
+	case update.Class == dns.ClassNONE:
+		key := rrsetKey{Name: name, Type: qtype}
+		rrset := u.rrsets[key]
+		if qtype == dns.SOA.ToNum() || atApex && qtype == dns.NS.ToNum() && len(rrset) == 1 {
+			return
+		}
+
+		i := findRecord(rrset, update.Record)
+		if i < 0 {
+			return
+		}
+		u.rrsets[key] = append(append([]dns.DnsRecord(nil), rrset[:i]...), rrset[i+1:]...)
+		u.changed = true
+	}
+}
+
+// add adds a record to the zone, or replaces the same record when it is
+// already there with another TTL. A CNAME record replaces the one at its
+// name and an SOA record only replaces the one of the apex when its serial
+// is larger.
+func (u *zoneUpdate) add(record dns.DnsRecord) {
+	name := dns.RecordDomain(record)
+	qtype := dns.RecordType(record)
+	key := rrsetKey{Name: name, Type: qtype}
+
+	switch record := record.(type) {
+	case dns.SOARecord:
+		current := u.rrsets[key]
+		if name != u.origin || len(current) == 0 || !serialLess(current[0].(dns.SOARecord).Serial, record.Serial) {
+			return
+		}
+		u.rrsets[key] = []dns.DnsRecord{record}
+		u.changed = true
+		return
+
+	case dns.CNAMERecord:
+		for other, rrset := range u.rrsets {
+			if other.Name == name && other.Type != qtype && len(rrset) > 0 && !isCNAMECompanion(other.Type) {
+				return
+			}
+		}
+		if len(u.rrsets[key]) > 0 {
+			if findRecord(u.rrsets[key], record) >= 0 && dns.RecordTTL(u.rrsets[key][0]) == record.TTL {
+				return
+			}
+			u.rrsets[key] = []dns.DnsRecord{record}
+			u.changed = true
+			return
+		}
+
+	default:
+		cname := rrsetKey{Name: name, Type: dns.CNAME.ToNum()}
+		if len(u.rrsets[cname]) > 0 && !isCNAMECompanion(qtype) {
+			return
+		}
+	}
+
+	rrset := u.rrsets[key]
+	i := findRecord(rrset, record)
+	if i >= 0 {
+		if dns.RecordTTL(rrset[i]) == dns.RecordTTL(record) {
+			return
+		}
+		rrset = append([]dns.DnsRecord(nil), rrset...)
+		rrset[i] = record
+	} else {
+		rrset = append(append([]dns.DnsRecord(nil), rrset...), record)
+	}
+	u.rrsets[key] = rrset
+	u.changed = true
+}
+
+// isCNAMECompanion reports whether records of a type may sit next to a
+// CNAME record, as the DNSSEC records do.
+func isCNAMECompanion(qtype uint16) bool {
+	return qtype == dns.RRSIG.ToNum() || qtype == dns.NSEC.ToNum()
+}
+
+// Records returns the records of the new version of the zone. Its serial is
+// increased unless an update already did (RFC 2136 section 3.6).
+func (u *zoneUpdate) Records(serial uint32) []dns.DnsRecord {
+	soaKey := rrsetKey{Name: u.origin, Type: dns.SOA.ToNum()}
+	soa := u.rrsets[soaKey][0].(dns.SOARecord)
+	if !serialLess(serial, soa.Serial) {
+		soa.Serial = serial + 1
+	}
+
+	records := []dns.DnsRecord{soa}
+	for key, rrset := range u.rrsets {
+		if key != soaKey {
+			records = append(records, rrset...)
+		}
+	}
+	return records
+}
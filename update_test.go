@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/guoard/godns/dns"
+)
+
+func updateTestZone(t *testing.T) *zone {
+	t.Helper()
+	z, err := newZone("example.com", []dns.DnsRecord{
+		dns.SOARecord{Domain: "example.com", MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 10, Minimum: 300, TTL: 3600},
+		dns.NSRecord{Domain: "example.com", Host: "ns1.example.com", TTL: 3600},
+		dns.NSRecord{Domain: "example.com", Host: "ns2.example.com", TTL: 3600},
+		dns.MXRecord{Domain: "example.com", Priority: 10, Host: "mail.example.com", TTL: 3600},
+		dns.ARecord{Domain: "ns1.example.com", Addr: net.IPv4(192, 0, 2, 1).To4(), TTL: 3600},
+		dns.ARecord{Domain: "www.example.com", Addr: net.IPv4(192, 0, 2, 10).To4(), TTL: 300},
+		dns.ARecord{Domain: "www.example.com", Addr: net.IPv4(192, 0, 2, 11).To4(), TTL: 300},
+		dns.CNAMERecord{Domain: "alias.example.com", Host: "www.example.com", TTL: 300},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func wwwA(last byte, ttl uint32) dns.ARecord {
+	return dns.ARecord{Domain: "www.example.com", Addr: net.IPv4(192, 0, 2, last).To4(), TTL: ttl}
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	tests := []struct {
+		name    string
+		prereqs []dns.DnsRecord
+		want    dns.ResultCode
+	}{
+		{"name in use", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.TypeANY, Class: dns.ClassANY}}, dns.NOERROR},
+		{"name not in use", []dns.DnsRecord{dns.UpdateRecord{Domain: "none.example.com", QType: dns.TypeANY, Class: dns.ClassANY}}, dns.NXDOMAIN},
+		{"RRset exists", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.A.ToNum(), Class: dns.ClassANY}}, dns.NOERROR},
+		{"RRset does not exist", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.MX.ToNum(), Class: dns.ClassANY}}, dns.NXRRSET},
+		{"name is free", []dns.DnsRecord{dns.UpdateRecord{Domain: "none.example.com", QType: dns.TypeANY, Class: dns.ClassNONE}}, dns.NOERROR},
+		{"name is taken", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.TypeANY, Class: dns.ClassNONE}}, dns.YXDOMAIN},
+		{"RRset is free", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.MX.ToNum(), Class: dns.ClassNONE}}, dns.NOERROR},
+		{"RRset is taken", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.A.ToNum(), Class: dns.ClassNONE}}, dns.YXRRSET},
+		{"RRset holds exactly the records", []dns.DnsRecord{wwwA(11, 0), wwwA(10, 0)}, dns.NOERROR},
+		{"RRset holds more records", []dns.DnsRecord{wwwA(10, 0)}, dns.NXRRSET},
+		{"RRset holds other records", []dns.DnsRecord{wwwA(10, 0), wwwA(12, 0)}, dns.NXRRSET},
+		{"records for a missing RRset", []dns.DnsRecord{dns.ARecord{Domain: "none.example.com", Addr: net.IPv4(192, 0, 2, 1).To4()}}, dns.NXRRSET},
+		{"first failing prerequisite wins", []dns.DnsRecord{
+			dns.UpdateRecord{Domain: "www.example.com", QType: dns.A.ToNum(), Class: dns.ClassNONE},
+			dns.UpdateRecord{Domain: "none.example.com", QType: dns.TypeANY, Class: dns.ClassANY},
+		}, dns.YXRRSET},
+		{"name outside the zone", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.org", QType: dns.TypeANY, Class: dns.ClassANY}}, dns.NOTZONE},
+		{"TTL other than zero", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.TypeANY, Class: dns.ClassANY, TTL: 60}}, dns.FORMERR},
+		{"prerequisite with data", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.A.ToNum(), Class: dns.ClassANY, Record: wwwA(10, 0)}}, dns.FORMERR},
+		{"another class", []dns.DnsRecord{dns.UpdateRecord{Domain: "www.example.com", QType: dns.A.ToNum(), Class: 3}}, dns.FORMERR},
+		{"records of a meta type", []dns.DnsRecord{dns.UnknownRecord{Domain: "www.example.com", QType: 252}}, dns.FORMERR},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkPrerequisites(updateTestZone(t), test.prereqs); got != test.want {
+				t.Errorf("checkPrerequisites = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestZoneUpdateApply(t *testing.T) {
+	deleteName := func(name string) dns.UpdateRecord {
+		return dns.UpdateRecord{Domain: name, QType: dns.TypeANY, Class: dns.ClassANY}
+	}
+	deleteRRset := func(name string, qtype dns.QueryType) dns.UpdateRecord {
+		return dns.UpdateRecord{Domain: name, QType: qtype.ToNum(), Class: dns.ClassANY}
+	}
+	deleteRecord := func(record dns.DnsRecord) dns.UpdateRecord {
+		return dns.UpdateRecord{Domain: dns.RecordDomain(record), QType: dns.RecordType(record), Class: dns.ClassNONE, Record: record}
+	}
+	ns := func(host string) dns.NSRecord {
+		return dns.NSRecord{Domain: "example.com", Host: host, TTL: 3600}
+	}
+	soa := func(serial uint32) dns.SOARecord {
+		return dns.SOARecord{Domain: "example.com", MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: serial, Minimum: 300, TTL: 3600}
+	}
+
+	tests := []struct {
+		name        string
+		updates     []dns.DnsRecord
+		wantChanged bool
+		rrsetName   string
+		rrsetType   dns.QueryType
+		wantCount   int
+	}{
+		{"add a record", []dns.DnsRecord{wwwA(12, 300)}, true, "www.example.com", dns.A, 3},
+		{"add a record that is there", []dns.DnsRecord{wwwA(10, 300)}, false, "www.example.com", dns.A, 2},
+		{"add a record that is there with another TTL", []dns.DnsRecord{wwwA(10, 60)}, true, "www.example.com", dns.A, 2},
+		{"add a record at a new name", []dns.DnsRecord{dns.ARecord{Domain: "new.example.com", Addr: net.IPv4(192, 0, 2, 1).To4(), TTL: 300}}, true, "new.example.com", dns.A, 1},
+		{"add data next to a CNAME", []dns.DnsRecord{dns.ARecord{Domain: "alias.example.com", Addr: net.IPv4(192, 0, 2, 1).To4(), TTL: 300}}, false, "alias.example.com", dns.A, 0},
+		{"add a CNAME next to data", []dns.DnsRecord{dns.CNAMERecord{Domain: "www.example.com", Host: "example.com", TTL: 300}}, false, "www.example.com", dns.CNAME, 0},
+		{"replace a CNAME", []dns.DnsRecord{dns.CNAMERecord{Domain: "alias.example.com", Host: "example.com", TTL: 300}}, true, "alias.example.com", dns.CNAME, 1},
+		{"add an SOA with a smaller serial", []dns.DnsRecord{soa(9)}, false, "example.com", dns.SOA, 1},
+		{"add an SOA with a larger serial", []dns.DnsRecord{soa(11)}, true, "example.com", dns.SOA, 1},
+		{"delete a name", []dns.DnsRecord{deleteName("www.example.com")}, true, "www.example.com", dns.A, 0},
+		{"delete a name that isn't there", []dns.DnsRecord{deleteName("none.example.com")}, false, "none.example.com", dns.A, 0},
+		{"delete the apex keeps its NS records", []dns.DnsRecord{deleteName("example.com")}, true, "example.com", dns.NS, 2},
+		{"delete the apex removes other records", []dns.DnsRecord{deleteName("example.com")}, true, "example.com", dns.MX, 0},
+		{"delete an RRset", []dns.DnsRecord{deleteRRset("www.example.com", dns.A)}, true, "www.example.com", dns.A, 0},
+		{"delete the NS RRset of the apex", []dns.DnsRecord{deleteRRset("example.com", dns.NS)}, false, "example.com", dns.NS, 2},
+		{"delete a record", []dns.DnsRecord{deleteRecord(wwwA(10, 0))}, true, "www.example.com", dns.A, 1},
+		{"delete a record that isn't there", []dns.DnsRecord{deleteRecord(wwwA(12, 0))}, false, "www.example.com", dns.A, 2},
+		{"delete the SOA record", []dns.DnsRecord{deleteRecord(soa(10))}, false, "example.com", dns.SOA, 1},
+		{"delete an NS record of the apex", []dns.DnsRecord{deleteRecord(ns("ns2.example.com"))}, true, "example.com", dns.NS, 1},
+		{"delete every NS record of the apex", []dns.DnsRecord{deleteRecord(ns("ns2.example.com")), deleteRecord(ns("ns1.example.com"))}, true, "example.com", dns.NS, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			update := newZoneUpdate(updateTestZone(t))
+			for _, record := range test.updates {
+				update.Apply(record)
+			}
+
+			if update.changed != test.wantChanged {
+				t.Errorf("changed = %v, want %v", update.changed, test.wantChanged)
+			}
+			rrset := update.rrsets[rrsetKey{Name: test.rrsetName, Type: test.rrsetType.ToNum()}]
+			if len(rrset) != test.wantCount {
+				t.Errorf("%s has %d records of type %d, want %d: %v", test.rrsetName, len(rrset), test.rrsetType.ToNum(), test.wantCount, rrset)
+			}
+		})
+	}
+}
+
+func TestZoneUpdateReplacesTTL(t *testing.T) {
+	update := newZoneUpdate(updateTestZone(t))
+	update.Apply(wwwA(10, 60))
+
+	rrset := update.rrsets[rrsetKey{Name: "www.example.com", Type: dns.A.ToNum()}]
+	i := findRecord(rrset, wwwA(10, 0))
+	if i < 0 {
+		t.Fatal("record is gone")
+	}
+	if ttl := dns.RecordTTL(rrset[i]); ttl != 60 {
+		t.Errorf("TTL = %d, want 60", ttl)
+	}
+}
+
+func TestZoneUpdateRecordsSerial(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []dns.DnsRecord
+		want    uint32
+	}{
+		{"serial is increased", []dns.DnsRecord{wwwA(12, 300)}, 11},
+		{"serial raised by the update is kept", []dns.DnsRecord{dns.SOARecord{Domain: "example.com", MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 20, Minimum: 300, TTL: 3600}}, 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			z := updateTestZone(t)
+			update := newZoneUpdate(z)
+			for _, record := range test.updates {
+				update.Apply(record)
+			}
+
+			updated, err := newZone(z.Origin, update.Records(z.SOA().Serial))
+			if err != nil {
+				t.Fatalf("newZone: %v", err)
+			}
+			if serial := updated.SOA().Serial; serial != test.want {
+				t.Errorf("serial = %d, want %d", serial, test.want)
+			}
+		})
+	}
+}
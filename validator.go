@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guoard/godns/dns"
+)
+
+// defaultTrustAnchors are the DS records of the root key signing keys, as
+// published by IANA.
+const defaultTrustAnchors = "20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D," +
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"
+
+// errBogus is returned for responses that fail DNSSEC validation.
+var errBogus = errors.New("DNSSEC validation failed")
+
+// parseTrustAnchors parses a comma separated list of root DS records, each
+// written as its key tag, algorithm, digest type and hex digest.
+func parseTrustAnchors(value string) ([]dns.DSRecord, error) {
+	var anchors []dns.DSRecord
+	for _, anchor := range strings.Split(value, ",") {
+		fields := strings.Fields(anchor)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("malformed trust anchor %q", anchor)
+		}
+
+		var numbers [3]uint64
+		for i, bits := range []int{16, 8, 8} {
+			number, err := strconv.ParseUint(fields[i], 10, bits)
+			if err != nil {
+				return nil, fmt.Errorf("malformed trust anchor %q: %w", anchor, err)
+			}
+			numbers[i] = number
+		}
+
+		digest, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed trust anchor %q: %w", anchor, err)
+		}
+
+		anchors = append(anchors, dns.DSRecord{
+			Domain:     "",
+			KeyTag:     uint16(numbers[0]),
+			Algorithm:  uint8(numbers[1]),
+			DigestType: uint8(numbers[2]),
+			Digest:     digest,
+		})
+	}
+	return anchors, nil
+}
+
+// checkingDisabledKey marks the context of queries from clients that set
+// the CD bit.
+type checkingDisabledKey struct{}
+
+// withCheckingDisabled returns a context under which bogus answers are
+// handed out instead of failing.
+func withCheckingDisabled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, checkingDisabledKey{}, true)
+}
+
+// checkingDisabled reports whether the client asked for answers to be
+// returned even when they fail validation.
+func checkingDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(checkingDisabledKey{}).(bool)
+	return disabled
+}
+
+// validateResponse checks the DNSSEC signatures of a final response to a
+// query, received from the servers of zone. Secure responses get their AD
+// bit set, insecure ones are left alone and bogus ones make it return an
+// error wrapping errBogus.
+func validateResponse(ctx context.Context, zone string, qname string, qtype dns.QueryType, response *dns.DnsPacket) error {
+	if !*dnssecValidation {
+		return nil
+	}
+
+	// The DNSKEY set at the apex of a zone is what the keys of the zone are
+	// learned from, so it's checked against the DS records instead.
+	if qtype == dns.DNSKEY {
+		return validateZoneKeys(ctx, qname, response)
+	}
+
+	signer := signerZone(zone, qname, qtype, response)
+	keys, err := zoneKeys(ctx, signer)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return nil
+	}
+
+	err = verifyResponse(signer, qname, qtype, response, keys)
+	if !errors.Is(err, errBogus) || signer != zone {
+		return err
+	}
+
+	// An answer the zone didn't sign may come from an unsigned child zone
+	// that the same servers are authoritative for, reached without a
+	// referral.
+	insecure, lookupErr := insecureDelegation(ctx, zone, qname, qtype)
+	if lookupErr != nil {
+		return lookupErr
+	}
+	if insecure {
+		return nil
+	}
+	return err
+}
+
+// verifyResponse checks the signatures made by signer over the answer, and
+// over the denial when there is one, setting the AD bit when all of them
+// are secure.
+func verifyResponse(signer string, qname string, qtype dns.QueryType, response *dns.DnsPacket, keys []dns.DNSKEYRecord) error {
+	secure := true
+	for _, rrset := range recordSets(response.Answers) {
+		sig, err := verifyRRset(signer, rrset, response.Answers, keys)
+		if err != nil {
+			return err
+		}
+
+		// A signature with fewer labels than its owner was made over a
+		// wildcard the records were expanded from. Records owned by the
+		// wildcard itself are signed with its labels but for the "*" one.
+		owner := dns.RecordDomain(rrset[0])
+		if int(sig.Labels) < dns.SignatureLabelCount(owner) {
+			proven, err := validateWildcardAnswer(signer, owner, sig, response, keys)
+			if err != nil {
+				return err
+			}
+			secure = secure && proven
+		}
+	}
+
+	// A denial is only as good as the signature on the SOA record that
+	// comes with it, and the NSEC or NSEC3 records proving it.
+	if len(response.Answers) == 0 || response.Header.Rescode == dns.NXDOMAIN {
+		soa := response.GetSOA()
+		if soa == nil {
+			return fmt.Errorf("%w: unsigned denial for %s", errBogus, qname)
+		}
+
+		_, err := verifyRRset(signer, []dns.DnsRecord{*soa}, response.Authorities, keys)
+		if err != nil {
+			return err
+		}
+
+		proven, err := validateDenial(signer, chainEnd(response.Answers, qname), qtype, response, keys)
+		if err != nil {
+			return err
+		}
+		secure = secure && proven
+	}
+
+	response.Header.AuthedData = secure
+	return nil
+}
+
+// chainEnd returns the name the CNAME chain starting at qname leads to
+// within the records, which is what a denial that comes with the chain is
+// about.
+func chainEnd(records []dns.DnsRecord, qname string) string {
+	name := qname
+	for i := 0; i < maxCNAMEChain; i++ {
+		cname, found := cnameAt(records, name)
+		if !found {
+			break
+		}
+		name = cname.Host
+	}
+	return name
+}
+
+// validateZoneKeys checks the DNSKEY set of a zone against the DS records
+// published by its parent, or against the trust anchors for the root. The
+// set is secure when a key matching one of the DS records signed it, and
+// insecure when the parent proves there are no DS records to match.
+func validateZoneKeys(ctx context.Context, zone string, response *dns.DnsPacket) error {
+	dsRecords := rootAnchors.DSRecords()
+	if zone != "" {
+		dsResponse, err := resolve(ctx, zone, dns.DS)
+		if err != nil {
+			return err
+		}
+		if !dsResponse.Header.AuthedData {
+			return nil
+		}
+
+		dsRecords = nil
+		for _, record := range dsResponse.Answers {
+			ds, ok := record.(dns.DSRecord)
+			if ok && dns.IsSubdomain(ds.Domain, zone) && dns.IsSubdomain(zone, ds.Domain) {
+				dsRecords = append(dsRecords, ds)
+			}
+		}
+	}
+
+	// A zone only signed with algorithms we don't know is treated as
+	// unsigned (RFC 4035 section 5.2).
+	var usable []dns.DSRecord
+	for _, ds := range dsRecords {
+		if dns.SupportedAlgorithm(ds.Algorithm) && dns.SupportedDigest(ds.DigestType) {
+			usable = append(usable, ds)
+		}
+	}
+	if len(usable) == 0 {
+		return nil
+	}
+
+	var entryKeys []dns.DNSKEYRecord
+	var keySet []dns.DnsRecord
+	for _, record := range response.Answers {
+		key, ok := record.(dns.DNSKEYRecord)
+		if !ok || !dns.IsSubdomain(key.Domain, zone) || !dns.IsSubdomain(zone, key.Domain) {
+			continue
+		}
+
+		keySet = append(keySet, key)
+		for _, ds := range usable {
+			if dns.MatchesDS(ds, key) {
+				entryKeys = append(entryKeys, key)
+				break
+			}
+		}
+	}
+
+	if len(entryKeys) == 0 {
+		return fmt.Errorf("%w: no DNSKEY of %q matches its DS records", errBogus, zone)
+	}
+
+	_, err := verifyRRset(zone, keySet, response.Answers, entryKeys)
+	if err != nil {
+		return err
+	}
+
+	// Every validated root key set may move the trust anchors along a key
+	// rollover.
+	if zone == "" {
+		rootAnchors.Observe(response.Answers, time.Now())
+	}
+
+	response.Header.AuthedData = true
+	return nil
+}
+
+// zoneKeys returns the validated keys of a zone, or nil if the zone is
+// insecure.
+func zoneKeys(ctx context.Context, zone string) ([]dns.DNSKEYRecord, error) {
+	response, err := resolve(ctx, zone, dns.DNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	if !response.Header.AuthedData {
+		return nil, nil
+	}
+
+	var keys []dns.DNSKEYRecord
+	for _, record := range response.Answers {
+		key, ok := record.(dns.DNSKEYRecord)
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// signerZone returns the zone that should have signed the response, which is
+// the zone of the servers that sent it unless its signatures name a zone
+// below it, as happens when the servers are also authoritative for a child
+// zone. DS records are always signed by a zone above the one they are about.
+func signerZone(zone string, qname string, qtype dns.QueryType, response *dns.DnsPacket) string {
+	for _, section := range [][]dns.DnsRecord{response.Answers, response.Authorities} {
+		for _, record := range section {
+			sig, ok := record.(dns.RRSIGRecord)
+			if !ok || !dns.IsSubdomain(sig.SignerName, zone) || !dns.IsSubdomain(qname, sig.SignerName) {
+				continue
+			}
+			if qtype == dns.DS && dns.IsSubdomain(sig.SignerName, qname) {
+				continue
+			}
+			return sig.SignerName
+		}
+	}
+	return zone
+}
+
+// insecureDelegation reports whether an unsigned zone is delegated from
+// zone on the way down to qname, which is learned from the DS records of
+// each name in between, starting from the top (RFC 4035 section 5.2). It
+// stops at the first zone cut, signed or not.
+func insecureDelegation(ctx context.Context, zone string, qname string, qtype dns.QueryType) (bool, error) {
+	// DS records are served from the parent side of the zone cut at qname.
+	target := qname
+	if qtype == dns.DS {
+		target = parentDomain(qname)
+	}
+
+	var names []string
+	for name := target; dns.CompareNames(name, zone) != 0 && dns.IsSubdomain(name, zone); name = parentDomain(name) {
+		names = append([]string{name}, names...)
+	}
+
+	for _, name := range names {
+		response, err := resolve(ctx, name, dns.DS)
+		if err != nil {
+			return false, err
+		}
+		if !response.Header.AuthedData {
+			return true, nil
+		}
+		if len(recordsAt(response.Answers, name, dns.DS)) > 0 {
+			return false, nil
+		}
+		if provesDelegation(zone, name, response.Authorities) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// provesDelegation reports whether the NSEC or NSEC3 record of name found
+// among the records says that name is a zone cut, with NS records but no
+// SOA record.
+func provesDelegation(zone string, name string, records []dns.DnsRecord) bool {
+	var types []uint16
+	var nsec3s []dns.NSEC3Record
+	for _, record := range records {
+		switch record := record.(type) {
+		case dns.NSECRecord:
+			if dns.CompareNames(record.Domain, name) == 0 {
+				types = record.Types
+			}
+		case dns.NSEC3Record:
+			nsec3s = append(nsec3s, record)
+		}
+	}
+
+	if types == nil && len(nsec3s) > 0 {
+		proof, ok := newNSEC3Proof(zone, nsec3s)
+		if !ok {
+			return false
+		}
+		record, found, err := proof.matching(name)
+		if err != nil || !found {
+			return false
+		}
+		types = record.Types
+	}
+
+	return dns.HasType(types, dns.NS.ToNum()) && !dns.HasType(types, dns.SOA.ToNum())
+}
+
+// recordSets groups the records by owner and type, leaving signatures out.
+func recordSets(records []dns.DnsRecord) [][]dns.DnsRecord {
+	var sets [][]dns.DnsRecord
+	index := make(map[cacheKey]int)
+	for _, record := range records {
+		switch record.(type) {
+		case dns.RRSIGRecord, dns.OPTRecord:
+			continue
+		}
+
+		key := newCacheKey(dns.RecordDomain(record), dns.RecordType(record))
+		i, found := index[key]
+		if !found {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, nil)
+		}
+		sets[i] = append(sets[i], record)
+	}
+	return sets
+}
+
+// verifyRRset checks that one of the signatures found among records covers
+// the record set and was made by one of the keys of signer, and returns that
+// signature.
+func verifyRRset(signer string, rrset []dns.DnsRecord, records []dns.DnsRecord, keys []dns.DNSKEYRecord) (dns.RRSIGRecord, error) {
+	owner := dns.RecordDomain(rrset[0])
+	qtype := dns.RecordType(rrset[0])
+	now := time.Now()
+
+	for _, record := range records {
+		sig, ok := record.(dns.RRSIGRecord)
+		if !ok || sig.TypeCovered != qtype || !strings.EqualFold(sig.Domain, owner) {
+			continue
+		}
+		if !strings.EqualFold(sig.SignerName, signer) || !dns.SignatureValidAt(sig, now) {
+			continue
+		}
+
+		for _, key := range keys {
+			if key.Flags&dns.DNSKEYFlagRevoke != 0 {
+				continue
+			}
+
+			err := dns.VerifyRRSIG(sig, key, rrset)
+			if err == nil {
+				return sig, nil
+			}
+		}
+	}
+
+	return dns.RRSIGRecord{}, fmt.Errorf("%w: no valid signature by %q for %s type %d", errBogus, signer, owner, qtype)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/guoard/godns/dns"
+)
+
+// zoneNode is a name of a zone along with the record sets it owns, keyed by
+// type, and the nodes of the names one label below it. Nodes without record
+// sets are empty non-terminals.
+type zoneNode struct {
+	Name     string
+	RRsets   map[uint16][]dns.DnsRecord
+	Children map[string]*zoneNode
+}
+
+// newZoneNode returns an empty node for name.
+func newZoneNode(name string) *zoneNode {
+	return &zoneNode{
+		Name:     name,
+		RRsets:   make(map[uint16][]dns.DnsRecord),
+		Children: make(map[string]*zoneNode),
+	}
+}
+
+// zone is a zone we serve authoritatively, held as a tree of names below
+// its apex. A zone is never modified once built: changes build a new zone
+// which then replaces the old one as a whole.
+type zone struct {
+	Origin  string
+	apex    *zoneNode
+	records []dns.DnsRecord
+	journal []zoneDiff
+}
+
+// newZone builds a zone from its records, checking that they all belong to
+// it and that its apex has an SOA record and NS records.
+func newZone(origin string, records []dns.DnsRecord) (*zone, error) {
+	origin = strings.ToLower(strings.TrimSuffix(origin, "."))
+	z := &zone{Origin: origin, apex: newZoneNode(origin)}
+
+	for _, record := range records {
+		name := dns.RecordDomain(record)
+		if !dns.IsSubdomain(name, origin) {
+			return nil, fmt.Errorf("record for %s is outside of zone %s", name, origin)
+		}
+
+		switch record.(type) {
+		case dns.SOARecord:
+			if name != origin {
+				return nil, fmt.Errorf("SOA record for %s is not at the apex of zone %s", name, origin)
+			}
+			if len(z.apex.RRsets[dns.SOA.ToNum()]) > 0 {
+				return nil, fmt.Errorf("zone %s has more than one SOA record", origin)
+			}
+		case dns.OPTRecord:
+			return nil, errors.New("OPT records can't be served from a zone")
+		}
+
+		node := z.addNode(name)
+		qtype := dns.RecordType(record)
+		node.RRsets[qtype] = append(node.RRsets[qtype], record)
+	}
+
+	if len(z.apex.RRsets[dns.SOA.ToNum()]) == 0 {
+		return nil, fmt.Errorf("zone %s has no SOA record", origin)
+	}
+	if len(z.apex.RRsets[dns.NS.ToNum()]) == 0 {
+		return nil, fmt.Errorf("zone %s has no NS records", origin)
+	}
+
+	var err error
+	z.walk(func(node *zoneNode) {
+		if err == nil && len(node.RRsets[dns.CNAME.ToNum()]) > 0 && !onlyCNAMEData(node) {
+			err = fmt.Errorf("CNAME record at %s next to other data", node.Name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The records are kept with the SOA record first, the order zone
+	// transfers send them in.
+	z.records = append(z.records, z.SOA())
+	z.walk(func(node *zoneNode) {
+		for _, qtype := range node.sortedTypes() {
+			if qtype != dns.SOA.ToNum() {
+				z.records = append(z.records, node.RRsets[qtype]...)
+			}
+		}
+	})
+
+	return z, nil
+}
+
+// onlyCNAMEData reports whether a node holding a CNAME record holds nothing
+// else but the DNSSEC records that may share its name (RFC 2181 section
+// 10.1).
+func onlyCNAMEData(node *zoneNode) bool {
+	for qtype := range node.RRsets {
+		switch dns.QueryTypeFromNum(qtype) {
+		case dns.CNAME, dns.RRSIG, dns.NSEC:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// addNode returns the node of a name of the zone, creating it and the
+// empty non-terminals above it as needed.
+func (z *zone) addNode(name string) *zoneNode {
+	node := z.apex
+	for _, label := range z.relativeLabels(name) {
+		child, found := node.Children[label]
+		if !found {
+			child = newZoneNode(label + "." + node.Name)
+			if node.Name == "" {
+				child.Name = label
+			}
+			node.Children[label] = child
+		}
+		node = child
+	}
+	return node
+}
+
+// relativeLabels returns the labels of a name of the zone below its apex,
+// starting from the one closest to the apex.
+func (z *zone) relativeLabels(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	relative := strings.TrimSuffix(name, z.Origin)
+	relative = strings.TrimSuffix(relative, ".")
+	if relative == "" {
+		return nil
+	}
+
+	labels := strings.Split(relative, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// walk calls visit for every node of the zone, parents before children and
+// siblings in label order.
+func (z *zone) walk(visit func(node *zoneNode)) {
+	var walkNode func(node *zoneNode)
+	walkNode = func(node *zoneNode) {
+		visit(node)
+
+		labels := make([]string, 0, len(node.Children))
+		for label := range node.Children {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+
+		for _, label := range labels {
+			walkNode(node.Children[label])
+		}
+	}
+	walkNode(z.apex)
+}
+
+// sortedTypes returns the types of the record sets of a node in ascending
+// order.
+func (node *zoneNode) sortedTypes() []uint16 {
+	types := make([]uint16, 0, len(node.RRsets))
+	for qtype := range node.RRsets {
+		types = append(types, qtype)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// Loaded reports whether the zone holds data. Secondary zones that were
+// never transferred or that expired are served empty, and answered with
+// SERVFAIL.
+func (z *zone) Loaded() bool {
+	return z != nil && z.apex != nil
+}
+
+// SOA returns the SOA record of the zone.
+func (z *zone) SOA() dns.SOARecord {
+	return z.apex.RRsets[dns.SOA.ToNum()][0].(dns.SOARecord)
+}
+
+// Records returns every record of the zone, starting with its SOA record.
+func (z *zone) Records() []dns.DnsRecord {
+	return z.records
+}
+
+// Node returns the node owning name, whether or not it lies below a zone
+// cut, or nil when the name doesn't exist in the zone.
+func (z *zone) Node(name string) *zoneNode {
+	if !dns.IsSubdomain(name, z.Origin) {
+		return nil
+	}
+
+	node := z.apex
+	for _, label := range z.relativeLabels(name) {
+		node = node.Children[label]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// Find walks down the zone towards name. It returns the zone cut found on
+// the way, if any, and otherwise the node owning name. When name doesn't
+// exist, the node is nil and encloser is its closest encloser, the deepest
+// existing name above it (RFC 4592 section 3.3.1). A cut at name itself is
+// ignored for DS queries, which the parent side of the cut answers (RFC
+// 4035 section 3.1.4.1).
+func (z *zone) Find(name string, qtype uint16) (node *zoneNode, encloser *zoneNode, cut *zoneNode) {
+	labels := z.relativeLabels(name)
+
+	node = z.apex
+	for i, label := range labels {
+		child := node.Children[label]
+		if child == nil {
+			return nil, node, nil
+		}
+		node = child
+
+		last := i == len(labels)-1
+		if len(node.RRsets[dns.NS.ToNum()]) > 0 && !(last && qtype == dns.DS.ToNum()) {
+			return nil, nil, node
+		}
+	}
+	return node, nil, nil
+}
+
+// zoneSet holds the zones we serve authoritatively, safe for concurrent
+// use.
+type zoneSet struct {
+	mu    sync.RWMutex
+	zones map[string]*zone
+}
+
+// authZones are the zones we serve authoritatively.
+var authZones = &zoneSet{zones: make(map[string]*zone)}
+
+// Find returns the deepest zone that name belongs to, or nil when we are
+// not authoritative for it. DS records at the apex of a zone belong to its
+// parent, which is used instead when we serve it too.
+func (s *zoneSet) Find(name string, qtype uint16) *zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.zones) == 0 {
+		return nil
+	}
+
+	qname := strings.ToLower(strings.TrimSuffix(name, "."))
+	name = qname
+	var found *zone
+	for {
+		z, ok := s.zones[name]
+		if ok {
+			if found != nil || qtype != dns.DS.ToNum() || name != qname {
+				return z
+			}
+			found = z
+		}
+		if name == "" {
+			return found
+		}
+		name = parentDomain(name)
+	}
+}
+
+// Get returns the zone with the given origin, if we serve it.
+func (s *zoneSet) Get(origin string) (*zone, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	z, found := s.zones[origin]
+	return z, found
+}
+
+// Store adds a zone, replacing the previous version of the same zone whose
+// changes are kept in the journal of the new one, and notifies the
+// secondaries of the change.
+func (s *zoneSet) Store(z *zone) {
+	s.mu.Lock()
+	previous := s.zones[z.Origin]
+	z.withJournal(previous)
+	s.zones[z.Origin] = z
+	s.mu.Unlock()
+
+	// Secondaries are told about new versions of the zone (RFC 1996).
+	if previous.Loaded() && z.Loaded() && serialLess(previous.SOA().Serial, z.SOA().Serial) {
+		notifySecondaries(z)
+	}
+}
+
+// loadZones reads the zone files listed as comma separated "origin=path"
+// pairs and adds them to the served zones. Zones already served are only
+// replaced when the serial of their file was increased.
+func loadZones(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		origin, path, found := strings.Cut(item, "=")
+		if !found {
+			return fmt.Errorf("malformed zone %q, expected origin=path", item)
+		}
+
+		z, err := loadZoneFile(origin, path)
+		if err != nil {
+			return err
+		}
+
+		previous, found := authZones.Get(z.Origin)
+		if found && previous.Loaded() && !serialLess(previous.SOA().Serial, z.SOA().Serial) {
+			fmt.Printf("Keeping zone %s, the serial in %s was not increased\n", z.Origin, path)
+			continue
+		}
+
+		authZones.Store(z)
+		fmt.Printf("Loaded zone %s with serial %d\n", z.Origin, z.SOA().Serial)
+	}
+	return nil
+}
+
+// loadZoneFile reads a zone from a file in the master file format.
+func loadZoneFile(origin string, path string) (*zone, error) {
+	records, err := dns.ReadZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := newZone(origin, records)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return z, nil
+}
+
+// reloadZonesOnHangup loads the zone files again whenever the process
+// receives SIGHUP.
+func reloadZonesOnHangup(spec string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		err := loadZones(spec)
+		if err != nil {
+			fmt.Printf("Failed to reload zones: %+v\n", err)
+		}
+	}
+}